@@ -1,26 +1,133 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/cache"
+	"httpfromtcp/internal/compress"
+	"httpfromtcp/internal/content"
+	"httpfromtcp/internal/https"
+	"httpfromtcp/internal/proxy"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/sse"
+	"httpfromtcp/internal/websocket"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
-const port = 42069
+const (
+	port    = 42069
+	tlsPort = 42443
+)
+
+// startTime stands in for the modification time of the pages built into the binary.
+var startTime = time.Now()
+
+var assetsHandler = content.FileServer(os.DirFS("."), content.WithDirectoryListing())
+
+var httpbinProxy = proxy.Handler(
+	&url.URL{Scheme: "https", Host: "httpbin.org"},
+	proxy.WithTransport(mustCache(cache.New(proxy.DefaultTransport))),
+	proxy.WithRewrite(func(out *http.Request, in *request.Request) {
+		out.URL.Path = strings.TrimPrefix(out.URL.Path, "/httpbin")
+		out.URL.RawPath = ""
+	}),
+)
+
+// forwardACL lets the forward proxy and CONNECT tunnels reach the given host:port pairs and
+// nothing else. Each needs a host without wildcards and an explicit port, and loopback and the
+// unspecified addresses are denied ahead of them, by name and by address, so the proxy cannot be
+// turned on this machine's own services.
+func forwardACL(destinations []string) (*proxy.ACL, error) {
+	acl := proxy.NewACL()
+	for _, pattern := range []string{"localhost", "127.0.0.0/8", "[::1]", "0.0.0.0/8", "[::]"} {
+		if err := acl.Deny(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, dest := range destinations {
+		dest = strings.TrimSpace(dest)
+		host, port, err := net.SplitHostPort(dest)
+		if err != nil {
+			return nil, fmt.Errorf("destination %q is not host:port: %w", dest, err)
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("destination %q needs an explicit port", dest)
+		}
+		if host == "" || strings.ContainsAny(host, "*/") {
+			return nil, fmt.Errorf("destination %q needs an explicit host", dest)
+		}
+		if addr, err := netip.ParseAddr(host); strings.EqualFold(host, "localhost") || (err == nil && (addr.Unmap().IsLoopback() || addr.Unmap().IsUnspecified())) {
+			return nil, fmt.Errorf("destination %q is this machine", dest)
+		}
+		if err := acl.Allow(dest); err != nil {
+			return nil, err
+		}
+	}
+	return acl, nil
+}
+
+func mustCache(c *cache.Cache, err error) *cache.Cache {
+	if err != nil {
+		log.Fatalf("Error creating cache: %v", err)
+	}
+	return c
+}
 
 func main() {
-	server, err := server.Serve(port, handler)
+	log.SetOutput(io.MultiWriter(os.Stderr, logs))
+
+	// TLS_CERT_FILE and TLS_KEY_FILE turn on https as well, reloading the certificate on change.
+	// REDIRECT_PORT then adds a plain http listener that sends everyone to https.
+	if certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"); certFile != "" && keyFile != "" {
+		tlsServer, err := server.ServeTLS(tlsPort, https.HSTS(compress.Handler(handler, compress.DefaultMinSize)), certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Error starting TLS server: %v", err)
+		}
+		defer tlsServer.Close()
+		log.Println("TLS server started on port", tlsPort)
+
+		if redirectPort := os.Getenv("REDIRECT_PORT"); redirectPort != "" {
+			p, err := strconv.Atoi(redirectPort)
+			if err != nil {
+				log.Fatalf("Error reading REDIRECT_PORT: %v", err)
+			}
+			redirectServer, err := server.Serve(p, https.Redirect(tlsPort))
+			if err != nil {
+				log.Fatalf("Error starting redirect server: %v", err)
+			}
+			defer redirectServer.Close()
+			log.Println("Redirecting to https from port", p)
+		}
+	}
+
+	// FORWARD_PROXY_ALLOW turns on the forward proxy and CONNECT tunnels, for the comma-separated
+	// host:port destinations it lists. Without it neither is served.
+	h := compress.Handler(handler, compress.DefaultMinSize)
+	opts := []server.Option{server.WithH2C()}
+	if allow := os.Getenv("FORWARD_PROXY_ALLOW"); allow != "" {
+		acl, err := forwardACL(strings.Split(allow, ","))
+		if err != nil {
+			log.Fatalf("Error reading FORWARD_PROXY_ALLOW: %v", err)
+		}
+		h = proxy.Forward(h, acl)
+		opts = append(opts, server.WithConnectHandler(proxy.Tunnel(acl)))
+		log.Println("Forward proxy enabled for", allow)
+	}
+
+	server, err := server.Serve(port, h, opts...)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -44,14 +151,26 @@ func handler(w *response.Writer, req *request.Request) {
 		return
 	}
 	if strings.HasPrefix(t, "/httpbin/") {
-		proxyHandler(req, w)
+		httpbinProxy(w, req)
 		return 
 	}
+	if strings.HasPrefix(t, "/assets/") {
+		assetsHandler(w, req)
+		return
+	}
+	if t == "/events" {
+		eventsHandler(w, req)
+		return
+	}
+	if t == "/echo" {
+		echoHandler(w, req)
+		return
+	}
 	if t == "/video" {
-		videoHandler(w)
+		videoHandler(w, req)
 		return
 	}
-	handler200(w)
+	handler200(w, req)
 }
 
 func handler400(w *response.Writer) {
@@ -90,8 +209,7 @@ func handler500(w *response.Writer) {
 	w.WriteBody(body)
 }
 
-func handler200(w *response.Writer) {
-	w.WriteRequestLine(response.StatusOK)
+func handler200(w *response.Writer, req *request.Request) {
 	body := []byte(`<html>
 <head>
 <title>200 OK</title>
@@ -102,85 +220,103 @@ func handler200(w *response.Writer) {
 </body>
 </html>
 `)
-	h := response.GetDefaultHeaders(len(body))
-	h["Content-Type"] = "text/html"
-	w.WriteHeaders(h)
-	w.WriteBody(body)
+	content.ServeBytes(w, req, "text/html", startTime, body)
 }
 
-func proxyHandler(req *request.Request, w *response.Writer) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	url := "https://httpbin.org/" + target
-	fmt.Printf("Proxying to %s\n", url)
+func videoHandler(w *response.Writer, req *request.Request) {
+	f, err := os.Open("assets/vim.mp4")
+	if err != nil {
+		handler500(w)
+		return 
+	}
+	defer f.Close()
 
-	resp, err := http.Get(url)
+	info, err := f.Stat()
 	if err != nil {
 		handler500(w)
 		return
 	}
-	defer resp.Body.Close()
-
-	w.WriteRequestLine(response.StatusOK)
 
-	h := response.GetDefaultHeaders(0)
-	delete(h, "Content-Length")
-	h["Transfer-Encoding"] = "chunked"
-	h["Trailer"] = "X-Content-SHA256, X-Content-Length"
-	w.WriteHeaders(h)
+	v := content.Validators{
+		ETag:         content.WeakETag(info.Size(), info.ModTime()),
+		LastModified: info.ModTime(),
+	}
+	content.ServeContent(w, req, "video/mp4", v, f)
+}
 
-	const maxChunkSize = 1024
-	buffer := make([]byte, maxChunkSize)
-	allChunks := make([]byte, 0)
+// echoHandler sends every WebSocket message it receives straight back.
+func echoHandler(w *response.Writer, req *request.Request) {
+	conn, err := websocket.Upgrade(w, req)
+	if err != nil {
+		return
+	}
 	for {
-		n, err := resp.Body.Read(buffer)
-		if err == io.EOF {
-			break
-		}
+		typ, msg, err := conn.ReadMessage()
 		if err != nil {
-			fmt.Printf("Error reading response body: %s", err)
-			break
+			conn.Close(websocket.CloseNormal, "")
+			return
 		}
-
-		fmt.Printf("Read %d bytes from %s\n", n, url)
-		_, err = w.WriteChunkedBody(buffer[:n])
-		if err != nil {
-			fmt.Printf("Error writing chunked body to response: %s\n", err)
-			break
+		if err := conn.WriteMessage(typ, msg); err != nil {
+			conn.Close(websocket.CloseInternalError, "")
+			return
 		}
-		fmt.Printf("Writing %d bytes to response\n", n)
-
-		len := len(allChunks) + n 
-		allChunks = append(allChunks, buffer[:n]...)
-		allChunks = allChunks[:len]
 	}
+}
 
-	_, err = w.WriteChunkedBodyDone()
-	if err != nil {
-		fmt.Printf("Error writing chunked body done: %s", err)
+// logFeed hands every line written to the log to the event streams listening at the time. A
+// listener that falls behind misses lines rather than holding up the log.
+type logFeed struct {
+	mu        sync.Mutex
+	listeners map[chan string]struct{}
+}
+
+var logs = &logFeed{listeners: make(map[chan string]struct{})}
+
+func (f *logFeed) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.listeners {
+		select {
+		case ch <- line:
+		default:
+		}
 	}
+	return len(p), nil
+}
 
-	hashAllChunks := sha256.Sum256(allChunks)
-	hexStr := hex.EncodeToString(hashAllChunks[:])
+func (f *logFeed) listen() chan string {
+	ch := make(chan string, 64)
+	f.mu.Lock()
+	f.listeners[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch
+}
 
-	trailers := make(headers.Headers)
-	trailers["X-Content-SHA256"] = hexStr
-	trailers["X-Content-Length"] = fmt.Sprintf("%d", len(allChunks))
-	w.WriteTrailers(trailers)
+func (f *logFeed) stopListening(ch chan string) {
+	f.mu.Lock()
+	delete(f.listeners, ch)
+	f.mu.Unlock()
 }
 
-func videoHandler(w *response.Writer) {
-	body, err := os.ReadFile("assets/vim.mp4")
+// eventsHandler streams the server's log lines as Server-Sent Events until the client leaves.
+func eventsHandler(w *response.Writer, req *request.Request) {
+	stream, err := sse.NewStream(w, req)
 	if err != nil {
-		handler500(w)
-		return 
+		return
 	}
+	defer stream.Close()
+	lines := logs.listen()
+	defer logs.stopListening(lines)
 
-	w.WriteRequestLine(response.StatusOK)
-
-	h := response.GetDefaultHeaders(len(body))
-	h["Content-Type"] = "video/mp4"
-	w.WriteHeaders(h)
-
-	w.WriteBody(body)
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case line := <-lines:
+			if err := stream.Send(sse.Event{Event: "log", Data: line}); err != nil {
+				return
+			}
+		}
+	}
 }
-
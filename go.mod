@@ -2,10 +2,13 @@ module httpfromtcp
 
 go 1.25.0
 
+require (
+	github.com/stretchr/testify v1.10.0
+	golang.org/x/tools/cmd/getgo v0.1.0-deprecated
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
-	golang.org/x/tools/cmd/getgo v0.1.0-deprecated
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
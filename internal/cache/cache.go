@@ -0,0 +1,500 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"httpfromtcp/internal/response"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxBytes bounds the memory the cache uses for entries.
+	DefaultMaxBytes = 64 << 20
+	// DefaultMaxEntryBytes is the largest body the cache keeps. Bigger responses are streamed
+	// through without being stored.
+	DefaultMaxEntryBytes = 4 << 20
+
+	// cacheName identifies this cache in Cache-Status headers (RFC 9211).
+	cacheName = "httpfromtcp"
+)
+
+// notModifiedHeaders are the fields a 304 carries over from the stored response, per RFC 9110
+// section 15.4.5.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+type Option func(*Cache)
+
+// WithMaxBytes bounds the memory used for entries. Once it is reached the least recently used
+// entries are dropped.
+func WithMaxBytes(maxBytes int64) Option {
+	return func(c *Cache) {
+		c.maxBytes = maxBytes
+	}
+}
+
+// WithMaxEntryBytes sets the largest body that is stored.
+func WithMaxEntryBytes(maxEntryBytes int64) Option {
+	return func(c *Cache) {
+		c.maxEntryBytes = maxEntryBytes
+	}
+}
+
+// WithDisk also keeps entries as files in dir, up to maxBytes of them, so the cache can hold
+// more than fits in memory and survives a restart. Memory then only holds the recently used
+// ones.
+func WithDisk(dir string, maxBytes int64) Option {
+	return func(c *Cache) {
+		c.diskDir = dir
+		c.diskMaxBytes = maxBytes
+	}
+}
+
+// Cache is a shared HTTP cache as RFC 9111 describes it, in the form of an http.RoundTripper
+// that sits in front of another one. Put it in a reverse proxy with proxy.WithTransport.
+//
+// GET responses are stored when Cache-Control, Expires or the status code allow it, keyed on
+// the URL and on the request headers the response's Vary names. A stored response is served
+// while it is fresh, with an Age header. Once it is stale it is revalidated with a conditional
+// request, unless stale-while-revalidate allows serving it as is while that happens in the
+// background. Conditional requests from clients are answered from the cache too. Successful
+// POST, PUT, PATCH and DELETE requests drop what is stored for their URL.
+type Cache struct {
+	next          http.RoundTripper
+	maxBytes      int64
+	maxEntryBytes int64
+	diskDir       string
+	diskMaxBytes  int64
+	now           func() time.Time
+
+	mu           sync.Mutex
+	store        store
+	revalidating map[string]bool
+	background   sync.WaitGroup
+}
+
+// New returns a cache in front of next.
+func New(next http.RoundTripper, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		next:          next,
+		maxBytes:      DefaultMaxBytes,
+		maxEntryBytes: DefaultMaxEntryBytes,
+		now:           time.Now,
+		revalidating:  make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	memory := newMemoryStore(c.maxBytes)
+	c.store = memory
+	if c.diskDir != "" {
+		disk, err := newDiskStore(c.diskDir, c.diskMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open cache directory: %w", err)
+		}
+		c.store = &tieredStore{memory: memory, disk: disk}
+	}
+	return c, nil
+}
+
+func (c *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp, err := c.next.RoundTrip(req)
+		if err == nil && isUnsafe(req.Method) && resp.StatusCode < 400 {
+			c.invalidate(req, resp)
+		}
+		return resp, err
+	}
+	if req.Header.Get("Range") != "" {
+		// Partial responses are not stored, and serving ranges out of a full one is left to
+		// the upstream.
+		return c.next.RoundTrip(req)
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	key := primaryKey(req.URL)
+	e, ok := c.lookup(key, req.Header)
+	if !ok {
+		if reqCC.has("only-if-cached") {
+			return gatewayTimeout(req), nil
+		}
+		return c.fetch(req, key, nil)
+	}
+
+	now := c.now()
+	age := e.age(now)
+	lifetime := freshnessLifetime(e.Header, e.StatusCode)
+	respCC := parseCacheControl(e.Header)
+	if reusable(req, reqCC, respCC, age, lifetime) {
+		return c.serve(req, e, age, "hit"), nil
+	}
+
+	if swr, ok := respCC.seconds("stale-while-revalidate"); ok && age < lifetime+swr &&
+		!reqCC.has("no-cache") && !mustRevalidate(respCC) {
+		c.revalidateInBackground(req, key, e)
+		return c.serve(req, e, age, "hit; detail=stale-while-revalidate"), nil
+	}
+	if reqCC.has("only-if-cached") {
+		return gatewayTimeout(req), nil
+	}
+	return c.fetch(req, key, e)
+}
+
+// reusable decides whether a stored response can be sent without asking the upstream, weighing
+// its freshness against what the client will accept (RFC 9111 sections 4.2 and 5.2.1).
+func reusable(req *http.Request, reqCC, respCC directives, age, lifetime time.Duration) bool {
+	if respCC.has("no-cache") || reqCC.has("no-cache") {
+		return false
+	}
+	if len(req.Header.Values("Cache-Control")) == 0 && strings.EqualFold(req.Header.Get("Pragma"), "no-cache") {
+		return false
+	}
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+
+	if mustRevalidate(respCC) || !reqCC.has("max-stale") {
+		return false
+	}
+	if reqCC["max-stale"] == "" {
+		return true
+	}
+	maxStale, _ := reqCC.seconds("max-stale")
+	return age-lifetime <= maxStale
+}
+
+// mustRevalidate reports directives that forbid a shared cache from ever serving the response
+// stale. s-maxage implies proxy-revalidate.
+func mustRevalidate(respCC directives) bool {
+	return respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage")
+}
+
+// fetch forwards req and stores the answer if it may. With stale set, the request is made
+// conditional on it, and a 304 refreshes it instead. The client's own conditional headers are
+// held back so that the cache gets a full response to store, and then applied to the answer.
+func (c *Cache) fetch(req *http.Request, key string, stale *entry) (*http.Response, error) {
+	if req.Method == "HEAD" && stale == nil {
+		return c.next.RoundTrip(req)
+	}
+
+	out := req.Clone(req.Context())
+	out.Method = "GET"
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if stale != nil {
+		if etag := stale.Header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := stale.Header.Get("Last-Modified"); lastModified != "" {
+			out.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := c.now()
+	resp, err := c.next.RoundTrip(out)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := c.now()
+
+	if stale != nil && resp.StatusCode == 304 {
+		resp.Body.Close()
+		refreshed := stale.refresh(resp.Header, requestTime, responseTime)
+		c.put(key, req.Header, refreshed)
+		return c.serve(req, refreshed, refreshed.age(responseTime), "fwd=stale; fwd-status=304"), nil
+	}
+
+	if !storable(out, resp) {
+		if stale != nil && resp.StatusCode < 500 {
+			c.remove(key)
+		}
+		resp.Header.Set("Cache-Status", cacheName+"; fwd="+forwardReason(stale)+"; fwd-status="+strconv.Itoa(resp.StatusCode))
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.maxEntryBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > c.maxEntryBytes {
+		// Too big to keep; hand it over with what was already read put back in front.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		resp.Header.Set("Cache-Status", cacheName+"; fwd="+forwardReason(stale))
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	e := &entry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	e.Header.Del("Cache-Status")
+	if e.Header.Get("Date") == "" {
+		e.Header.Set("Date", responseTime.UTC().Format(response.TimeFormat))
+	}
+	c.put(key, req.Header, e)
+	return c.serve(req, e, e.age(responseTime), "fwd="+forwardReason(stale)+"; stored"), nil
+}
+
+func forwardReason(stale *entry) string {
+	if stale != nil {
+		return "stale"
+	}
+	return "miss"
+}
+
+// revalidateInBackground refreshes e without holding up req. Only one refresh per URL runs at
+// a time.
+func (c *Cache) revalidateInBackground(req *http.Request, key string, e *entry) {
+	c.mu.Lock()
+	if c.revalidating[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[key] = true
+	c.mu.Unlock()
+
+	out := req.Clone(context.WithoutCancel(req.Context()))
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, key)
+			c.mu.Unlock()
+		}()
+		if resp, err := c.fetch(out, key, e); err == nil {
+			resp.Body.Close()
+		}
+	}()
+}
+
+// serve builds a response out of e, or a 304 if the client's conditional headers say it
+// already has it.
+func (c *Cache) serve(req *http.Request, e *entry, age time.Duration, status string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Set("Cache-Status", cacheName+"; "+status)
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	if req.Method == "HEAD" {
+		resp.Body = http.NoBody
+	}
+
+	if e.StatusCode == 200 && notModified(req.Header, e.Header) {
+		notModified := make(http.Header)
+		for _, key := range append(notModifiedHeaders, "Age", "Cache-Status") {
+			if vs := h.Values(key); len(vs) > 0 {
+				notModified[http.CanonicalHeaderKey(key)] = vs
+			}
+		}
+		resp.Status = "304 Not Modified"
+		resp.StatusCode = 304
+		resp.Header = notModified
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+	}
+	return resp
+}
+
+// notModified evaluates a client's If-None-Match, or failing that If-Modified-Since, against a
+// stored response.
+func notModified(reqHeader, stored http.Header) bool {
+	if list := reqHeader.Get("If-None-Match"); list != "" {
+		etag := strings.TrimPrefix(stored.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range splitDirectives(list) {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := response.ParseTime(reqHeader.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := response.ParseTime(stored.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+func (e *entry) age(now time.Time) time.Duration {
+	return initialAge(e.Header, e.RequestTime, e.ResponseTime) + now.Sub(e.ResponseTime)
+}
+
+// refresh returns a copy of e with the header fields of a 304 laid over its own, as RFC 9111
+// section 4.3.4 asks, except for those describing the body, which the 304 did not carry.
+func (e *entry) refresh(h http.Header, requestTime, responseTime time.Time) *entry {
+	refreshed := *e
+	refreshed.Header = e.Header.Clone()
+	for key, vs := range h {
+		switch key {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding", "Cache-Status":
+			continue
+		}
+		refreshed.Header[key] = vs
+	}
+	refreshed.RequestTime = requestTime
+	refreshed.ResponseTime = responseTime
+	return &refreshed
+}
+
+// primaryKey is the URL without its fragment, which never reaches the server anyway.
+func primaryKey(u *url.URL) string {
+	keyURL := *u
+	keyURL.Fragment = ""
+	keyURL.RawFragment = ""
+	return keyURL.String()
+}
+
+// variantKey extends key with the request's values for the fields the response varies on.
+func variantKey(key string, fields []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, field := range fields {
+		values := make([]string, 0)
+		for _, v := range h.Values(field) {
+			for _, part := range strings.Split(v, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					values = append(values, part)
+				}
+			}
+		}
+		b.WriteString("\x00" + field + ":" + strings.Join(values, ","))
+	}
+	return b.String()
+}
+
+func varyFields(h http.Header) []string {
+	fields := make([]string, 0)
+	for _, val := range h.Values("Vary") {
+		for _, field := range strings.Split(val, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	return fields
+}
+
+func (c *Cache) lookup(key string, reqHeader http.Header) (*entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.store.get(key)
+	if !ok || e.StatusCode != 0 {
+		return e, ok
+	}
+	return c.store.get(variantKey(key, e.Vary, reqHeader))
+}
+
+func (c *Cache) put(key string, reqHeader http.Header, e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fields := varyFields(e.Header)
+	if len(fields) == 0 {
+		c.removeLocked(key)
+		c.store.put(key, e)
+		return
+	}
+
+	index, ok := c.store.get(key)
+	if !ok || index.StatusCode != 0 || strings.Join(index.Vary, ",") != strings.Join(fields, ",") {
+		c.removeLocked(key)
+		index = &entry{Vary: fields}
+	}
+	variant := variantKey(key, fields, reqHeader)
+	known := false
+	for _, v := range index.Variants {
+		known = known || v == variant
+	}
+	if !known {
+		index = &entry{Vary: index.Vary, Variants: append(index.Variants[:len(index.Variants):len(index.Variants)], variant)}
+	}
+	c.store.put(key, index)
+	c.store.put(variant, e)
+}
+
+func (c *Cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *Cache) removeLocked(key string) {
+	if index, ok := c.store.get(key); ok {
+		for _, variant := range index.Variants {
+			c.store.remove(variant)
+		}
+	}
+	c.store.remove(key)
+}
+
+func isUnsafe(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH" || method == "DELETE"
+}
+
+// invalidate drops what is stored for the target of a successful unsafe request, and for the
+// URLs its Location and Content-Location point to on the same host (RFC 9111 section 4.4).
+func (c *Cache) invalidate(req *http.Request, resp *http.Response) {
+	c.remove(primaryKey(req.URL))
+	for _, field := range []string{"Location", "Content-Location"} {
+		val := resp.Header.Get(field)
+		if val == "" {
+			continue
+		}
+		target, err := req.URL.Parse(val)
+		if err == nil && target.Host == req.URL.Host {
+			c.remove(primaryKey(target))
+		}
+	}
+}
+
+// gatewayTimeout is the answer to only-if-cached when nothing usable is stored.
+func gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "504 Gateway Timeout",
+		StatusCode: 504,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Cache-Status": {cacheName + "; fwd=miss"}},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
@@ -0,0 +1,371 @@
+package cache
+
+import (
+	"fmt"
+	"httpfromtcp/internal/response"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var epoch = time.Date(2025, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+// upstream is a fake origin: it answers with whatever respond builds and records what it got.
+type upstream struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	respond  func(req *http.Request) (int, http.Header, string)
+}
+
+func (u *upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.mu.Lock()
+	u.requests = append(u.requests, req)
+	u.mu.Unlock()
+	statusCode, h, body := u.respond(req)
+	// A real transport hands back canonical keys.
+	canonical := make(http.Header)
+	for k, vs := range h {
+		for _, v := range vs {
+			canonical.Add(k, v)
+		}
+	}
+	return &http.Response{
+		StatusCode:    statusCode,
+		Header:        canonical,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func (u *upstream) calls() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.requests)
+}
+
+func (u *upstream) last() *http.Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[len(u.requests)-1]
+}
+
+// fixed answers every request the same way, dated with the cache's clock.
+func fixed(clock *time.Time, statusCode int, h http.Header, body string) func(*http.Request) (int, http.Header, string) {
+	return func(*http.Request) (int, http.Header, string) {
+		out := h.Clone()
+		out.Set("Date", clock.Format(response.TimeFormat))
+		return statusCode, out, body
+	}
+}
+
+func newCache(t *testing.T, u *upstream, opts ...Option) (*Cache, *time.Time) {
+	t.Helper()
+	c, err := New(u, opts...)
+	require.NoError(t, err)
+	clock := epoch
+	c.now = func() time.Time { return clock }
+	return c, &clock
+}
+
+func get(t *testing.T, c *Cache, method, url string, h http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	if h != nil {
+		req.Header = h
+	}
+	resp, err := c.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestCacheFreshness(t *testing.T) {
+	u := &upstream{}
+	c, clock := newCache(t, u)
+	u.respond = fixed(clock, 200, http.Header{"Cache-Control": {"max-age=60"}}, "hello")
+
+	// Test: Fresh responses are served from the cache with their age
+	resp, body := get(t, c, "GET", "http://origin/a", nil)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "httpfromtcp; fwd=miss; stored", resp.Header.Get("Cache-Status"))
+	*clock = clock.Add(10 * time.Second)
+	resp, body = get(t, c, "GET", "http://origin/a", nil)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "10", resp.Header.Get("Age"))
+	assert.Equal(t, "httpfromtcp; hit", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, 1, u.calls())
+
+	// Test: HEAD is answered from the GET entry
+	resp, body = get(t, c, "HEAD", "http://origin/a", nil)
+	assert.Empty(t, body)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Equal(t, 1, u.calls())
+
+	// Test: Ages reported by the upstream count
+	u.respond = func(req *http.Request) (int, http.Header, string) {
+		return 200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"55"}, "Date": {clock.Format(response.TimeFormat)}}, "old"
+	}
+	get(t, c, "GET", "http://origin/aged", nil)
+	*clock = clock.Add(6 * time.Second)
+	get(t, c, "GET", "http://origin/aged", nil)
+	assert.Equal(t, 3, u.calls())
+
+	// Test: The client can ask for a younger response or refuse the cache
+	get(t, c, "GET", "http://origin/a", http.Header{"Cache-Control": {"max-age=5"}})
+	assert.Equal(t, 4, u.calls())
+	get(t, c, "GET", "http://origin/a", http.Header{"Pragma": {"no-cache"}})
+	assert.Equal(t, 5, u.calls())
+
+	// Test: only-if-cached never goes upstream
+	resp, _ = get(t, c, "GET", "http://origin/missing", http.Header{"Cache-Control": {"only-if-cached"}})
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, 5, u.calls())
+}
+
+func TestCacheStorability(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		h      http.Header
+		reqH   http.Header
+		stored bool
+	}{
+		{"max-age", 200, http.Header{"Cache-Control": {"max-age=60"}}, nil, true},
+		{"expires", 200, http.Header{"Expires": {epoch.Add(time.Minute).Format(response.TimeFormat)}}, nil, true},
+		{"invalid expires", 200, http.Header{"Expires": {"0"}}, nil, false},
+		{"heuristic", 200, http.Header{"Last-Modified": {epoch.Add(-10 * time.Hour).Format(response.TimeFormat)}}, nil, true},
+		{"no freshness", 200, http.Header{}, nil, false},
+		{"no-store", 200, http.Header{"Cache-Control": {"max-age=60, no-store"}}, nil, false},
+		{"private", 200, http.Header{"Cache-Control": {`private="X-User", max-age=60`}}, nil, false},
+		{"request no-store", 200, http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Cache-Control": {"no-store"}}, false},
+		{"set-cookie", 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=1"}}, nil, false},
+		{"vary star", 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, nil, false},
+		{"authorization", 200, http.Header{"Cache-Control": {"max-age=60"}}, http.Header{"Authorization": {"Basic x"}}, false},
+		{"authorization public", 200, http.Header{"Cache-Control": {"public, max-age=60"}}, http.Header{"Authorization": {"Basic x"}}, true},
+		{"404 heuristic", 404, http.Header{"Last-Modified": {epoch.Add(-10 * time.Hour).Format(response.TimeFormat)}}, nil, true},
+		{"500", 500, http.Header{"Last-Modified": {epoch.Add(-10 * time.Hour).Format(response.TimeFormat)}}, nil, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &upstream{}
+			c, clock := newCache(t, u)
+			u.respond = fixed(clock, tc.status, tc.h, "body")
+			get(t, c, "GET", "http://origin/", tc.reqH)
+			get(t, c, "GET", "http://origin/", tc.reqH)
+			expected := 2
+			if tc.stored {
+				expected = 1
+			}
+			assert.Equal(t, expected, u.calls())
+		})
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	date := epoch.Format(response.TimeFormat)
+	// Test: s-maxage beats max-age, which beats Expires, which beats the heuristic
+	assert.Equal(t, 10*time.Second, freshnessLifetime(http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, 200))
+	assert.Equal(t, 60*time.Second, freshnessLifetime(http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Date":          {date},
+		"Expires":       {epoch.Add(time.Hour).Format(response.TimeFormat)},
+	}, 200))
+	assert.Equal(t, time.Hour, freshnessLifetime(http.Header{
+		"Date":    {date},
+		"Expires": {epoch.Add(time.Hour).Format(response.TimeFormat)},
+	}, 200))
+	assert.Equal(t, time.Hour, freshnessLifetime(http.Header{
+		"Date":          {date},
+		"Last-Modified": {epoch.Add(-10 * time.Hour).Format(response.TimeFormat)},
+	}, 200))
+	assert.Equal(t, 24*time.Hour, freshnessLifetime(http.Header{
+		"Date":          {date},
+		"Last-Modified": {epoch.Add(-1000 * time.Hour).Format(response.TimeFormat)},
+	}, 200))
+
+	// Test: Conflicting duplicates make it stale
+	assert.Equal(t, time.Duration(0), freshnessLifetime(http.Header{"Cache-Control": {"max-age=60", "max-age=120"}}, 200))
+
+	// Test: The age includes transit time and the upstream's Age
+	h := http.Header{"Date": {date}, "Age": {"30"}}
+	assert.Equal(t, 32*time.Second, initialAge(h, epoch.Add(time.Second), epoch.Add(3*time.Second)))
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	u := &upstream{}
+	c, clock := newCache(t, u)
+	u.respond = fixed(clock, 200, http.Header{
+		"Cache-Control": {"max-age=60"},
+		"ETag":          {`"v1"`},
+		"Last-Modified": {epoch.Add(-time.Hour).Format(response.TimeFormat)},
+		"X-Version":     {"1"},
+	}, "version one")
+	get(t, c, "GET", "http://origin/doc", nil)
+
+	// Test: A stale entry is revalidated, and a 304 refreshes it
+	*clock = clock.Add(2 * time.Minute)
+	u.respond = func(req *http.Request) (int, http.Header, string) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return 304, http.Header{"Cache-Control": {"max-age=120"}, "X-Version": {"1b"}, "Date": {clock.Format(response.TimeFormat)}}, ""
+		}
+		return 200, http.Header{}, "unexpected"
+	}
+	resp, body := get(t, c, "GET", "http://origin/doc", nil)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "version one", body)
+	assert.Equal(t, "1b", resp.Header.Get("X-Version"))
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", resp.Header.Get("Cache-Status"))
+	assert.Equal(t, epoch.Add(-time.Hour).Format(response.TimeFormat), u.last().Header.Get("If-Modified-Since"))
+
+	*clock = clock.Add(time.Minute)
+	get(t, c, "GET", "http://origin/doc", nil)
+	assert.Equal(t, 2, u.calls())
+
+	// Test: A changed resource replaces the entry
+	*clock = clock.Add(2 * time.Minute)
+	u.respond = fixed(clock, 200, http.Header{"Cache-Control": {"max-age=60"}, "ETag": {`"v2"`}}, "version two")
+	_, body = get(t, c, "GET", "http://origin/doc", nil)
+	assert.Equal(t, "version two", body)
+	_, body = get(t, c, "GET", "http://origin/doc", nil)
+	assert.Equal(t, "version two", body)
+	assert.Equal(t, 3, u.calls())
+
+	// Test: The client's own conditional request is answered from the cache
+	resp, body = get(t, c, "GET", "http://origin/doc", http.Header{"If-None-Match": {`W/"v2"`}})
+	assert.Equal(t, 304, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, `"v2"`, resp.Header.Get("ETag"))
+	assert.Equal(t, 3, u.calls())
+
+	// Test: no-cache responses are revalidated every time
+	u.respond = fixed(clock, 200, http.Header{"Cache-Control": {"no-cache"}, "ETag": {`"nc"`}}, "always ask")
+	get(t, c, "GET", "http://origin/nc", nil)
+	get(t, c, "GET", "http://origin/nc", nil)
+	assert.Equal(t, 5, u.calls())
+	assert.Equal(t, `"nc"`, u.last().Header.Get("If-None-Match"))
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	u := &upstream{}
+	c, clock := newCache(t, u)
+	version := 1
+	u.respond = func(req *http.Request) (int, http.Header, string) {
+		return 200, http.Header{
+			"Cache-Control": {"max-age=60, stale-while-revalidate=30"},
+			"Date":          {clock.Format(response.TimeFormat)},
+		}, fmt.Sprintf("version %d", version)
+	}
+	get(t, c, "GET", "http://origin/feed", nil)
+
+	// Test: Within the window the stale copy is served while it is refreshed
+	*clock = clock.Add(70 * time.Second)
+	version = 2
+	resp, body := get(t, c, "GET", "http://origin/feed", nil)
+	assert.Equal(t, "version 1", body)
+	assert.Contains(t, resp.Header.Get("Cache-Status"), "stale-while-revalidate")
+	c.background.Wait()
+	assert.Equal(t, 2, u.calls())
+
+	_, body = get(t, c, "GET", "http://origin/feed", nil)
+	assert.Equal(t, "version 2", body)
+	assert.Equal(t, 2, u.calls())
+
+	// Test: Past the window the client waits for the refresh
+	*clock = clock.Add(100 * time.Second)
+	version = 3
+	_, body = get(t, c, "GET", "http://origin/feed", nil)
+	assert.Equal(t, "version 3", body)
+	assert.Equal(t, 3, u.calls())
+}
+
+func TestCacheVary(t *testing.T) {
+	u := &upstream{}
+	c, clock := newCache(t, u)
+	u.respond = func(req *http.Request) (int, http.Header, string) {
+		return 200, http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Vary":          {"accept-language"},
+			"Date":          {clock.Format(response.TimeFormat)},
+		}, "in " + req.Header.Get("Accept-Language")
+	}
+
+	// Test: Each variant is stored on its own
+	_, body := get(t, c, "GET", "http://origin/", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "in en", body)
+	_, body = get(t, c, "GET", "http://origin/", http.Header{"Accept-Language": {"de"}})
+	assert.Equal(t, "in de", body)
+	_, body = get(t, c, "GET", "http://origin/", http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "in en", body)
+	_, body = get(t, c, "GET", "http://origin/", http.Header{"Accept-Language": {"de"}})
+	assert.Equal(t, "in de", body)
+	assert.Equal(t, 2, u.calls())
+
+	// Test: Unsafe requests drop every variant
+	u.respond = fixed(clock, 204, http.Header{}, "")
+	get(t, c, "POST", "http://origin/", nil)
+	u.respond = fixed(clock, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}, "fresh")
+	_, body = get(t, c, "GET", "http://origin/", http.Header{"Accept-Language": {"de"}})
+	assert.Equal(t, "fresh", body)
+	assert.Equal(t, 4, u.calls())
+}
+
+func TestCacheEviction(t *testing.T) {
+	u := &upstream{}
+	c, clock := newCache(t, u, WithMaxBytes(1000), WithMaxEntryBytes(400))
+	u.respond = func(req *http.Request) (int, http.Header, string) {
+		return 200, http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Date":          {clock.Format(response.TimeFormat)},
+		}, strings.Repeat("x", 300)
+	}
+
+	// Test: The least recently used entry goes first
+	get(t, c, "GET", "http://origin/1", nil)
+	get(t, c, "GET", "http://origin/2", nil)
+	get(t, c, "GET", "http://origin/1", nil)
+	get(t, c, "GET", "http://origin/3", nil)
+	assert.Equal(t, 3, u.calls())
+	get(t, c, "GET", "http://origin/1", nil)
+	get(t, c, "GET", "http://origin/3", nil)
+	assert.Equal(t, 3, u.calls())
+	get(t, c, "GET", "http://origin/2", nil)
+	assert.Equal(t, 4, u.calls())
+
+	// Test: Bodies over the entry limit pass through whole but are not kept
+	u.respond = fixed(clock, 200, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("y", 500))
+	_, body := get(t, c, "GET", "http://origin/big", nil)
+	assert.Len(t, body, 500)
+	get(t, c, "GET", "http://origin/big", nil)
+	assert.Equal(t, 6, u.calls())
+}
+
+func TestCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	u := &upstream{}
+	c, clock := newCache(t, u, WithDisk(dir, 1<<20), WithMaxBytes(100))
+	u.respond = fixed(clock, 200, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("z", 200))
+
+	// Test: Entries too big for memory are served from disk
+	get(t, c, "GET", "http://origin/file", nil)
+	_, body := get(t, c, "GET", "http://origin/file", nil)
+	assert.Len(t, body, 200)
+	assert.Equal(t, 1, u.calls())
+
+	// Test: A new cache picks up what an earlier one stored
+	c2, clock2 := newCache(t, u, WithDisk(dir, 1<<20))
+	*clock2 = clock.Add(30 * time.Second)
+	resp, body := get(t, c2, "GET", "http://origin/file", nil)
+	assert.Len(t, body, 200)
+	assert.Equal(t, "30", resp.Header.Get("Age"))
+	assert.Equal(t, 1, u.calls())
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"httpfromtcp/internal/response"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHeuristicLifetime caps the freshness guessed from Last-Modified, as RFC 9111 section
+// 4.2.2 suggests for responses that give no explicit lifetime.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// directives holds a parsed Cache-Control header. Directives without an argument map to "".
+type directives map[string]string
+
+func parseCacheControl(h http.Header) directives {
+	d := make(directives)
+	for _, val := range h.Values("Cache-Control") {
+		for _, part := range splitDirectives(val) {
+			name, arg, _ := strings.Cut(part, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, seen := d[name]; seen {
+				// RFC 9111 section 4.2.1: conflicting duplicates make the lifetime stale.
+				if name == "max-age" || name == "s-maxage" {
+					d[name] = "0"
+				}
+				continue
+			}
+			d[name] = strings.Trim(strings.TrimSpace(arg), "\"")
+		}
+	}
+	return d
+}
+
+// splitDirectives splits on commas that are not inside a quoted string, since
+// private="Set-Cookie, Authorization" is one directive.
+func splitDirectives(val string) []string {
+	parts := make([]string, 0)
+	start, quoted := 0, false
+	for i := 0; i < len(val); i++ {
+		switch val[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, val[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, val[start:])
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns a delta-seconds argument. A directive with a malformed argument is treated
+// as 0, which errs on the side of not reusing anything.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// heuristicStatuses are the status codes RFC 9110 section 15.1 makes cacheable by default,
+// left out of them 206, which this cache does not store.
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// storable decides whether a shared cache may keep resp (RFC 9111 section 3). Responses that
+// set cookies are not stored either, since handing one client's cookie to another is hardly
+// ever what the upstream meant.
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+
+	if respCC.has("public") || respCC.has("max-age") || respCC.has("s-maxage") ||
+		resp.Header.Get("Expires") != "" {
+		return resp.StatusCode >= 200 && resp.StatusCode != 206 && resp.StatusCode != 304
+	}
+	if !heuristicStatuses[resp.StatusCode] {
+		return false
+	}
+	// Without an explicit lifetime the entry is only useful if there is something to guess
+	// one from or to revalidate against.
+	return resp.Header.Get("Last-Modified") != "" || resp.Header.Get("ETag") != ""
+}
+
+// freshnessLifetime works out how long a response stays fresh, in the order RFC 9111 section
+// 4.2.1 gives for shared caches: s-maxage, max-age, Expires, then a guess from Last-Modified.
+func freshnessLifetime(h http.Header, statusCode int) time.Duration {
+	cc := parseCacheControl(h)
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime
+	}
+
+	date, err := response.ParseTime(h.Get("Date"))
+	if val := h.Get("Expires"); val != "" {
+		expires, expErr := response.ParseTime(val)
+		if expErr != nil || err != nil {
+			// An invalid Expires, "0" being the usual one, means already expired.
+			return 0
+		}
+		return max(expires.Sub(date), 0)
+	}
+
+	if !heuristicStatuses[statusCode] || cc.has("no-cache") {
+		return 0
+	}
+	lastModified, lmErr := response.ParseTime(h.Get("Last-Modified"))
+	if lmErr != nil || err != nil || !date.After(lastModified) {
+		return 0
+	}
+	return min(date.Sub(lastModified)/10, maxHeuristicLifetime)
+}
+
+// initialAge is the corrected_initial_age of RFC 9111 section 4.2.3: how old the response
+// already was when it arrived, from its Age and Date headers and the time the round trip took.
+func initialAge(h http.Header, requestTime, responseTime time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := response.ParseTime(h.Get("Date")); err == nil {
+		apparentAge = max(responseTime.Sub(date), 0)
+	}
+	ageValue := time.Duration(0)
+	if age, err := strconv.ParseInt(strings.TrimSpace(h.Get("Age")), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	return max(apparentAge, correctedAge)
+}
@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// entry is what the cache keeps for one response. The entry stored under a URL whose response
+// varies only lists the Vary fields and the variants seen so far, with a zero StatusCode, and
+// the responses themselves are stored under keys that add the request's values for those
+// fields.
+type entry struct {
+	Vary         []string
+	Variants     []string
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+func (e *entry) size() int64 {
+	size := int64(len(e.Body))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v) + 4)
+		}
+	}
+	for _, field := range e.Vary {
+		size += int64(len(field))
+	}
+	for _, variant := range e.Variants {
+		size += int64(len(variant))
+	}
+	return size
+}
+
+// store is where the cache keeps its entries.
+type store interface {
+	get(key string) (*entry, bool)
+	put(key string, e *entry)
+	remove(key string)
+}
+
+type lruItem[V any] struct {
+	key   string
+	value V
+	size  int64
+}
+
+// lru keeps values up to a total size, dropping the least recently used ones to make room.
+type lru[V any] struct {
+	maxBytes int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+	// evicted, if set, is told about every key pushed out to make room.
+	evicted func(key string)
+}
+
+func newLRU[V any](maxBytes int64) *lru[V] {
+	return &lru[V]{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (l *lru[V]) get(key string) (V, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem[V]).value, true
+}
+
+// put adds or replaces key. A value bigger than the whole budget is not kept at all, and false
+// is returned.
+func (l *lru[V]) put(key string, value V, size int64) bool {
+	l.remove(key)
+	if size > l.maxBytes {
+		return false
+	}
+	l.items[key] = l.order.PushFront(&lruItem[V]{key: key, value: value, size: size})
+	l.size += size
+	for l.size > l.maxBytes {
+		oldest := l.order.Back().Value.(*lruItem[V]).key
+		l.remove(oldest)
+		if l.evicted != nil {
+			l.evicted(oldest)
+		}
+	}
+	return true
+}
+
+func (l *lru[V]) remove(key string) {
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.size -= el.Value.(*lruItem[V]).size
+}
+
+type memoryStore struct {
+	entries *lru[*entry]
+}
+
+func newMemoryStore(maxBytes int64) *memoryStore {
+	return &memoryStore{entries: newLRU[*entry](maxBytes)}
+}
+
+func (ms *memoryStore) get(key string) (*entry, bool) {
+	return ms.entries.get(key)
+}
+
+func (ms *memoryStore) put(key string, e *entry) {
+	ms.entries.put(key, e, e.size()+int64(len(key)))
+}
+
+func (ms *memoryStore) remove(key string) {
+	ms.entries.remove(key)
+}
+
+// diskRecord is the form an entry takes in a file, along with its key so a hash collision
+// cannot serve the wrong response.
+type diskRecord struct {
+	Key   string
+	Entry *entry
+}
+
+// diskStore keeps one gob-encoded file per entry in dir. Only the file names and sizes are
+// held in memory, for the LRU.
+type diskStore struct {
+	dir   string
+	files *lru[struct{}]
+}
+
+// newDiskStore opens dir, creating it if needed, and picks up the files a previous run left
+// there, oldest first so they are the first to go.
+func newDiskStore(dir string, maxBytes int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	ds := &diskStore{dir: dir, files: newLRU[struct{}](maxBytes)}
+	ds.files.evicted = func(name string) {
+		os.Remove(filepath.Join(ds.dir, name))
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	existing := make([]os.FileInfo, 0)
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err == nil && info.Mode().IsRegular() && filepath.Ext(info.Name()) == ".entry" {
+			existing = append(existing, info)
+		}
+	}
+	sort.Slice(existing, func(i, j int) bool { return existing[i].ModTime().Before(existing[j].ModTime()) })
+	for _, info := range existing {
+		if !ds.files.put(info.Name(), struct{}{}, info.Size()) {
+			os.Remove(filepath.Join(dir, info.Name()))
+		}
+	}
+	return ds, nil
+}
+
+func (ds *diskStore) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".entry"
+}
+
+func (ds *diskStore) get(key string) (*entry, bool) {
+	name := ds.fileName(key)
+	if _, ok := ds.files.get(name); !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(ds.dir, name))
+	if err != nil {
+		ds.files.remove(name)
+		return nil, false
+	}
+	var record diskRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err != nil || record.Key != key {
+		return nil, false
+	}
+	return record.Entry, true
+}
+
+func (ds *diskStore) put(key string, e *entry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(diskRecord{Key: key, Entry: e}); err != nil {
+		return
+	}
+	name := ds.fileName(key)
+	if int64(buf.Len()) > ds.files.maxBytes {
+		ds.remove(key)
+		return
+	}
+
+	// Write to a temporary file first so a crash never leaves half an entry behind.
+	tmp, err := os.CreateTemp(ds.dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(ds.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	ds.files.put(name, struct{}{}, int64(buf.Len()))
+}
+
+func (ds *diskStore) remove(key string) {
+	name := ds.fileName(key)
+	ds.files.remove(name)
+	os.Remove(filepath.Join(ds.dir, name))
+}
+
+// tieredStore keeps recently used entries in memory in front of a larger disk store. Every
+// entry is written to both, so dropping one from memory costs nothing.
+type tieredStore struct {
+	memory *memoryStore
+	disk   *diskStore
+}
+
+func (ts *tieredStore) get(key string) (*entry, bool) {
+	if e, ok := ts.memory.get(key); ok {
+		return e, true
+	}
+	e, ok := ts.disk.get(key)
+	if ok {
+		ts.memory.put(key, e)
+	}
+	return e, ok
+}
+
+func (ts *tieredStore) put(key string, e *entry) {
+	ts.memory.put(key, e)
+	ts.disk.put(key, e)
+}
+
+func (ts *tieredStore) remove(key string) {
+	ts.memory.remove(key)
+	ts.disk.remove(key)
+}
@@ -0,0 +1,494 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout bounds a whole call to Do, redirects included.
+	DefaultTimeout = 30 * time.Second
+	// DefaultDialTimeout bounds connecting to a server, TLS handshake included.
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultIdleTimeout is how long a kept-alive connection waits in the pool to be reused.
+	DefaultIdleTimeout = 90 * time.Second
+	// DefaultMaxIdleConnsPerHost is how many kept-alive connections the pool holds per server.
+	DefaultMaxIdleConnsPerHost = 2
+	// DefaultMaxRedirects is how many redirects Do follows before giving up.
+	DefaultMaxRedirects = 10
+)
+
+var (
+	ErrTooManyRedirects = errors.New("too many redirects")
+
+	// errNoResponse marks a request that failed before any of the response arrived. On a
+	// connection taken from the pool that usually means the server had already closed it.
+	errNoResponse = errors.New("connection closed before the response")
+)
+
+type Option func(*Client)
+
+// WithTimeout bounds a whole call to Do, redirects included. Zero means no limit beyond the
+// request's context.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithDialTimeout bounds connecting to a server, TLS handshake included.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// WithIdleTimeout sets how long a kept-alive connection waits in the pool before it is closed
+// rather than reused.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.idleTimeout = d
+	}
+}
+
+// WithMaxIdleConnsPerHost sets how many kept-alive connections the pool holds per server.
+// Zero turns keep-alive off.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(c *Client) {
+		c.maxIdleConnsPerHost = n
+	}
+}
+
+// WithMaxRedirects sets how many redirects Do follows. Zero turns following off, so redirect
+// responses are returned as they are.
+func WithMaxRedirects(n int) Option {
+	return func(c *Client) {
+		c.maxRedirects = n
+	}
+}
+
+// WithMaxBodyBytes sets how big a response body may be, since each is read into memory whole.
+// Do fails with response.ErrBodyTooLarge on a bigger one. The default is
+// response.DefaultMaxBodyBytes.
+func WithMaxBodyBytes(n int) Option {
+	return func(c *Client) {
+		c.maxBodyBytes = n
+	}
+}
+
+// WithTLSConfig sets the configuration https connections are made with. The server name is
+// filled in per connection.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// Client sends requests over HTTP/1.1, writing them and parsing the responses with this
+// project's own code. It is safe for concurrent use.
+type Client struct {
+	timeout             time.Duration
+	dialTimeout         time.Duration
+	idleTimeout         time.Duration
+	maxIdleConnsPerHost int
+	maxRedirects        int
+	maxBodyBytes        int
+	tlsConfig           *tls.Config
+
+	mu sync.Mutex
+	// idle holds kept-alive connections by "scheme://host:port", most recently used last.
+	idle map[string][]*persistConn
+}
+
+// Response is a response together with the request it answers. After redirects that is the
+// last request sent, so its target is where the response actually came from.
+type Response struct {
+	*response.Response
+	Request *request.Request
+}
+
+type persistConn struct {
+	conn      net.Conn
+	rr        *response.Reader
+	bw        *bufio.Writer
+	counter   *countingReader
+	key       string
+	idleSince time.Time
+	// broken is set when the connection cannot be reused even though its last response was
+	// read in full.
+	broken bool
+}
+
+// countingReader counts the bytes read through it, which tells a request that failed before
+// any of its response arrived from one that failed partway.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func New(opts ...Option) *Client {
+	c := &Client{
+		timeout:             DefaultTimeout,
+		dialTimeout:         DefaultDialTimeout,
+		idleTimeout:         DefaultIdleTimeout,
+		maxIdleConnsPerHost: DefaultMaxIdleConnsPerHost,
+		maxRedirects:        DefaultMaxRedirects,
+		maxBodyBytes:        response.DefaultMaxBodyBytes,
+		idle:                make(map[string][]*persistConn),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewRequest builds a request for Do. rawURL must be an absolute http or https URL, which
+// becomes the request target; it is sent in origin form with a Host header.
+func NewRequest(method, rawURL string, body []byte) (*request.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if method == "CONNECT" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("request target %q is not an absolute http or https URL", rawURL)
+	}
+	u.Fragment, u.RawFragment = "", ""
+	target := u.String()
+	if err := request.CheckTarget(method, target); err != nil {
+		return nil, err
+	}
+
+	h := headers.Headers{"host": u.Host}
+	if len(body) > 0 || method == "POST" || method == "PUT" || method == "PATCH" {
+		h["content-length"] = strconv.Itoa(len(body))
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        body,
+	}, nil
+}
+
+// Get sends a GET request for rawURL.
+func (c *Client) Get(rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Do sends req and returns the response, following redirects. The request's context bounds
+// the call along with the client's timeout. A response of any status is not an error.
+func (c *Client) Do(req *request.Request) (*Response, error) {
+	ctx := req.Context()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	for redirects := 0; ; redirects++ {
+		resp, err := c.roundTrip(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if c.maxRedirects <= 0 {
+			return resp, nil
+		}
+		next, err := redirect(req, resp.Response)
+		if err != nil || next == nil {
+			return resp, err
+		}
+		if redirects == c.maxRedirects {
+			return nil, fmt.Errorf("%w: stopped after %d", ErrTooManyRedirects, redirects)
+		}
+		req = next
+	}
+}
+
+// CloseIdleConnections closes the connections waiting in the pool. The client stays usable.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = make(map[string][]*persistConn)
+	c.mu.Unlock()
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+	}
+}
+
+// roundTrip sends one request and reads its response. A request that fails on a pooled
+// connection before any of the response arrives is sent again on a new connection, if its
+// method is idempotent, since the server may simply have closed the connection while idle.
+func (c *Client) roundTrip(ctx context.Context, req *request.Request) (*Response, error) {
+	u, err := targetURL(req)
+	if err != nil {
+		return nil, err
+	}
+	key := u.Scheme + "://" + hostPort(u)
+	// The request is put into wire form before any connection is taken, so one that cannot be
+	// written safely never gets near the network.
+	var wire bytes.Buffer
+	if err := originForm(req, u).Write(&wire); err != nil {
+		return nil, err
+	}
+
+	for {
+		pc, reused, err := c.getConn(ctx, key, u)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := pc.exchange(ctx, req.RequestLine.Method, wire.Bytes())
+		if err != nil {
+			pc.conn.Close()
+			if reused && errors.Is(err, errNoResponse) && isIdempotent(req.RequestLine.Method) && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		if resp.KeepAlive() && !pc.broken && !req.Headers.HasToken("connection", "close") {
+			c.putConn(pc)
+		} else {
+			pc.conn.Close()
+		}
+		return &Response{Response: resp, Request: req}, nil
+	}
+}
+
+// exchange writes a request, already in wire form, and reads the response to it within ctx's
+// deadline.
+func (pc *persistConn) exchange(ctx context.Context, method string, wire []byte) (*response.Response, error) {
+	// The context's own deadline ends the exchange too, so that a timeout is reported with
+	// the context's error rather than the connection's.
+	stop := context.AfterFunc(ctx, func() {
+		pc.conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	read := pc.counter.n
+	resp, err := func() (*response.Response, error) {
+		pc.bw.Write(wire)
+		if err := pc.bw.Flush(); err != nil {
+			return nil, err
+		}
+		for {
+			// Interim responses are passed over; 101 is final, and ends the connection's use
+			// for HTTP.
+			resp, err := pc.rr.ReadResponse(method)
+			if err != nil {
+				return nil, err
+			}
+			if code := resp.StatusLine.StatusCode; code >= 200 || code == response.StatusSwitchingProtocols {
+				return resp, nil
+			}
+		}
+	}()
+	if err != nil && pc.counter.n == read {
+		err = fmt.Errorf("%w: %w", errNoResponse, err)
+	}
+	if !stop() && err == nil {
+		// The context ended just as the response arrived and left the connection with a
+		// deadline in the past.
+		pc.broken = true
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("%w: %w", context.Cause(ctx), err)
+	}
+	pc.conn.SetDeadline(time.Time{})
+	return resp, err
+}
+
+// originForm returns the copy of req that goes on the wire: its target in origin form and its
+// Host header taken from the URL.
+func originForm(req *request.Request, u *url.URL) *request.Request {
+	out := *req
+	out.RequestLine.RequestTarget = u.RequestURI()
+	out.RequestLine.HttpVersion = "1.1"
+	out.Headers = maps.Clone(req.Headers)
+	if out.Headers == nil {
+		out.Headers = make(headers.Headers)
+	}
+	out.Headers.Delete("Host")
+	out.Headers["host"] = u.Host
+	return &out
+}
+
+// getConn takes the most recently used idle connection to key from the pool, or dials a new
+// one if there is none.
+func (c *Client) getConn(ctx context.Context, key string, u *url.URL) (*persistConn, bool, error) {
+	c.mu.Lock()
+	var stale []*persistConn
+	var pc *persistConn
+	for conns := c.idle[key]; len(conns) > 0; conns = c.idle[key] {
+		last := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		if c.idleTimeout > 0 && time.Since(last.idleSince) > c.idleTimeout {
+			stale = append(stale, last)
+			continue
+		}
+		pc = last
+		break
+	}
+	c.mu.Unlock()
+	for _, s := range stale {
+		s.conn.Close()
+	}
+	if pc != nil {
+		return pc, true, nil
+	}
+
+	conn, err := c.dial(ctx, u)
+	if err != nil {
+		return nil, false, err
+	}
+	counter := &countingReader{r: conn}
+	pc = &persistConn{conn: conn, rr: response.NewReader(counter, response.WithMaxBodyBytes(c.maxBodyBytes)), bw: bufio.NewWriter(conn), counter: counter, key: key}
+	return pc, false, nil
+}
+
+// putConn returns a connection to the pool once its response has been read in full.
+func (c *Client) putConn(pc *persistConn) {
+	c.mu.Lock()
+	if len(c.idle[pc.key]) >= c.maxIdleConnsPerHost {
+		c.mu.Unlock()
+		pc.conn.Close()
+		return
+	}
+	pc.idleSince = time.Now()
+	c.idle[pc.key] = append(c.idle[pc.key], pc)
+	c.mu.Unlock()
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	if c.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.dialTimeout)
+		defer cancel()
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", hostPort(u))
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+
+	config := &tls.Config{}
+	if c.tlsConfig != nil {
+		config = c.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+	config.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// targetURL returns the absolute URL a request built by NewRequest, or followed from a
+// redirect, is for.
+func targetURL(req *request.Request) (*url.URL, error) {
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("request target %q is not an absolute http or https URL", req.RequestLine.RequestTarget)
+	}
+	return u, nil
+}
+
+// hostPort returns the address to dial for u, with the scheme's default port filled in.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func isIdempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "PUT" || method == "DELETE"
+}
+
+// redirect returns the request to send next if resp redirects req, or nil if it does not.
+// 303, and 301 or 302 in answer to a POST, turn the request into a GET without a body, as
+// browsers do; 307 and 308 repeat it as it was. Credentials are not passed on to another host.
+func redirect(req *request.Request, resp *response.Response) (*request.Request, error) {
+	code := resp.StatusLine.StatusCode
+	switch code {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther,
+		response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+	default:
+		return nil, nil
+	}
+	location, ok := resp.Headers.Get("Location")
+	if !ok {
+		return nil, nil
+	}
+
+	from, err := targetURL(req)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("redirect location %q is incorrect: %w", location, err)
+	}
+	to := from.ResolveReference(ref)
+	to.Fragment, to.RawFragment = "", ""
+	if to.Scheme != "http" && to.Scheme != "https" {
+		return nil, fmt.Errorf("redirect location %q is not an http or https URL", location)
+	}
+
+	method, body := req.RequestLine.Method, req.Body
+	h := maps.Clone(req.Headers)
+	if (code == response.StatusSeeOther && method != "HEAD") || (code <= response.StatusFound && method == "POST") {
+		method, body = "GET", []byte{}
+		h.Delete("Content-Length")
+		h.Delete("Content-Type")
+	}
+	h.Delete("Host")
+	h["host"] = to.Host
+	if to.Host != from.Host {
+		h.Delete("Authorization")
+		h.Delete("Cookie")
+		h.Delete("Proxy-Authorization")
+	}
+
+	next := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: to.String(), HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        body,
+	}
+	return next.WithContext(req.Context()), nil
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newServer starts a test server and counts the connections clients open to it.
+func newServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	conns := &atomic.Int32{}
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts, conns
+}
+
+func TestClient(t *testing.T) {
+	ts, conns := newServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chunked":
+			rw.Header().Set("Trailer", "X-Sum")
+			rw.WriteHeader(http.StatusOK)
+			io.WriteString(rw, "part one,")
+			rw.(http.Flusher).Flush()
+			io.WriteString(rw, "part two")
+			rw.Header().Set("X-Sum", "17")
+		default:
+			body, _ := io.ReadAll(r.Body)
+			rw.Header().Set("X-Custom", r.Header.Get("X-Custom"))
+			rw.Header().Set("X-Host", r.Host)
+			fmt.Fprintf(rw, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+		}
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	// Test: A request goes out with its headers and the response comes back parsed
+	req, err := NewRequest("GET", ts.URL+"/path?q=1#fragment", nil)
+	require.NoError(t, err)
+	req.Headers["x-custom"] = "value"
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusLine{HttpVersion: "1.1", StatusCode: response.StatusOK, ReasonPhrase: "OK"}, resp.StatusLine)
+	assert.Equal(t, "GET /path?q=1 ", string(resp.Body))
+	assert.Equal(t, "value", resp.Headers["x-custom"])
+	assert.Equal(t, strings.TrimPrefix(ts.URL, "http://"), resp.Headers["x-host"])
+	assert.Equal(t, req, resp.Request)
+
+	// Test: A body is sent with its length
+	req, err = NewRequest("POST", ts.URL+"/upload", []byte("payload"))
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /upload payload", string(resp.Body))
+
+	// Test: Chunked bodies are put back together, with their trailers
+	resp, err = c.Get(ts.URL + "/chunked")
+	require.NoError(t, err)
+	assert.Equal(t, "part one,part two", string(resp.Body))
+	assert.Equal(t, "17", resp.Trailers["x-sum"])
+
+	// Test: HEAD responses have no body to wait for
+	req, err = NewRequest("HEAD", ts.URL+"/", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Body)
+
+	// Test: A header value that would smuggle in another field is refused before anything is sent
+	req, err = NewRequest("GET", ts.URL+"/", nil)
+	require.NoError(t, err)
+	req.Headers["x-custom"] = "value\r\nX-Injected: yes"
+	_, err = c.Do(req)
+	assert.Error(t, err)
+	req.Headers = map[string]string{"bad name": "value"}
+	_, err = c.Do(req)
+	assert.Error(t, err)
+
+	// Test: Every request so far went over the one kept-alive connection
+	assert.Equal(t, int32(1), conns.Load())
+
+	// Test: Requests that are not absolute http URLs are refused
+	for _, bad := range []string{"/relative", "ftp://example.test/", "http://exa mple.test/"} {
+		_, err := NewRequest("GET", bad, nil)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	ts, conns := newServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "ok")
+	})
+
+	// Test: Connections idle past the timeout are not reused
+	c := New(WithIdleTimeout(time.Nanosecond))
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(ts.URL)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), conns.Load())
+	c.CloseIdleConnections()
+
+	// Test: Without idle connections allowed every request gets a new one
+	conns.Store(0)
+	c = New(WithMaxIdleConnsPerHost(0))
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(ts.URL)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), conns.Load())
+
+	// Test: A request asking for the connection to close is not pooled
+	conns.Store(0)
+	c = New()
+	defer c.CloseIdleConnections()
+	for i := 0; i < 2; i++ {
+		req, err := NewRequest("GET", ts.URL, nil)
+		require.NoError(t, err)
+		req.Headers["connection"] = "close"
+		_, err = c.Do(req)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), conns.Load())
+}
+
+// serveOnce answers a single request on each connection and then closes it, despite telling the
+// client it could keep the connection.
+func serveOnce(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestClientStaleConnection(t *testing.T) {
+	url := serveOnce(t)
+	c := New()
+	defer c.CloseIdleConnections()
+
+	// Test: A request on a connection the server has since closed is sent again
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(url)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(resp.Body))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test: A request that is not safe to repeat is not
+	req, err := NewRequest("POST", url, []byte("once"))
+	require.NoError(t, err)
+	_, err = c.Do(req)
+	assert.Error(t, err)
+}
+
+func TestClientTimeout(t *testing.T) {
+	ts, _ := newServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	// Test: The client's timeout ends a request the server sits on
+	c := New(WithTimeout(50 * time.Millisecond))
+	start := time.Now()
+	_, err := c.Get(ts.URL)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: So does the request's context
+	c = New()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = c.Do(req.WithContext(ctx))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientRedirects(t *testing.T) {
+	other, _ := newServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, "other %s auth=%q cookie=%q", r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+	})
+	ts, _ := newServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/found":
+			http.Redirect(rw, r, "/target?from=found", http.StatusFound)
+		case "/see-other":
+			http.Redirect(rw, r, "/target", http.StatusSeeOther)
+		case "/temporary":
+			http.Redirect(rw, r, "/target", http.StatusTemporaryRedirect)
+		case "/elsewhere":
+			http.Redirect(rw, r, other.URL+"/landed", http.StatusMovedPermanently)
+		case "/loop":
+			http.Redirect(rw, r, "/loop", http.StatusFound)
+		case "/no-location":
+			rw.WriteHeader(http.StatusFound)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(rw, "%s %s %s auth=%q", r.Method, r.URL.RequestURI(), body, r.Header.Get("Authorization"))
+		}
+	})
+	c := New()
+	defer c.CloseIdleConnections()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   string
+	}{
+		{"found", "GET", "/found", "", `GET /target?from=found  auth="secret"`},
+		{"POST after found becomes GET", "POST", "/found", "data", `GET /target?from=found  auth="secret"`},
+		{"see other becomes GET", "PUT", "/see-other", "data", `GET /target  auth="secret"`},
+		{"temporary repeats the request", "POST", "/temporary", "data", `POST /target data auth="secret"`},
+		{"credentials stay behind on another host", "GET", "/elsewhere", "", `other /landed auth="" cookie=""`},
+	}
+	for _, tt := range tests {
+		// Test: Redirects are followed the way browsers follow them
+		req, err := NewRequest(tt.method, ts.URL+tt.path, []byte(tt.body))
+		require.NoError(t, err)
+		req.Headers["authorization"] = "secret"
+		req.Headers["cookie"] = "id=1"
+		resp, err := c.Do(req)
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, response.StatusOK, resp.StatusLine.StatusCode, tt.name)
+		assert.Equal(t, tt.want, string(resp.Body), tt.name)
+		assert.NotEqual(t, ts.URL+tt.path, resp.Request.RequestLine.RequestTarget, tt.name)
+	}
+
+	// Test: A redirect without a location is returned as it is
+	resp, err := c.Get(ts.URL + "/no-location")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, resp.StatusLine.StatusCode)
+
+	// Test: Redirect loops give up
+	_, err = New(WithMaxRedirects(3)).Get(ts.URL + "/loop")
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Test: With following turned off the redirect itself comes back
+	resp, err = New(WithMaxRedirects(0)).Get(ts.URL + "/found")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, resp.StatusLine.StatusCode)
+	assert.Equal(t, "/target?from=found", resp.Headers["location"])
+}
+
+func TestClientMaxBodyBytes(t *testing.T) {
+	ts, _ := newServer(t, func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, strings.Repeat("x", 100))
+	})
+
+	// Test: A response body past the limit is an error, not a bigger buffer
+	_, err := New(WithMaxBodyBytes(10)).Get(ts.URL)
+	assert.ErrorIs(t, err, response.ErrBodyTooLarge)
+
+	// Test: Bodies within it are read as usual
+	resp, err := New(WithMaxBodyBytes(100)).Get(ts.URL)
+	require.NoError(t, err)
+	assert.Len(t, resp.Body, 100)
+}
+
+func TestClientTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, "%s over %s", r.URL.Path, r.Proto)
+	}))
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	// Test: https URLs are fetched over TLS, checked against the configured roots
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	c := New(WithTLSConfig(&tls.Config{RootCAs: pool}))
+	defer c.CloseIdleConnections()
+	resp, err := c.Get(ts.URL + "/secure")
+	require.NoError(t, err)
+	assert.Equal(t, "/secure over HTTP/1.1", string(resp.Body))
+
+	// Test: An untrusted certificate is refused
+	_, err = New().Get(ts.URL + "/secure")
+	var certErr *tls.CertificateVerificationError
+	assert.True(t, errors.As(err, &certErr), "%v", err)
+}
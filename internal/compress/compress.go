@@ -0,0 +1,104 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/negotiation"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultMinSize is the body size below which compressing is not worth the extra bytes of
+// framing and the CPU time.
+const DefaultMinSize = 1024
+
+var offers = []string{"gzip", "deflate", "identity"}
+
+// Handler wraps next so responses are gzip or deflate encoded whenever the client's
+// Accept-Encoding allows it. A response is left alone if it already has a Content-Encoding, if
+// its Content-Length is under minSize, if its type is already compressed (images, audio, video,
+// archives) or if it has no body. Compressed responses drop Content-Length in favour of chunked
+// framing. Every response gets "Vary: Accept-Encoding" since its body depends on that header.
+func Handler(next server.Handler, minSize int) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.AddVary("Accept-Encoding")
+
+		encoding, ok := negotiation.Encoding(req.Headers, offers)
+		if !ok || encoding == "identity" {
+			next(w, req)
+			return
+		}
+
+		w.OnWriteHeaders(func(statusCode response.StatusCode, h headers.Headers) {
+			if !shouldCompress(statusCode, h, minSize) {
+				return
+			}
+
+			h.Delete("Content-Length")
+			h.Delete("Transfer-Encoding")
+			h["Transfer-Encoding"] = "chunked"
+			h["Content-Encoding"] = encoding
+			if etag, ok := h.Get("ETag"); ok && !strings.HasPrefix(etag, "W/") {
+				// The encoded bytes differ from the ones the strong validator was made for.
+				h.Delete("ETag")
+				h["ETag"] = "W/" + etag
+			}
+
+			w.EncodeBody(func(dst io.Writer) io.WriteCloser {
+				if encoding == "gzip" {
+					return gzip.NewWriter(dst)
+				}
+				return zlib.NewWriter(dst)
+			})
+		})
+		next(w, req)
+	}
+}
+
+func shouldCompress(statusCode response.StatusCode, h headers.Headers, minSize int) bool {
+	if statusCode < 200 || statusCode == 204 || statusCode == 206 || statusCode == 304 {
+		return false
+	}
+	if _, ok := h.Get("Content-Encoding"); ok {
+		return false
+	}
+	if _, ok := h.Get("Content-Range"); ok {
+		return false
+	}
+	if val, ok := h.Get("Content-Length"); ok {
+		contentLength, err := strconv.Atoi(val)
+		if err != nil || contentLength < minSize {
+			return false
+		}
+	}
+
+	mt, err := h.ContentType()
+	if err != nil {
+		return true
+	}
+	return !isCompressed(mt)
+}
+
+// isCompressed reports media types whose bodies are already compressed, where a second pass
+// only burns CPU.
+func isCompressed(mt headers.MediaType) bool {
+	switch mt.Type {
+	case "image":
+		return mt.Subtype != "svg+xml" && mt.Subtype != "bmp"
+	case "video", "audio":
+		return true
+	case "font":
+		return mt.Subtype == "woff" || mt.Subtype == "woff2"
+	case "application":
+		switch mt.Subtype {
+		case "zip", "gzip", "x-gzip", "zstd", "x-bzip2", "x-xz", "x-7z-compressed", "x-rar-compressed", "pdf":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var original = []byte(strings.Repeat("<p>Your request was an absolute banger.</p>\n", 100))
+
+// run sends one request through the compression handler and splits the output into its header
+// section and its body, undoing chunked framing if there is any.
+func run(t *testing.T, acceptEncoding string, next func(w *response.Writer, req *request.Request)) (string, []byte) {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetKeepAlive(true)
+	req := &request.Request{Headers: headers.Headers{}}
+	if acceptEncoding != "" {
+		req.Headers["accept-encoding"] = acceptEncoding
+	}
+	Handler(next, DefaultMinSize)(w, req)
+	require.NoError(t, w.Finish())
+
+	head, body, found := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, found)
+	head += "\r\n"
+	if !strings.Contains(head, "Transfer-Encoding: chunked") {
+		return head, []byte(body)
+	}
+	return head, dechunk(t, body)
+}
+
+func dechunk(t *testing.T, body string) []byte {
+	t.Helper()
+	r := bufio.NewReader(strings.NewReader(body))
+	out := make([]byte, 0)
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		require.NoError(t, err)
+		if size == 0 {
+			return out
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(r, chunk)
+		require.NoError(t, err)
+		require.Equal(t, "\r\n", string(chunk[size:]))
+		out = append(out, chunk[:size]...)
+	}
+}
+
+func fixedHandler(contentType string, body []byte) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		w.WriteRequestLine(response.StatusOK)
+		h := response.GetDefaultHeaders(len(body))
+		h["Content-Type"] = contentType
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+}
+
+func TestGzipContentLengthResponse(t *testing.T) {
+	// Test: Content-Length body is gzipped and sent chunked
+	head, body := run(t, "gzip, deflate;q=0.5", fixedHandler("text/html", original))
+	assert.Contains(t, head, "Content-Encoding: gzip\r\n")
+	assert.Contains(t, head, "Transfer-Encoding: chunked\r\n")
+	assert.Contains(t, head, "Vary: Accept-Encoding\r\n")
+	assert.NotContains(t, head, "Content-Length")
+	assert.NotContains(t, head, "Connection: close")
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, original, decoded)
+}
+
+func TestDeflateChunkedResponse(t *testing.T) {
+	// Test: Chunked body with trailers is deflated chunk by chunk
+	head, body := run(t, "deflate", func(w *response.Writer, req *request.Request) {
+		w.WriteRequestLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		delete(h, "Content-Length")
+		h["Transfer-Encoding"] = "chunked"
+		w.WriteHeaders(h)
+		for i := 0; i < len(original); i += 300 {
+			w.WriteChunkedBody(original[i:min(i+300, len(original))])
+		}
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.Headers{"X-Content-Length": fmt.Sprint(len(original))})
+	})
+	assert.Contains(t, head, "Content-Encoding: deflate\r\n")
+
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, original, decoded)
+}
+
+func TestSkippedResponses(t *testing.T) {
+	// Test: Small bodies are left alone
+	head, body := run(t, "gzip", fixedHandler("text/plain", []byte("tiny")))
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.Contains(t, head, "Content-Length: 4\r\n")
+	assert.Equal(t, "tiny", string(body))
+
+	// Test: Already compressed types are left alone
+	head, body = run(t, "gzip", fixedHandler("video/mp4", original))
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.Equal(t, original, body)
+
+	// Test: No Accept-Encoding still gets Vary
+	head, body = run(t, "", fixedHandler("text/html", original))
+	assert.NotContains(t, head, "Content-Encoding")
+	assert.Contains(t, head, "Vary: Accept-Encoding\r\n")
+	assert.Equal(t, original, body)
+
+	// Test: Unsupported coding falls back to identity
+	head, _ = run(t, "br", fixedHandler("text/html", original))
+	assert.NotContains(t, head, "Content-Encoding")
+}
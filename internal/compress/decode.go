@@ -0,0 +1,118 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"strings"
+)
+
+// DefaultMaxDecodedSize caps how large a decompressed request body may grow. A few kilobytes of
+// gzip can expand to gigabytes, so the limit applies to the output, not the input.
+const DefaultMaxDecodedSize = 10 << 20
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errTooLarge            = errors.New("decoded body is too large")
+)
+
+// DecodeRequest wraps next so request bodies sent with "Content-Encoding: gzip" or "deflate"
+// reach it already decoded, with Content-Encoding removed and Content-Length fixed up to match.
+// Bodies that decode to more than maxSize bytes get 413, bodies that do not decode get 400, and
+// codings other than gzip and deflate get 415.
+func DecodeRequest(next server.Handler, maxSize int) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		val, ok := req.Headers.Get("Content-Encoding")
+		if !ok {
+			next(w, req)
+			return
+		}
+
+		codings := make([]string, 0)
+		for _, coding := range strings.Split(val, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+		for _, coding := range codings {
+			if coding != "gzip" && coding != "x-gzip" && coding != "deflate" {
+				writeDecodeError(w, fmt.Errorf("%w: %s", errUnsupportedEncoding, coding))
+				return
+			}
+		}
+
+		body, err := req.ReadBody()
+		if err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+
+		// Codings are listed in the order they were applied, so undo them back to front.
+		for i := len(codings) - 1; i >= 0; i-- {
+			body, err = decode(codings[i], body, maxSize)
+			if err != nil {
+				writeDecodeError(w, err)
+				return
+			}
+		}
+
+		req.Body = body
+		delete(req.Headers, "content-encoding")
+		req.Headers["content-length"] = fmt.Sprintf("%d", len(body))
+		next(w, req)
+	}
+}
+
+func decode(coding string, body []byte, maxSize int) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch coding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// "deflate" is meant to be zlib wrapped, but plenty of clients send raw deflate.
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s body: %w", coding, err)
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s body: %w", coding, err)
+	}
+	if len(decoded) > maxSize {
+		return nil, fmt.Errorf("%w: limit is %d bytes", errTooLarge, maxSize)
+	}
+	return decoded, nil
+}
+
+func writeDecodeError(w *response.Writer, err error) {
+	statusCode := response.StatusBadRequest
+	h := response.GetDefaultHeaders(0)
+	switch {
+	case errors.Is(err, errUnsupportedEncoding):
+		statusCode = response.StatusUnsupportedMediaType
+		h["Accept-Encoding"] = "gzip, deflate"
+	case errors.Is(err, errTooLarge):
+		statusCode = response.StatusContentTooLarge
+	}
+
+	body := fmt.Appendf(nil, "Error decoding request body: %v", err)
+	h["Content-Length"] = fmt.Sprintf("%d", len(body))
+	w.WriteRequestLine(statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
@@ -0,0 +1,93 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeRun(t *testing.T, encoding string, body []byte, maxSize int) (string, *request.Request) {
+	t.Helper()
+	req := &request.Request{
+		Headers: headers.Headers{"content-length": "0"},
+		Body:    body,
+	}
+	if encoding != "" {
+		req.Headers["content-encoding"] = encoding
+	}
+
+	var seen *request.Request
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	DecodeRequest(func(w *response.Writer, req *request.Request) {
+		seen = req
+	}, maxSize)(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String(), seen
+}
+
+func TestDecodeRequest(t *testing.T) {
+	// Test: gzip body is decoded and headers fixed up
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(original)
+	zw.Close()
+	_, seen := decodeRun(t, "gzip", gz.Bytes(), DefaultMaxDecodedSize)
+	require.NotNil(t, seen)
+	assert.Equal(t, original, seen.Body)
+	assert.NotContains(t, seen.Headers, "content-encoding")
+	assert.Equal(t, "4400", seen.Headers["content-length"])
+
+	// Test: zlib and raw deflate are both accepted for deflate
+	var zl bytes.Buffer
+	zlw := zlib.NewWriter(&zl)
+	zlw.Write(original)
+	zlw.Close()
+	_, seen = decodeRun(t, "deflate", zl.Bytes(), DefaultMaxDecodedSize)
+	require.NotNil(t, seen)
+	assert.Equal(t, original, seen.Body)
+
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write(original)
+	fw.Close()
+	_, seen = decodeRun(t, "deflate", raw.Bytes(), DefaultMaxDecodedSize)
+	require.NotNil(t, seen)
+	assert.Equal(t, original, seen.Body)
+
+	// Test: No Content-Encoding passes straight through
+	_, seen = decodeRun(t, "", []byte("plain"), DefaultMaxDecodedSize)
+	require.NotNil(t, seen)
+	assert.Equal(t, "plain", string(seen.Body))
+}
+
+func TestDecodeRequestErrors(t *testing.T) {
+	// Test: Zip bomb is cut off at the limit
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write([]byte(strings.Repeat("\x00", 1<<20)))
+	zw.Close()
+	out, seen := decodeRun(t, "gzip", bomb.Bytes(), 1024)
+	assert.Nil(t, seen)
+	assert.Contains(t, out, "HTTP/1.1 413 Content Too Large\r\n")
+
+	// Test: Unsupported coding
+	out, seen = decodeRun(t, "br", []byte("whatever"), DefaultMaxDecodedSize)
+	assert.Nil(t, seen)
+	assert.Contains(t, out, "HTTP/1.1 415 Unsupported Media Type\r\n")
+	assert.Contains(t, out, "Accept-Encoding: gzip, deflate\r\n")
+
+	// Test: Corrupt gzip data
+	out, seen = decodeRun(t, "gzip", []byte("not gzip at all"), DefaultMaxDecodedSize)
+	assert.Nil(t, seen)
+	assert.Contains(t, out, "HTTP/1.1 400 Bad Request\r\n")
+}
@@ -0,0 +1,186 @@
+package content
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"time"
+)
+
+// Validators are what a representation can be checked against in conditional requests. Either
+// field may be left empty.
+type Validators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// StrongETag derives a strong validator from the exact bytes of a body, for responses that are
+// built in memory.
+func StrongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// WeakETag derives a weak validator from a file's size and modification time. It is cheap, but
+// two different contents could share it, so it may only be used where weak comparison applies.
+func WeakETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf("W/\"%x-%x-%x\"", size, modTime.Unix(), modTime.Nanosecond())
+}
+
+func (v Validators) setHeaders(h headers.Headers) {
+	if v.ETag != "" {
+		h["ETag"] = v.ETag
+	}
+	if !v.LastModified.IsZero() {
+		h["Last-Modified"] = v.LastModified.UTC().Format(response.TimeFormat)
+	}
+}
+
+// CheckPreconditions evaluates the conditional headers of req against v in the order RFC 9110
+// section 13.2.2 lays down: If-Match, then If-Unmodified-Since, then If-None-Match, then
+// If-Modified-Since. If one of them decides the request it writes the 304 or 412 response and
+// returns true, and the handler should stop there. The representation is taken to exist, even
+// if v is empty, so "*" matches it.
+func CheckPreconditions(w *response.Writer, req *request.Request, v Validators) bool {
+	statusCode := evaluatePreconditions(req, v)
+	if statusCode == 0 {
+		return false
+	}
+
+	h := make(headers.Headers)
+	v.setHeaders(h)
+	if statusCode == response.StatusNotModified {
+		w.WriteRequestLine(statusCode)
+		w.WriteHeaders(h)
+		return true
+	}
+
+	body := []byte("Precondition Failed")
+	h["Content-Length"] = fmt.Sprintf("%d", len(body))
+	h["Content-Type"] = "text/plain"
+	w.WriteRequestLine(statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+	return true
+}
+
+func evaluatePreconditions(req *request.Request, v Validators) response.StatusCode {
+	method := req.RequestLine.Method
+	isSafe := method == "GET" || method == "HEAD"
+
+	if val, ok := req.Headers.Get("If-Match"); ok {
+		if !matchETags(val, v.ETag, true) {
+			return response.StatusPreconditionFailed
+		}
+	} else if val, ok := req.Headers.Get("If-Unmodified-Since"); ok && !v.LastModified.IsZero() {
+		since, err := response.ParseTime(val)
+		if err == nil && v.LastModified.Truncate(time.Second).After(since) {
+			return response.StatusPreconditionFailed
+		}
+	}
+
+	if val, ok := req.Headers.Get("If-None-Match"); ok {
+		if matchETags(val, v.ETag, false) {
+			if isSafe {
+				return response.StatusNotModified
+			}
+			return response.StatusPreconditionFailed
+		}
+	} else if val, ok := req.Headers.Get("If-Modified-Since"); ok && isSafe && !v.LastModified.IsZero() {
+		since, err := response.ParseTime(val)
+		if err == nil && !v.LastModified.Truncate(time.Second).After(since) {
+			return response.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// rangeApplies evaluates If-Range: a Range header is only honored if the representation still
+// matches what the client has. An entity tag has to match strongly and a date exactly.
+func rangeApplies(req *request.Request, v Validators) bool {
+	val, ok := req.Headers.Get("If-Range")
+	if !ok {
+		return true
+	}
+	val = strings.TrimSpace(val)
+	if strings.HasPrefix(val, "\"") || strings.HasPrefix(val, "W/") {
+		return matchETags(val, v.ETag, true)
+	}
+	date, err := response.ParseTime(val)
+	if err != nil || v.LastModified.IsZero() {
+		return false
+	}
+	return v.LastModified.Truncate(time.Second).Equal(date)
+}
+
+// matchETags reports whether the entity tag list in a conditional header matches current.
+// "*" matches any current representation, whether or not it has an entity tag (RFC 9110
+// sections 13.1.1 and 13.1.2). Strong comparison requires both tags to be strong and identical;
+// weak comparison ignores the W/ prefix.
+func matchETags(list, current string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if current == "" {
+		return false
+	}
+
+	currentWeak, currentTag := splitETag(current)
+	for _, candidate := range parseETags(list) {
+		weak, tag := splitETag(candidate)
+		if tag != currentTag {
+			continue
+		}
+		if !strong || (!weak && !currentWeak) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitETag(etag string) (bool, string) {
+	if tag, ok := strings.CutPrefix(etag, "W/"); ok {
+		return true, tag
+	}
+	return false, etag
+}
+
+// parseETags splits a comma separated list of entity tags. It cannot just split on commas
+// because a comma is allowed inside the quotes.
+func parseETags(list string) []string {
+	etags := make([]string, 0)
+	data := []byte(list)
+	for len(data) > 0 {
+		data = bytes.TrimLeft(data, " \t,")
+		if len(data) == 0 {
+			break
+		}
+
+		start := 0
+		if bytes.HasPrefix(data, []byte("W/")) {
+			start = 2
+		}
+		if len(data) <= start || data[start] != '"' {
+			// Not an entity tag; skip to the next element.
+			next := bytes.IndexByte(data, ',')
+			if next == -1 {
+				break
+			}
+			data = data[next:]
+			continue
+		}
+		end := bytes.IndexByte(data[start+1:], '"')
+		if end == -1 {
+			break
+		}
+		end += start + 2
+		etags = append(etags, string(data[:end]))
+		data = data[end:]
+	}
+	return etags
+}
@@ -0,0 +1,144 @@
+package content
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	page     = []byte("<html>cached page</html>")
+	modified = time.Date(2025, time.March, 4, 5, 6, 7, 0, time.UTC)
+)
+
+func conditional(t *testing.T, method string, h headers.Headers) (string, string) {
+	t.Helper()
+	h["host"] = "localhost"
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: "/", HttpVersion: "1.1"},
+		Headers:     h,
+	}
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetMethod(method)
+	ServeBytes(w, req, "text/html", modified, page)
+	require.NoError(t, w.Finish())
+
+	head, body, _ := strings.Cut(buf.String(), "\r\n\r\n")
+	return head + "\r\n", body
+}
+
+func TestValidatorHeaders(t *testing.T) {
+	// Test: Buffered responses carry a strong ETag and Last-Modified
+	head, body := conditional(t, "GET", headers.Headers{})
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, head, "ETag: "+StrongETag(page)+"\r\n")
+	assert.Contains(t, head, "Last-Modified: Tue, 04 Mar 2025 05:06:07 GMT\r\n")
+	assert.Equal(t, string(page), body)
+
+	// Test: Weak ETags are marked as such and differ with the modification time
+	assert.True(t, strings.HasPrefix(WeakETag(10, modified), "W/\""))
+	assert.NotEqual(t, WeakETag(10, modified), WeakETag(10, modified.Add(time.Second)))
+}
+
+func TestConditionalRequests(t *testing.T) {
+	etag := StrongETag(page)
+
+	// Test: If-None-Match hit gives 304 with validators and no body
+	head, body := conditional(t, "GET", headers.Headers{"if-none-match": `"other", ` + etag})
+	assert.Contains(t, head, "HTTP/1.1 304 Not Modified\r\n")
+	assert.Contains(t, head, "ETag: "+etag+"\r\n")
+	assert.Empty(t, body)
+
+	// Test: If-None-Match uses weak comparison
+	head, _ = conditional(t, "GET", headers.Headers{"if-none-match": "W/" + etag})
+	assert.Contains(t, head, "HTTP/1.1 304 Not Modified\r\n")
+
+	// Test: If-None-Match miss beats a matching If-Modified-Since
+	head, _ = conditional(t, "GET", headers.Headers{
+		"if-none-match":     `"other"`,
+		"if-modified-since": "Tue, 04 Mar 2025 05:06:07 GMT",
+	})
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+
+	// Test: If-Modified-Since at or after the modification time gives 304
+	head, _ = conditional(t, "GET", headers.Headers{"if-modified-since": "Tue, 04 Mar 2025 05:06:07 GMT"})
+	assert.Contains(t, head, "HTTP/1.1 304 Not Modified\r\n")
+	head, _ = conditional(t, "GET", headers.Headers{"if-modified-since": "Mon, 03 Mar 2025 05:06:07 GMT"})
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+
+	// Test: If-None-Match on an unsafe method gives 412
+	head, _ = conditional(t, "PUT", headers.Headers{"if-none-match": "*"})
+	assert.Contains(t, head, "HTTP/1.1 412 Precondition Failed\r\n")
+
+	// Test: If-Match needs a strong match
+	head, _ = conditional(t, "GET", headers.Headers{"if-match": etag})
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	head, _ = conditional(t, "GET", headers.Headers{"if-match": "W/" + etag})
+	assert.Contains(t, head, "HTTP/1.1 412 Precondition Failed\r\n")
+
+	// Test: If-Unmodified-Since in the past gives 412, and If-Match takes precedence over it
+	head, _ = conditional(t, "GET", headers.Headers{"if-unmodified-since": "Sunday, 02-Mar-25 00:00:00 GMT"})
+	assert.Contains(t, head, "HTTP/1.1 412 Precondition Failed\r\n")
+	head, _ = conditional(t, "GET", headers.Headers{
+		"if-match":            "*",
+		"if-unmodified-since": "Sun Mar  2 00:00:00 2025",
+	})
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+}
+
+func TestConditionalWithoutValidators(t *testing.T) {
+	serve := func(method string, h headers.Headers) string {
+		h["host"] = "localhost"
+		req := &request.Request{
+			RequestLine: request.RequestLine{Method: method, RequestTarget: "/", HttpVersion: "1.1"},
+			Headers:     h,
+		}
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		w.SetMethod(method)
+		Serve(w, req, "text/plain", strings.NewReader("no validators"))
+		require.NoError(t, w.Finish())
+		return buf.String()
+	}
+
+	// Test: If-Match: * matches a representation that has no ETag
+	assert.Contains(t, serve("PUT", headers.Headers{"if-match": "*"}), "HTTP/1.1 200 OK\r\n")
+
+	// Test: If-None-Match: * does too, so it fails for unsafe methods and gives 304 for GET
+	assert.Contains(t, serve("PUT", headers.Headers{"if-none-match": "*"}), "HTTP/1.1 412 Precondition Failed\r\n")
+	assert.Contains(t, serve("GET", headers.Headers{"if-none-match": "*"}), "HTTP/1.1 304 Not Modified\r\n")
+
+	// Test: A listed tag never matches a representation without one
+	assert.Contains(t, serve("PUT", headers.Headers{"if-match": `"abc"`}), "HTTP/1.1 412 Precondition Failed\r\n")
+	assert.Contains(t, serve("GET", headers.Headers{"if-none-match": `"abc"`}), "HTTP/1.1 200 OK\r\n")
+}
+
+func TestIfRange(t *testing.T) {
+	// Test: Matching If-Range keeps the range
+	head, body := conditional(t, "GET", headers.Headers{"range": "bytes=0-5", "if-range": StrongETag(page)})
+	assert.Contains(t, head, "HTTP/1.1 206 Partial Content\r\n")
+	assert.Equal(t, "<html>", body)
+
+	head, _ = conditional(t, "GET", headers.Headers{"range": "bytes=0-5", "if-range": "Tue, 04 Mar 2025 05:06:07 GMT"})
+	assert.Contains(t, head, "HTTP/1.1 206 Partial Content\r\n")
+
+	// Test: Stale or weak If-Range sends the whole thing
+	head, body = conditional(t, "GET", headers.Headers{"range": "bytes=0-5", "if-range": `"stale"`})
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.Equal(t, string(page), body)
+
+	head, _ = conditional(t, "GET", headers.Headers{"range": "bytes=0-5", "if-range": "W/" + StrongETag(page)})
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+}
+
+func TestParseETags(t *testing.T) {
+	assert.Equal(t, []string{`"a"`, `W/"b,c"`, `""`}, parseETags(` "a" ,W/"b,c", junk, ""`))
+}
@@ -0,0 +1,314 @@
+package content
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxSymlinkDepth bounds how many links escapesRoot follows, so a link cycle cannot spin forever.
+const maxSymlinkDepth = 40
+
+type FileServerOption func(*fileServer)
+
+// WithDirectoryListing makes the file server render an HTML index for directories that have no
+// index.html, instead of answering 403.
+func WithDirectoryListing() FileServerOption {
+	return func(fsrv *fileServer) {
+		fsrv.listDirs = true
+	}
+}
+
+type fileServer struct {
+	root     fs.FS
+	listDirs bool
+}
+
+// FileServer returns a Handler that serves the files in root, mapping the request path onto
+// it. Paths are percent-decoded and any ".." segment is refused rather than cleaned away. If
+// root can read links, symlinks that lead outside it are refused too; use Dir to get a root the
+// operating system also keeps links from escaping. Directories are served through their
+// index.html. Files are streamed through Serve, so they get range support, and their type comes
+// from the extension or, failing that, from sniffing the first bytes.
+func FileServer(root fs.FS, opts ...FileServerOption) server.Handler {
+	fsrv := &fileServer{root: root}
+	for _, opt := range opts {
+		opt(fsrv)
+	}
+	return fsrv.serve
+}
+
+// Dir opens a directory as an fs.FS confined to it: paths and symlinks that would resolve
+// outside dir fail to open.
+func Dir(dir string) (fs.FS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return root.FS(), nil
+}
+
+func (fsrv *fileServer) serve(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method != "GET" && method != "HEAD" {
+		body := []byte("Method Not Allowed")
+		h := response.GetDefaultHeaders(len(body))
+		h["Allow"] = "GET, HEAD"
+		w.WriteRequestLine(response.StatusMethodNotAllowed)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+		return
+	}
+
+	urlPath, query, hasQuery := strings.Cut(req.RequestLine.RequestTarget, "?")
+	name, err := cleanPath(urlPath)
+	if err != nil || escapesRoot(fsrv.root, name, 0) {
+		writeError(w, response.StatusNotFound, errors.New("file not found"))
+		return
+	}
+
+	f, info, err := fsrv.open(name)
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	defer f.Close()
+
+	// Relative links inside a directory listing or index.html only resolve against a path
+	// that ends in a slash, and a file should not be reachable with one.
+	isDirPath := strings.HasSuffix(urlPath, "/")
+	if info.IsDir() != isDirPath && urlPath != "/" {
+		location := strings.TrimSuffix(urlPath, "/")
+		if info.IsDir() {
+			location = urlPath + "/"
+		}
+		if hasQuery {
+			location += "?" + query
+		}
+		redirect(w, location)
+		return
+	}
+
+	if !info.IsDir() {
+		serveFile(w, req, f, info)
+		return
+	}
+
+	index := path.Join(name, "index.html")
+	if indexFile, indexInfo, err := fsrv.open(index); err == nil && !escapesRoot(fsrv.root, index, 0) {
+		defer indexFile.Close()
+		if !indexInfo.IsDir() {
+			serveFile(w, req, indexFile, indexInfo)
+			return
+		}
+	}
+	if !fsrv.listDirs {
+		writeError(w, response.StatusForbidden, errors.New("directory listing is disabled"))
+		return
+	}
+	fsrv.serveListing(w, req, name, urlPath)
+}
+
+func (fsrv *fileServer) open(name string) (fs.File, fs.FileInfo, error) {
+	f, err := fsrv.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// cleanPath turns a URL path into an fs.FS name. It refuses ".." segments outright rather than
+// letting path.Clean quietly resolve them, along with NUL bytes and backslashes, which some
+// file systems treat as separators.
+func cleanPath(urlPath string) (string, error) {
+	decoded, err := url.PathUnescape(urlPath)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(decoded, "\\\x00") {
+		return "", fmt.Errorf("path %q is incorrect", urlPath)
+	}
+	for _, segment := range strings.Split(decoded, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("path %q leaves the root", urlPath)
+		}
+	}
+
+	name := strings.Trim(path.Clean("/"+decoded), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("path %q is incorrect", urlPath)
+	}
+	return name, nil
+}
+
+// escapesRoot walks name one element at a time and reports whether any symlink along the way
+// points outside the root. File systems that cannot read links are trusted to confine
+// themselves.
+func escapesRoot(fsys fs.FS, name string, depth int) bool {
+	linkFS, ok := fsys.(fs.ReadLinkFS)
+	if !ok || name == "." {
+		return false
+	}
+	if depth > maxSymlinkDepth {
+		return true
+	}
+
+	parts := strings.Split(name, "/")
+	current := "."
+	for i, part := range parts {
+		current = path.Join(current, part)
+		info, err := linkFS.Lstat(current)
+		if err != nil {
+			// Whatever is wrong with the path, Open reports it.
+			return false
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := linkFS.ReadLink(current)
+		if err != nil || path.IsAbs(target) || strings.HasPrefix(target, "\\") {
+			return true
+		}
+		resolved := path.Join(path.Dir(current), target)
+		if resolved == ".." || strings.HasPrefix(resolved, "../") {
+			return true
+		}
+		rest := append([]string{resolved}, parts[i+1:]...)
+		return escapesRoot(fsys, path.Join(rest...), depth+1)
+	}
+	return false
+}
+
+func serveFile(w *response.Writer, req *request.Request, f fs.File, info fs.FileInfo) {
+	contentType := TypeByExtension(path.Ext(info.Name()))
+
+	rs, seekable := f.(io.ReadSeeker)
+	if !seekable {
+		serveStream(w, req, f, info, contentType)
+		return
+	}
+	if contentType == "" {
+		sniffed := make([]byte, sniffLen)
+		n, _ := io.ReadFull(rs, sniffed)
+		contentType = DetectContentType(sniffed[:n])
+	}
+	v := Validators{ETag: WeakETag(info.Size(), info.ModTime()), LastModified: info.ModTime()}
+	ServeContent(w, req, contentType, v, rs)
+}
+
+// serveStream sends a file that cannot seek. Without seeking there are no ranges, and the
+// sniffed bytes have to be sent ahead of the rest of the file.
+func serveStream(w *response.Writer, req *request.Request, f fs.File, info fs.FileInfo, contentType string) {
+	v := Validators{ETag: WeakETag(info.Size(), info.ModTime()), LastModified: info.ModTime()}
+	if CheckPreconditions(w, req, v) {
+		return
+	}
+
+	var reader io.Reader = f
+	if contentType == "" {
+		sniffed := make([]byte, sniffLen)
+		n, _ := io.ReadFull(f, sniffed)
+		contentType = DetectContentType(sniffed[:n])
+		reader = io.MultiReader(strings.NewReader(string(sniffed[:n])), f)
+	}
+
+	h := make(headers.Headers)
+	h["Content-Type"] = contentType
+	h["Content-Length"] = fmt.Sprintf("%d", info.Size())
+	v.setHeaders(h)
+	w.WriteRequestLine(response.StatusOK)
+	w.WriteHeaders(h)
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if _, err := w.WriteBody(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (fsrv *fileServer) serveListing(w *response.Writer, req *request.Request, name, urlPath string) {
+	entries, err := fs.ReadDir(fsrv.root, name)
+	if err != nil {
+		writeError(w, response.StatusInternalServerError, err)
+		return
+	}
+
+	title := html.EscapeString("Index of " + urlPath)
+	var b strings.Builder
+	b.WriteString("<html>\n<head>\n<title>" + title + "</title>\n</head>\n<body>\n")
+	b.WriteString("<h1>" + title + "</h1>\n<ul>\n")
+	if urlPath != "/" {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		if strings.Contains(entry.Name(), ":") {
+			// Keep "a:b" from being read as a URL scheme.
+			href = "./" + href
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+
+	body := []byte(b.String())
+	h := response.GetDefaultHeaders(len(body))
+	h["Content-Type"] = "text/html; charset=utf-8"
+	w.WriteRequestLine(response.StatusOK)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func redirect(w *response.Writer, location string) {
+	body := []byte("Moved Permanently")
+	h := response.GetDefaultHeaders(len(body))
+	h["Location"] = location
+	w.WriteRequestLine(response.StatusMovedPermanently)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func writeOpenError(w *response.Writer, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		writeError(w, response.StatusNotFound, errors.New("file not found"))
+	case errors.Is(err, fs.ErrPermission):
+		writeError(w, response.StatusForbidden, errors.New("permission denied"))
+	default:
+		// os.Root reports paths that try to escape it with its own error, and those are
+		// answered as if the file did not exist.
+		writeError(w, response.StatusNotFound, errors.New("file not found"))
+	}
+}
@@ -0,0 +1,148 @@
+package content
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, handler server.Handler, method, target string) (string, string) {
+	t.Helper()
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     headers.Headers{"host": "localhost"},
+	}
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetMethod(method)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	head, body, found := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, found)
+	return head + "\r\n", body
+}
+
+var site = fstest.MapFS{
+	"index.html":       {Data: []byte("<html>home</html>")},
+	"notes.txt":        {Data: []byte("hello notes")},
+	"mystery":          {Data: []byte("<!DOCTYPE html><p>sniffed</p>")},
+	"blob":             {Data: []byte{0x00, 0x01, 0x02}},
+	"docs/guide.md":    {Data: []byte("# guide")},
+	"docs/a <b>&c.txt": {Data: []byte("odd")},
+	"empty/.keep":      {Data: []byte{}},
+	"media/clip.mp4":   {Data: []byte("\x00\x00\x00\x18ftypmp42rest")},
+}
+
+func TestFileServerFiles(t *testing.T) {
+	handler := FileServer(site)
+
+	// Test: Root serves index.html
+	head, body := get(t, handler, "GET", "/")
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, head, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Equal(t, "<html>home</html>", body)
+
+	// Test: Type by extension, with query string ignored
+	head, body = get(t, handler, "GET", "/notes.txt?v=1")
+	assert.Contains(t, head, "Content-Type: text/plain; charset=utf-8\r\n")
+	assert.Equal(t, "hello notes", body)
+
+	// Test: Type by sniffing
+	head, body = get(t, handler, "GET", "/mystery")
+	assert.Contains(t, head, "Content-Type: text/html; charset=utf-8\r\n")
+	assert.Equal(t, "<!DOCTYPE html><p>sniffed</p>", body)
+	head, _ = get(t, handler, "GET", "/blob")
+	assert.Contains(t, head, "Content-Type: application/octet-stream\r\n")
+
+	// Test: Percent-encoded names
+	_, body = get(t, handler, "GET", "/docs/a%20%3Cb%3E&c.txt")
+	assert.Equal(t, "odd", body)
+
+	// Test: HEAD has headers but no body
+	head, body = get(t, handler, "HEAD", "/notes.txt")
+	assert.Contains(t, head, "Content-Length: 11\r\n")
+	assert.Empty(t, body)
+
+	// Test: Other methods are refused
+	head, _ = get(t, handler, "POST", "/notes.txt")
+	assert.Contains(t, head, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, head, "Allow: GET, HEAD\r\n")
+
+	// Test: Missing files and traversal attempts
+	for _, target := range []string{"/missing", "/../etc/passwd", "/docs/%2e%2e/%2e%2e/etc/passwd", "/docs/..%5c..%5cetc"} {
+		head, _ = get(t, handler, "GET", target)
+		assert.Contains(t, head, "HTTP/1.1 404 Not Found\r\n", target)
+	}
+}
+
+func TestFileServerDirectories(t *testing.T) {
+	// Test: Directory without slash redirects
+	head, _ := get(t, FileServer(site), "GET", "/docs?x=1")
+	assert.Contains(t, head, "HTTP/1.1 301 Moved Permanently\r\n")
+	assert.Contains(t, head, "Location: /docs/?x=1\r\n")
+
+	// Test: File with slash redirects the other way
+	head, _ = get(t, FileServer(site), "GET", "/notes.txt/")
+	assert.Contains(t, head, "Location: /notes.txt\r\n")
+
+	// Test: Listing is off by default
+	head, _ = get(t, FileServer(site), "GET", "/docs/")
+	assert.Contains(t, head, "HTTP/1.1 403 Forbidden\r\n")
+
+	// Test: Listing escapes names
+	head, body := get(t, FileServer(site, WithDirectoryListing()), "GET", "/docs/")
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, body, "<title>Index of /docs/</title>")
+	assert.Contains(t, body, `<a href="../">../</a>`)
+	assert.Contains(t, body, `<a href="a%20%3Cb%3E&amp;c.txt">a &lt;b&gt;&amp;c.txt</a>`)
+	assert.Contains(t, body, `<a href="guide.md">guide.md</a>`)
+}
+
+func TestFileServerSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644))
+
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "public.txt"), []byte("public"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "sub"), 0o755))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "abs-link")))
+	require.NoError(t, os.Symlink("../"+filepath.Base(outside), filepath.Join(root, "rel-link")))
+	require.NoError(t, os.Symlink("../public.txt", filepath.Join(root, "sub", "inside-link")))
+
+	confined, err := Dir(root)
+	require.NoError(t, err)
+	for name, fsys := range map[string]fs.FS{"DirFS": os.DirFS(root), "Dir": confined} {
+		handler := FileServer(fsys)
+
+		// Test: Links that stay inside the root work
+		_, body := get(t, handler, "GET", "/sub/inside-link")
+		assert.Equal(t, "public", body, name)
+
+		// Test: Links that leave the root are refused
+		head, _ := get(t, handler, "GET", "/abs-link")
+		assert.Contains(t, head, "HTTP/1.1 404 Not Found\r\n", name)
+		head, _ = get(t, handler, "GET", "/rel-link/secret.txt")
+		assert.Contains(t, head, "HTTP/1.1 404 Not Found\r\n", name)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	assert.Equal(t, "image/png", DetectContentType([]byte("\x89PNG\r\n\x1a\nrest")))
+	assert.Equal(t, "video/mp4", DetectContentType(site["media/clip.mp4"].Data))
+	assert.Equal(t, "text/html; charset=utf-8", DetectContentType([]byte("  \n<HTML>")))
+	assert.Equal(t, "text/plain; charset=utf-8", DetectContentType([]byte("<htmlish")))
+	assert.Equal(t, "text/xml; charset=utf-8", DetectContentType([]byte("<?xml version=\"1.0\"?>")))
+	assert.Equal(t, "text/plain; charset=utf-8", DetectContentType([]byte{}))
+}
@@ -0,0 +1,96 @@
+package content
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// Range is a resolved byte range: Length bytes starting at Start.
+type Range struct {
+	Start  int64
+	Length int64
+}
+
+// ContentRange formats the range for a Content-Range header.
+func (r Range) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// ParseRange parses a "bytes=" Range header against a representation of the given size, as
+// described in RFC 9110 section 14.1.2. It understands the three forms of a byte range:
+// "0-499", the open-ended "500-" and the suffix "-500", and any number of them separated by
+// commas. Ranges that run past the end are clipped. Ranges that start past the end are dropped,
+// and if that leaves none it returns ErrRangeNotSatisfiable. Any other error means the header
+// is malformed and should be ignored.
+func ParseRange(val string, size int64) ([]Range, error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(val), "bytes=")
+	if !found {
+		return nil, fmt.Errorf("range %q is not in bytes", val)
+	}
+
+	ranges := make([]Range, 0)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, fmt.Errorf("range %q is incorrect", part)
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			suffix, err := parsePos(last)
+			if err != nil {
+				return nil, err
+			}
+			if suffix == 0 || size == 0 {
+				continue
+			}
+			suffix = min(suffix, size)
+			ranges = append(ranges, Range{Start: size - suffix, Length: suffix})
+			continue
+		}
+
+		start, err := parsePos(first)
+		if err != nil {
+			return nil, err
+		}
+		end := size - 1
+		if last != "" {
+			end, err = parsePos(last)
+			if err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, fmt.Errorf("range %q ends before it starts", part)
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, Range{Start: start, Length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, ErrRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+func parsePos(s string) (int64, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, fmt.Errorf("range position %q is incorrect", s)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("range position %q is incorrect", s)
+	}
+	return n, nil
+}
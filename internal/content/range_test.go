@@ -0,0 +1,134 @@
+package content
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	// Test: Single, open-ended and suffix ranges
+	ranges, err := ParseRange("bytes=0-499", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 0, Length: 500}}, ranges)
+
+	ranges, err = ParseRange("bytes=900-", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 900, Length: 100}}, ranges)
+
+	ranges, err = ParseRange("bytes=-300", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 700, Length: 300}}, ranges)
+
+	// Test: Clipping and several ranges
+	ranges, err = ParseRange("bytes=0-0, 990-5000, -5000", 1000)
+	require.NoError(t, err)
+	assert.Equal(t, []Range{{Start: 0, Length: 1}, {Start: 990, Length: 10}, {Start: 0, Length: 1000}}, ranges)
+
+	// Test: Unsatisfiable
+	_, err = ParseRange("bytes=1000-", 1000)
+	assert.ErrorIs(t, err, ErrRangeNotSatisfiable)
+	_, err = ParseRange("bytes=-0", 1000)
+	assert.ErrorIs(t, err, ErrRangeNotSatisfiable)
+
+	// Test: Malformed
+	for _, val := range []string{"items=0-1", "bytes=5", "bytes=5-1", "bytes=a-b", "bytes=-", "bytes=+1-2"} {
+		_, err := ParseRange(val, 1000)
+		assert.Error(t, err, val)
+		assert.NotErrorIs(t, err, ErrRangeNotSatisfiable, val)
+	}
+}
+
+var video = []byte(strings.Repeat("0123456789", 10))
+
+func serve(t *testing.T, rangeHeader string) (string, []byte) {
+	t.Helper()
+	req := &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/video", HttpVersion: "1.1"},
+		Headers:     headers.Headers{"host": "localhost"},
+	}
+	if rangeHeader != "" {
+		req.Headers["range"] = rangeHeader
+	}
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	Serve(w, req, "video/mp4", bytes.NewReader(video))
+	require.NoError(t, w.Finish())
+
+	head, body, found := strings.Cut(buf.String(), "\r\n\r\n")
+	require.True(t, found)
+	return head + "\r\n", []byte(body)
+}
+
+func TestServeRanges(t *testing.T) {
+	// Test: No Range sends everything and advertises ranges
+	head, body := serve(t, "")
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.Contains(t, head, "Accept-Ranges: bytes\r\n")
+	assert.Contains(t, head, "Content-Length: 100\r\n")
+	assert.Equal(t, video, body)
+
+	// Test: Single range
+	head, body = serve(t, "bytes=10-19")
+	assert.Contains(t, head, "HTTP/1.1 206 Partial Content\r\n")
+	assert.Contains(t, head, "Content-Range: bytes 10-19/100\r\n")
+	assert.Contains(t, head, "Content-Length: 10\r\n")
+	assert.Equal(t, video[10:20], body)
+
+	// Test: Unsatisfiable range
+	head, body = serve(t, "bytes=200-")
+	assert.Contains(t, head, "HTTP/1.1 416 Range Not Satisfiable\r\n")
+	assert.Contains(t, head, "Content-Range: bytes */100\r\n")
+	assert.Empty(t, body)
+
+	// Test: Malformed and overlapping ranges fall back to 200
+	head, body = serve(t, "bytes=oops")
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.Equal(t, video, body)
+	head, _ = serve(t, "bytes=0-50, 25-75")
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+}
+
+func TestServeMultipartRanges(t *testing.T) {
+	// Test: Two ranges come back as multipart/byteranges
+	head, body := serve(t, "bytes=0-4, -5")
+	assert.Contains(t, head, "HTTP/1.1 206 Partial Content\r\n")
+
+	contentType := ""
+	for _, line := range strings.Split(head, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "Content-Type: "); ok {
+			contentType = v
+		}
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	assert.Contains(t, head, fmt.Sprintf("Content-Length: %d\r\n", len(body)))
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "bytes 0-4/100", part.Header.Get("Content-Range"))
+	assert.Equal(t, "video/mp4", part.Header.Get("Content-Type"))
+	data, _ := io.ReadAll(part)
+	assert.Equal(t, "01234", string(data))
+
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "bytes 95-99/100", part.Header.Get("Content-Range"))
+	data, _ = io.ReadAll(part)
+	assert.Equal(t, "56789", string(data))
+
+	_, err = mr.NextPart()
+	assert.ErrorIs(t, err, io.EOF)
+}
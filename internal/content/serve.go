@@ -0,0 +1,178 @@
+package content
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"time"
+)
+
+// copyBufferSize is how much of the content is held in memory at a time while streaming.
+const copyBufferSize = 32 * 1024
+
+// maxRanges caps how many ranges a multi-range request may ask for before it is answered with
+// the whole representation instead.
+const maxRanges = 32
+
+// Serve answers a GET or HEAD for content, honoring a Range header if there is one. Without
+// Range, or with one that is malformed, overlaps itself or asks for more than the whole, it
+// sends the full content with 200. A single range gets 206 with Content-Range, several get a
+// multipart/byteranges body, and ranges that all start past the end get 416. Every response
+// advertises "Accept-Ranges: bytes". The content is streamed, never read into memory whole.
+func Serve(w *response.Writer, req *request.Request, contentType string, content io.ReadSeeker) {
+	ServeContent(w, req, contentType, Validators{}, content)
+}
+
+// ServeContent is Serve for content that has validators. They are sent as ETag and
+// Last-Modified, conditional headers are checked against them before anything else, and a
+// Range guarded by an If-Range that no longer matches is ignored.
+func ServeContent(w *response.Writer, req *request.Request, contentType string, v Validators, content io.ReadSeeker) {
+	if CheckPreconditions(w, req, v) {
+		return
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		writeError(w, response.StatusInternalServerError, err)
+		return
+	}
+
+	h := make(headers.Headers)
+	h["Accept-Ranges"] = "bytes"
+	h["Content-Type"] = contentType
+	v.setHeaders(h)
+
+	val, ok := req.Headers.Get("Range")
+	if !ok || req.RequestLine.Method != "GET" || !rangeApplies(req, v) {
+		serveFull(w, req, h, content, size)
+		return
+	}
+
+	ranges, err := ParseRange(val, size)
+	if errors.Is(err, ErrRangeNotSatisfiable) {
+		h["Content-Range"] = fmt.Sprintf("bytes */%d", size)
+		h["Content-Length"] = "0"
+		w.WriteRequestLine(response.StatusRangeNotSatisfiable)
+		w.WriteHeaders(h)
+		return
+	}
+	if err != nil || !isReasonable(ranges, size) {
+		serveFull(w, req, h, content, size)
+		return
+	}
+
+	if len(ranges) == 1 {
+		h["Content-Range"] = ranges[0].ContentRange(size)
+		h["Content-Length"] = fmt.Sprintf("%d", ranges[0].Length)
+		w.WriteRequestLine(response.StatusPartialContent)
+		w.WriteHeaders(h)
+		copyRange(w, content, ranges[0])
+		return
+	}
+	serveMultipart(w, h, content, size, ranges)
+}
+
+// ServeBytes serves a body built in memory, with a strong ETag computed from its bytes and a
+// Last-Modified header if modTime is set. It gets the same conditional and range handling as
+// ServeContent.
+func ServeBytes(w *response.Writer, req *request.Request, contentType string, modTime time.Time, body []byte) {
+	v := Validators{ETag: StrongETag(body), LastModified: modTime}
+	ServeContent(w, req, contentType, v, bytes.NewReader(body))
+}
+
+func serveFull(w *response.Writer, req *request.Request, h headers.Headers, content io.ReadSeeker, size int64) {
+	h["Content-Length"] = fmt.Sprintf("%d", size)
+	w.WriteRequestLine(response.StatusOK)
+	w.WriteHeaders(h)
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+	copyRange(w, content, Range{Start: 0, Length: size})
+}
+
+// serveMultipart sends each range as a part of a multipart/byteranges body. The part headers
+// are worked out first so the total Content-Length is known before anything is sent.
+func serveMultipart(w *response.Writer, h headers.Headers, content io.ReadSeeker, size int64, ranges []Range) {
+	random := make([]byte, 16)
+	rand.Read(random)
+	boundary := hex.EncodeToString(random)
+
+	partHeaders := make([]string, len(ranges))
+	total := int64(0)
+	for i, r := range ranges {
+		partHeaders[i] = fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n",
+			boundary, h["Content-Type"], r.ContentRange(size))
+		total += int64(len(partHeaders[i])) + r.Length
+	}
+	closing := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	total += int64(len(closing))
+
+	h["Content-Type"] = "multipart/byteranges; boundary=" + boundary
+	h["Content-Length"] = fmt.Sprintf("%d", total)
+	w.WriteRequestLine(response.StatusPartialContent)
+	w.WriteHeaders(h)
+	for i, r := range ranges {
+		if _, err := w.WriteBody([]byte(partHeaders[i])); err != nil {
+			return
+		}
+		if err := copyRange(w, content, r); err != nil {
+			return
+		}
+	}
+	w.WriteBody([]byte(closing))
+}
+
+func copyRange(w *response.Writer, content io.ReadSeeker, r Range) error {
+	if _, err := content.Seek(r.Start, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, min(copyBufferSize, max(r.Length, 1)))
+	remaining := r.Length
+	for remaining > 0 {
+		n, err := content.Read(buf[:min(int64(len(buf)), remaining)])
+		if n > 0 {
+			if _, werr := w.WriteBody(buf[:n]); werr != nil {
+				return werr
+			}
+			remaining -= int64(n)
+		}
+		if err == io.EOF && remaining > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// isReasonable guards against range requests built to make the server do far more work than
+// sending the content once: too many ranges, overlapping ranges, or more bytes than the whole.
+func isReasonable(ranges []Range, size int64) bool {
+	if len(ranges) > maxRanges {
+		return false
+	}
+	total := int64(0)
+	for i, r := range ranges {
+		total += r.Length
+		for _, other := range ranges[:i] {
+			if r.Start < other.Start+other.Length && other.Start < r.Start+r.Length {
+				return false
+			}
+		}
+	}
+	return total <= size
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, err error) {
+	body := fmt.Appendf(nil, "Error serving content: %v", err)
+	w.WriteRequestLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
@@ -0,0 +1,98 @@
+package content
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+)
+
+// sniffLen is how many leading bytes DetectContentType looks at.
+const sniffLen = 512
+
+// extraTypes covers extensions the mime package only knows about when the system has a mime
+// table installed.
+var extraTypes = map[string]string{
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+	".mp3":   "audio/mpeg",
+	".ogg":   "application/ogg",
+	".txt":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".zip":   "application/zip",
+	".gz":    "application/gzip",
+}
+
+// TypeByExtension returns the media type for a file extension such as ".html", or "" if the
+// extension is not known.
+func TypeByExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return extraTypes[ext]
+}
+
+type signature struct {
+	offset      int
+	magic       []byte
+	contentType string
+}
+
+var signatures = []signature{
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{8, []byte("WEBP"), "image/webp"},
+	{0, []byte("\x1f\x8b\x08"), "application/x-gzip"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{4, []byte("ftyp"), "video/mp4"},
+	{0, []byte("\x1a\x45\xdf\xa3"), "video/webm"},
+	{0, []byte("OggS"), "application/ogg"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("wOFF"), "font/woff"},
+	{0, []byte("wOF2"), "font/woff2"},
+}
+
+var htmlPrefixes = []string{
+	"<!doctype html", "<html", "<head", "<body", "<script", "<title", "<style", "<div", "<p", "<h1", "<!--",
+}
+
+// DetectContentType guesses a media type from the first bytes of a file, along the lines of the
+// WHATWG MIME sniffing algorithm: well known magic numbers first, then markup, then text versus
+// binary. It always returns a usable type, falling back to application/octet-stream.
+func DetectContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+
+	for _, sig := range signatures {
+		if len(data) >= sig.offset+len(sig.magic) && bytes.Equal(data[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return sig.contentType
+		}
+	}
+
+	trimmed := bytes.ToLower(bytes.TrimLeft(data, " \t\r\n\f"))
+	for _, prefix := range htmlPrefixes {
+		if bytes.HasPrefix(trimmed, []byte(prefix)) {
+			rest := trimmed[len(prefix):]
+			if prefix == "<!--" || len(rest) == 0 || rest[0] == ' ' || rest[0] == '>' {
+				return "text/html; charset=utf-8"
+			}
+		}
+	}
+	if bytes.HasPrefix(trimmed, []byte("<?xml")) {
+		return "text/xml; charset=utf-8"
+	}
+
+	for _, b := range data {
+		if b <= 0x08 || b == 0x0b || (b >= 0x0e && b <= 0x1a) || (b >= 0x1c && b <= 0x1f) {
+			return "application/octet-stream"
+		}
+	}
+	return "text/plain; charset=utf-8"
+}
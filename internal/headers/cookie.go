@@ -0,0 +1,30 @@
+package headers
+
+import (
+	"strings"
+)
+
+// IsCookieNameCorrect checks a cookie name, which has to be a token (RFC 6265 section 4.1.1).
+// Both the Cookie header a client sends and the Set-Cookie header a server writes are held to it.
+func IsCookieNameCorrect(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, ch := range name {
+		if ch <= ' ' || ch >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsCookieValueCorrect checks for cookie-octets as defined by RFC 6265 section 4.1.1. Double
+// quotes around the value are the caller's to strip first.
+func IsCookieValueCorrect(value string) bool {
+	for _, ch := range value {
+		if ch <= ' ' || ch >= 0x7f || ch == '"' || ch == ',' || ch == ';' || ch == '\\' {
+			return false
+		}
+	}
+	return true
+}
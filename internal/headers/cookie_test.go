@@ -0,0 +1,22 @@
+package headers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieNameAndValue(t *testing.T) {
+	// Test: Names are tokens
+	assert.True(t, IsCookieNameCorrect("session_id"))
+	for _, name := range []string{"", "a b", "a=b", "a;b", "a\"b", "é"} {
+		assert.False(t, IsCookieNameCorrect(name), name)
+	}
+
+	// Test: Values are cookie-octets, which leave out quotes, commas, semicolons and backslashes
+	assert.True(t, IsCookieValueCorrect("abc-123_.~!#$%&'()*+/:<=>?@[]^`{|}"))
+	assert.True(t, IsCookieValueCorrect(""))
+	for _, value := range []string{"a b", "a,b", "a;b", "a\\b", "\"abc\"", "a\x7fb", "\r\n"} {
+		assert.False(t, IsCookieValueCorrect(value), value)
+	}
+}
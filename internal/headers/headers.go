@@ -87,6 +87,21 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 	return clrfIdx+2, false, nil
 }
 
+// CheckField checks a field name and value the way Parse checks a field line, for callers that
+// write fields rather than read them. A value holding CR or LF would end the line early and
+// pass the rest off as more fields, so it is refused along with the other control characters.
+func CheckField(key, val string) error {
+	hks := make(HeaderKeySet)
+	hks.initialize()
+	if _, ok := isHeaderKeyCorrect(key, hks); !ok {
+		return fmt.Errorf("header name %q is incorrect", key)
+	}
+	if _, ok := isHeaderValCorrect(val); !ok {
+		return fmt.Errorf("header %s has an incorrect value", key)
+	}
+	return nil
+}
+
 func isHeaderKeyCorrect(key string, hks HeaderKeySet) (string, bool) {
 	if len(key) == 0 {
 		return key, false
@@ -102,15 +117,58 @@ func isHeaderKeyCorrect(key string, hks HeaderKeySet) (string, bool) {
 	return key, true 
 }
 
+// isHeaderValCorrect trims the whitespace around a field value. Values may be empty (RFC 9110
+// section 5.5), but may not hold control characters other than tab.
 func isHeaderValCorrect(val string) (string, bool) {
-	if len(val) == 0 {
-		return val, false
-	}
-
 	val = strings.TrimSpace(val)
-	if len(val) == 0 {
-		return val, false
+	for i := 0; i < len(val); i++ {
+		if (val[i] < ' ' && val[i] != '\t') || val[i] == 0x7f {
+			return val, false
+		}
 	}
 
 	return val, true
-}
\ No newline at end of file
+}
+
+// Get looks a header up without regard to case. Parsed request headers are
+// stored lowercased while handlers tend to build response headers in
+// canonical form, so callers that can see either should go through Get.
+func (h Headers) Get(key string) (string, bool) {
+	if val, ok := h[key]; ok {
+		return val, true
+	}
+	if val, ok := h[strings.ToLower(key)]; ok {
+		return val, true
+	}
+	for k, val := range h {
+		if strings.EqualFold(k, key) {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// Delete removes every spelling of the given header key.
+func (h Headers) Delete(key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+}
+
+// HasToken reports whether the comma separated header value contains the
+// given token, ignoring case. It is meant for list headers such as
+// Connection or Transfer-Encoding.
+func (h Headers) HasToken(key, token string) bool {
+	val, ok := h.Get(key)
+	if !ok {
+		return false
+	}
+	for _, part := range strings.Split(val, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
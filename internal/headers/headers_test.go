@@ -95,4 +95,41 @@ func TestRequestLineParse(t *testing.T) {
 	assert.Equal(t, "localhost:42069, localhost:69420", headers["host"])
 	assert.Equal(t, 30, n)
 	assert.True(t, done)
-}
\ No newline at end of file
+
+	// Test: Valid empty header value
+	headers = make(Headers)
+	data = []byte("X-Empty:   \r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.NoError(t, err)
+	val, ok := headers["x-empty"]
+	assert.True(t, ok)
+	assert.Equal(t, "", val)
+	assert.Equal(t, 15, n)
+	assert.True(t, done)
+
+	// Test: Invalid control character in header value
+	headers = make(Headers)
+	data = []byte("X-Bell: ring\a\r\n\r\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, len(headers))
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+}
+func TestCheckField(t *testing.T) {
+	// Test: Fields the parser would accept pass
+	assert.NoError(t, CheckField("X-Custom", "some value"))
+	assert.NoError(t, CheckField("x-empty", ""))
+
+	// Test: Names with separators and values with line breaks do not
+	for _, field := range [][2]string{
+		{"", "v"},
+		{"Bad Name", "v"},
+		{"X-Colon:", "v"},
+		{"X-Injected", "v\r\nX-Other: 1"},
+		{"X-Newline", "v\nGET /admin HTTP/1.1"},
+		{"X-Nul", "v\x00"},
+	} {
+		assert.Error(t, CheckField(field[0], field[1]), "%q", field)
+	}
+}
@@ -0,0 +1,186 @@
+package headers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrHeaderMissing = errors.New("header is missing")
+
+// MediaType is a parsed Content-Type style value such as
+// `multipart/form-data; boundary="abc 123"`. Type, Subtype and parameter names are lowercased
+// since they compare case-insensitively; parameter values are kept as sent, minus any quoting.
+type MediaType struct {
+	Type    string
+	Subtype string
+	Params  map[string]string
+}
+
+// ParseMediaType parses a media type as defined by RFC 9110 section 8.3.1. Parameter values may
+// be tokens or quoted strings with backslash escapes, and a parameter may appear only once.
+func ParseMediaType(val string) (MediaType, error) {
+	hks := make(HeaderKeySet)
+	hks.initialize()
+
+	essence, rest, _ := strings.Cut(val, ";")
+	essence = strings.TrimSpace(essence)
+	typ, subtype, found := strings.Cut(essence, "/")
+	if !found || !isToken(typ, hks) || !isToken(subtype, hks) {
+		return MediaType{}, fmt.Errorf("media type %q is incorrect", val)
+	}
+
+	mt := MediaType{
+		Type:    strings.ToLower(typ),
+		Subtype: strings.ToLower(subtype),
+		Params:  make(map[string]string),
+	}
+
+	for {
+		rest = strings.TrimLeft(rest, " \t;")
+		if rest == "" {
+			return mt, nil
+		}
+
+		name, after, found := strings.Cut(rest, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !found || !isToken(name, hks) {
+			return MediaType{}, fmt.Errorf("media type parameter in %q is incorrect", val)
+		}
+		if _, ok := mt.Params[name]; ok {
+			return MediaType{}, fmt.Errorf("media type parameter %q is repeated", name)
+		}
+
+		value, remaining, err := parseParamValue(after, hks)
+		if err != nil {
+			return MediaType{}, fmt.Errorf("media type parameter %q: %w", name, err)
+		}
+		mt.Params[name] = value
+
+		remaining = strings.TrimLeft(remaining, " \t")
+		if remaining != "" && remaining[0] != ';' {
+			return MediaType{}, fmt.Errorf("media type %q has junk after parameter %q", val, name)
+		}
+		rest = remaining
+	}
+}
+
+// parseParamValue reads one token or quoted-string off the front of s and returns the value and
+// whatever follows it.
+func parseParamValue(s string, hks HeaderKeySet) (string, string, error) {
+	if strings.HasPrefix(s, "\"") {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '"':
+				return b.String(), s[i+1:], nil
+			case '\\':
+				if i+1 == len(s) {
+					return "", "", fmt.Errorf("quoted string is not terminated")
+				}
+				i++
+				b.WriteByte(s[i])
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return "", "", fmt.Errorf("quoted string is not terminated")
+	}
+
+	end := strings.IndexAny(s, "; \t")
+	if end == -1 {
+		end = len(s)
+	}
+	if !isToken(s[:end], hks) {
+		return "", "", fmt.Errorf("value %q is incorrect", s[:end])
+	}
+	return s[:end], s[end:], nil
+}
+
+// Essence returns "type/subtype" without parameters.
+func (m MediaType) Essence() string {
+	return m.Type + "/" + m.Subtype
+}
+
+// String formats the media type with its parameters in a stable order, quoting values that are
+// not plain tokens.
+func (m MediaType) String() string {
+	hks := make(HeaderKeySet)
+	hks.initialize()
+
+	names := make([]string, 0, len(m.Params))
+	for name := range m.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(m.Essence())
+	for _, name := range names {
+		value := m.Params[name]
+		b.WriteString("; " + name + "=")
+		if isToken(value, hks) {
+			b.WriteString(value)
+			continue
+		}
+		b.WriteByte('"')
+		for i := 0; i < len(value); i++ {
+			if value[i] == '"' || value[i] == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(value[i])
+		}
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// ContentType parses the Content-Type header.
+func (h Headers) ContentType() (MediaType, error) {
+	val, ok := h.Get("Content-Type")
+	if !ok {
+		return MediaType{}, fmt.Errorf("content-type: %w", ErrHeaderMissing)
+	}
+	return ParseMediaType(val)
+}
+
+// ContentLength parses the Content-Length header. Only plain decimal digits are accepted. A
+// client that repeats the header ends up with a comma separated list, which RFC 9110 section 8.6
+// lets us accept as long as every value agrees.
+func (h Headers) ContentLength() (int, error) {
+	val, ok := h.Get("Content-Length")
+	if !ok {
+		return 0, fmt.Errorf("content-length: %w", ErrHeaderMissing)
+	}
+
+	contentLength := -1
+	for _, part := range strings.Split(val, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 || strings.Trim(part, "0123456789") != "" {
+			return 0, fmt.Errorf("content-length %q is incorrect", val)
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("content-length %q is too large", val)
+		}
+		if contentLength != -1 && n != contentLength {
+			return 0, fmt.Errorf("content-length %q has conflicting values", val)
+		}
+		contentLength = n
+	}
+	return contentLength, nil
+}
+
+func isToken(s string, hks HeaderKeySet) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, ch := range s {
+		if !hks[ch] {
+			return false
+		}
+	}
+	return true
+}
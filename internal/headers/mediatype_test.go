@@ -0,0 +1,76 @@
+package headers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMediaType(t *testing.T) {
+	// Test: Plain type with charset, mixed case
+	mt, err := ParseMediaType("Text/HTML; Charset=UTF-8")
+	require.NoError(t, err)
+	assert.Equal(t, "text", mt.Type)
+	assert.Equal(t, "html", mt.Subtype)
+	assert.Equal(t, "text/html", mt.Essence())
+	assert.Equal(t, "UTF-8", mt.Params["charset"])
+
+	// Test: Quoted boundary with escapes and extra whitespace
+	mt, err = ParseMediaType(`multipart/form-data ;  boundary="abc \"123\"; x" ; foo=bar`)
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/form-data", mt.Essence())
+	assert.Equal(t, `abc "123"; x`, mt.Params["boundary"])
+	assert.Equal(t, "bar", mt.Params["foo"])
+
+	// Test: Round trip through String
+	again, err := ParseMediaType(mt.String())
+	require.NoError(t, err)
+	assert.Equal(t, mt, again)
+	assert.Equal(t, `multipart/form-data; boundary="abc \"123\"; x"; foo=bar`, mt.String())
+
+	// Test: Malformed values
+	for _, val := range []string{
+		"",
+		"text",
+		"text/",
+		"/html",
+		"text/html; charset",
+		"text/html; charset=",
+		`text/html; charset="utf-8`,
+		"text/html; charset=utf-8 junk",
+		"text/html; charset=a; CHARSET=b",
+		"te xt/html",
+	} {
+		_, err := ParseMediaType(val)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestHeadersContentLength(t *testing.T) {
+	// Test: Valid, repeated identical and missing lengths
+	n, err := Headers{"content-length": "42"}.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, 42, n)
+
+	n, err = Headers{"Content-Length": "7, 7"}.ContentLength()
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+
+	_, err = Headers{}.ContentLength()
+	assert.ErrorIs(t, err, ErrHeaderMissing)
+
+	// Test: Malformed lengths
+	for _, val := range []string{"", "-1", "+5", "1.5", "abc", "5, 6", "99999999999999999999"} {
+		_, err := Headers{"content-length": val}.ContentLength()
+		assert.Error(t, err, val)
+		assert.NotErrorIs(t, err, ErrHeaderMissing)
+	}
+
+	// Test: Content type accessor
+	mt, err := Headers{"content-type": "application/json"}.ContentType()
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", mt.Essence())
+	_, err = Headers{}.ContentType()
+	assert.ErrorIs(t, err, ErrHeaderMissing)
+}
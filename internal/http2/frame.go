@@ -0,0 +1,205 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface is what every HTTP/2 client sends first (RFC 9113 section 3.4). A server that
+// sees it at the start of a connection knows the client speaks HTTP/2 without asking.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	frameHeaderLen = 9
+
+	// defaultMaxFrameSize is the largest frame payload either side may send until told
+	// otherwise, and the limit this server keeps for what it reads.
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+
+	// defaultWindowSize is the flow-control window every stream and the connection start with.
+	defaultWindowSize = 65535
+	maxWindowSize     = 1<<31 - 1
+)
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+type setting struct {
+	id  settingID
+	val uint32
+}
+
+// errCode is the reason given in RST_STREAM and GOAWAY frames (RFC 9113 section 7).
+type errCode uint32
+
+const (
+	errCodeNo            errCode = 0x0
+	errCodeProtocol      errCode = 0x1
+	errCodeInternal      errCode = 0x2
+	errCodeFlowControl   errCode = 0x3
+	errCodeStreamClosed  errCode = 0x5
+	errCodeFrameSize     errCode = 0x6
+	errCodeRefusedStream errCode = 0x7
+	errCodeCancel        errCode = 0x8
+	errCodeCompression   errCode = 0x9
+)
+
+func (c errCode) String() string {
+	switch c {
+	case errCodeNo:
+		return "NO_ERROR"
+	case errCodeProtocol:
+		return "PROTOCOL_ERROR"
+	case errCodeInternal:
+		return "INTERNAL_ERROR"
+	case errCodeFlowControl:
+		return "FLOW_CONTROL_ERROR"
+	case errCodeStreamClosed:
+		return "STREAM_CLOSED"
+	case errCodeFrameSize:
+		return "FRAME_SIZE_ERROR"
+	case errCodeRefusedStream:
+		return "REFUSED_STREAM"
+	case errCodeCancel:
+		return "CANCEL"
+	case errCodeCompression:
+		return "COMPRESSION_ERROR"
+	}
+	return fmt.Sprintf("error code 0x%x", uint32(c))
+}
+
+// connError ends the whole connection with a GOAWAY.
+type connError struct {
+	code   errCode
+	reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("connection error %v: %s", e.code, e.reason)
+}
+
+// streamError ends one stream with a RST_STREAM and leaves the connection running.
+type streamError struct {
+	streamID uint32
+	code     errCode
+	reason   string
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("stream %d error %v: %s", e.streamID, e.code, e.reason)
+}
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f *frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+// readFrame reads the next frame, refusing one whose payload is over maxSize.
+func readFrame(r io.Reader, maxSize uint32) (*frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	f := &frame{
+		typ:      frameType(header[3]),
+		flags:    header[4],
+		streamID: binary.BigEndian.Uint32(header[5:]) & (1<<31 - 1),
+	}
+	if length > maxSize {
+		return nil, connError{errCodeFrameSize, fmt.Sprintf("frame of %d bytes is over the limit of %d", length, maxSize)}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, noEOF(err)
+	}
+	return f, nil
+}
+
+// noEOF turns a clean end of input into an unexpected one, for when it comes partway through a
+// frame.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendFrame(buf []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	length := len(payload)
+	buf = append(buf, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	buf = binary.BigEndian.AppendUint32(buf, streamID)
+	return append(buf, payload...)
+}
+
+// unpad strips the padding from a DATA or HEADERS payload that has the PADDED flag.
+func (f *frame) unpad() ([]byte, error) {
+	if !f.has(flagPadded) {
+		return f.payload, nil
+	}
+	if len(f.payload) == 0 || int(f.payload[0]) >= len(f.payload) {
+		return nil, connError{errCodeProtocol, "padding is longer than the frame"}
+	}
+	return f.payload[1 : len(f.payload)-int(f.payload[0])], nil
+}
+
+func parseSettings(payload []byte) ([]setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError{errCodeFrameSize, "SETTINGS payload is not a multiple of 6 bytes"}
+	}
+	settings := make([]setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, setting{
+			id:  settingID(binary.BigEndian.Uint16(payload[i:])),
+			val: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
+
+func appendSettings(buf []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(s.id))
+		buf = binary.BigEndian.AppendUint32(buf, s.val)
+	}
+	return buf
+}
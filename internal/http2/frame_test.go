@@ -0,0 +1,55 @@
+package http2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+	// Test: A frame comes back as it was written, without the reserved bit of its stream ID
+	buf := appendFrame(nil, frameHeaders, flagEndHeaders|flagEndStream, 1<<31|5, []byte("block"))
+	f, err := readFrame(bytes.NewReader(buf), defaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, &frame{typ: frameHeaders, flags: flagEndHeaders | flagEndStream, streamID: 5, payload: []byte("block")}, f)
+	assert.True(t, f.has(flagEndStream))
+	assert.False(t, f.has(flagPadded))
+
+	// Test: A frame over the size limit ends the connection
+	_, err = readFrame(bytes.NewReader(appendFrame(nil, frameData, 0, 1, make([]byte, 20))), 10)
+	var ce connError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, errCodeFrameSize, ce.code)
+
+	// Test: A frame cut short is an unexpected end
+	_, err = readFrame(bytes.NewReader(buf[:len(buf)-1]), defaultMaxFrameSize)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = readFrame(bytes.NewReader(nil), defaultMaxFrameSize)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Padding is stripped, and padding longer than the frame refused
+	padded := &frame{typ: frameData, flags: flagPadded, payload: []byte("\x03data\x00\x00\x00")}
+	data, err := padded.unpad()
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	padded.payload = []byte("\x05abc")
+	_, err = padded.unpad()
+	assert.ErrorAs(t, err, &ce)
+}
+
+func TestSettings(t *testing.T) {
+	// Test: Settings survive a round trip
+	want := []setting{{settingInitialWindowSize, 1 << 20}, {settingMaxFrameSize, 1 << 15}}
+	got, err := parseSettings(appendSettings(nil, want...))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// Test: A payload that is not whole settings is refused
+	_, err = parseSettings([]byte{0, 1, 0, 0, 0})
+	var ce connError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, errCodeFrameSize, ce.code)
+}
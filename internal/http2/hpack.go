@@ -0,0 +1,453 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// headerField is one name and value in a header block.
+type headerField struct {
+	name, value string
+}
+
+// size is what the field counts for against a dynamic table's limit (RFC 7541 section 4.1).
+func (hf headerField) size() uint32 {
+	return uint32(len(hf.name) + len(hf.value) + 32)
+}
+
+// staticTable is RFC 7541 Appendix A. Index 1 is the first entry.
+var staticTable = [...]headerField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+var (
+	errHeaderListTooLarge = errors.New("header list is too large")
+	errCompression        = errors.New("header block is incorrect")
+)
+
+// decoder turns header blocks back into fields, keeping the dynamic table the peer's encoder
+// builds up across blocks (RFC 7541).
+type decoder struct {
+	// dynamic holds the newest entry first, so index 62 is dynamic[0].
+	dynamic []headerField
+	size    uint32
+	maxSize uint32
+	// limit is the table size this side advertised; the encoder may pick anything up to it.
+	limit       uint32
+	maxListSize uint32
+}
+
+func newDecoder(tableSize, maxListSize uint32) *decoder {
+	return &decoder{maxSize: tableSize, limit: tableSize, maxListSize: maxListSize}
+}
+
+// decode reads a whole header block. A block whose fields add up to more than maxListSize is
+// still read to the end, so the dynamic table stays in step with the peer, and then refused
+// with errHeaderListTooLarge. Any error wrapping errCompression leaves the table unusable and
+// has to end the connection.
+func (d *decoder) decode(block []byte) ([]headerField, error) {
+	var fields []headerField
+	var listSize uint32
+	tooLarge := false
+	first := true
+	for len(block) > 0 {
+		b := block[0]
+		var hf headerField
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// Indexed field.
+			var index uint64
+			index, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			hf, err = d.at(index)
+			if err != nil {
+				return nil, err
+			}
+		case b&0xc0 == 0x40:
+			// Literal with incremental indexing.
+			hf, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(hf)
+		case b&0xe0 == 0x20:
+			// Dynamic table size update, only allowed before the first field.
+			if !first {
+				return nil, fmt.Errorf("%w: table size update after a field", errCompression)
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.limit) {
+				return nil, fmt.Errorf("%w: table size %d is over the limit of %d", errCompression, size, d.limit)
+			}
+			d.maxSize = uint32(size)
+			d.evict()
+			continue
+		default:
+			// Literal without indexing (0000) or never indexed (0001).
+			hf, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+		}
+		first = false
+
+		listSize += hf.size()
+		if listSize > d.maxListSize {
+			tooLarge = true
+		}
+		if !tooLarge {
+			fields = append(fields, hf)
+		}
+	}
+	if tooLarge {
+		return nil, errHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+func (d *decoder) at(index uint64) (headerField, error) {
+	switch {
+	case index == 0:
+		return headerField{}, fmt.Errorf("%w: index 0", errCompression)
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	case index-uint64(len(staticTable)) <= uint64(len(d.dynamic)):
+		return d.dynamic[index-uint64(len(staticTable))-1], nil
+	}
+	return headerField{}, fmt.Errorf("%w: index %d is not in the table", errCompression, index)
+}
+
+// readLiteral reads a field whose name is either indexed or given as a string, followed by
+// its value.
+func (d *decoder) readLiteral(block []byte, prefixBits uint8) (headerField, []byte, error) {
+	index, block, err := readInt(block, prefixBits)
+	if err != nil {
+		return headerField{}, nil, err
+	}
+	var hf headerField
+	if index > 0 {
+		named, err := d.at(index)
+		if err != nil {
+			return headerField{}, nil, err
+		}
+		hf.name = named.name
+	} else if hf.name, block, err = readString(block); err != nil {
+		return headerField{}, nil, err
+	}
+	if hf.value, block, err = readString(block); err != nil {
+		return headerField{}, nil, err
+	}
+	return hf, block, nil
+}
+
+// add puts hf at the front of the dynamic table, evicting the oldest entries to make room. An
+// entry bigger than the whole table just empties it.
+func (d *decoder) add(hf headerField) {
+	d.dynamic = append([]headerField{hf}, d.dynamic...)
+	d.size += hf.size()
+	d.evict()
+}
+
+func (d *decoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= last.size()
+	}
+}
+
+// readInt reads an integer with an N-bit prefix (RFC 7541 section 5.1).
+func readInt(p []byte, prefixBits uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, fmt.Errorf("%w: block ends inside an integer", errCompression)
+	}
+	max := uint64(1)<<prefixBits - 1
+	v := uint64(p[0]) & max
+	p = p[1:]
+	if v < max {
+		return v, p, nil
+	}
+	for shift := uint(0); len(p) > 0; shift += 7 {
+		if shift > 28 {
+			return 0, nil, fmt.Errorf("%w: integer is too large", errCompression)
+		}
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: block ends inside an integer", errCompression)
+}
+
+func appendInt(buf []byte, prefixBits uint8, first byte, v uint64) []byte {
+	max := uint64(1)<<prefixBits - 1
+	if v < max {
+		return append(buf, first|byte(v))
+	}
+	buf = append(buf, first|byte(max))
+	v -= max
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// readString reads a string literal, which is Huffman coded when its first bit is set.
+func readString(p []byte) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, fmt.Errorf("%w: block ends inside a string", errCompression)
+	}
+	huffman := p[0]&0x80 != 0
+	length, p, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(p)) < length {
+		return "", nil, fmt.Errorf("%w: block ends inside a string", errCompression)
+	}
+	raw, p := p[:length], p[length:]
+	if !huffman {
+		return string(raw), p, nil
+	}
+	s, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, p, nil
+}
+
+// appendString writes s as a string literal, Huffman coded when that comes out shorter.
+func appendString(buf []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		buf = appendInt(buf, 7, 0x80, uint64(n))
+		return appendHuffman(buf, s)
+	}
+	buf = appendInt(buf, 7, 0, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendHeaderField encodes hf without ever adding it to the peer's dynamic table, so the
+// encoder keeps no state: a field the static table holds whole goes out as its index, one whose
+// name it holds as that index and a literal value, and anything else as two literals.
+func appendHeaderField(buf []byte, hf headerField) []byte {
+	nameIndex := 0
+	for i, entry := range staticTable {
+		if entry.name != hf.name {
+			continue
+		}
+		if entry.value == hf.value {
+			return appendInt(buf, 7, 0x80, uint64(i+1))
+		}
+		if nameIndex == 0 {
+			nameIndex = i + 1
+		}
+	}
+	first := byte(0x00)
+	if isSensitive(hf.name) {
+		first = 0x10
+	}
+	buf = appendInt(buf, 4, first, uint64(nameIndex))
+	if nameIndex == 0 {
+		buf = appendString(buf, hf.name)
+	}
+	return appendString(buf, hf.value)
+}
+
+// isSensitive picks out fields that intermediaries should not compress either, since they
+// would give away secrets to an attacker who can observe compressed sizes.
+func isSensitive(name string) bool {
+	return name == "authorization" || name == "proxy-authorization" || name == "set-cookie" || strings.HasSuffix(name, "-token")
+}
+
+// huffmanCodeLen holds the length in bits of each byte's code in the Huffman code of RFC 7541
+// Appendix B. The code is canonical, so the codes themselves follow from the lengths: within
+// each length they count up in byte order, after every shorter code. End-of-string, symbol 256,
+// has 30 bits.
+var huffmanCodeLen = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
+
+const (
+	huffmanEOS       = 256
+	huffmanEOSLen    = 30
+	huffmanMaxLength = 30
+)
+
+var (
+	huffmanCodes [256]uint32
+
+	// For each code length: the first code of that length, how many codes have it, and where
+	// their symbols start in huffmanSymbols, which lists symbols by code.
+	huffmanFirstCode  [huffmanMaxLength + 1]uint32
+	huffmanCount      [huffmanMaxLength + 1]uint32
+	huffmanFirstIndex [huffmanMaxLength + 1]int
+	huffmanSymbols    []int
+)
+
+func init() {
+	code := uint32(0)
+	for length := 1; length <= huffmanMaxLength; length++ {
+		huffmanFirstCode[length] = code
+		huffmanFirstIndex[length] = len(huffmanSymbols)
+		for sym := 0; sym <= huffmanEOS; sym++ {
+			if symbolLen(sym) != length {
+				continue
+			}
+			if sym < huffmanEOS {
+				huffmanCodes[sym] = code
+			}
+			huffmanSymbols = append(huffmanSymbols, sym)
+			huffmanCount[length]++
+			code++
+		}
+		code <<= 1
+	}
+}
+
+func symbolLen(sym int) int {
+	if sym == huffmanEOS {
+		return huffmanEOSLen
+	}
+	return int(huffmanCodeLen[sym])
+}
+
+func huffmanDecode(p []byte) (string, error) {
+	var out strings.Builder
+	code, length := uint32(0), 0
+	for _, b := range p {
+		for bit := 7; bit >= 0; bit-- {
+			code = code<<1 | uint32(b>>bit&1)
+			length++
+			if offset := code - huffmanFirstCode[length]; code >= huffmanFirstCode[length] && offset < huffmanCount[length] {
+				sym := huffmanSymbols[huffmanFirstIndex[length]+int(offset)]
+				if sym == huffmanEOS {
+					return "", fmt.Errorf("%w: end-of-string symbol inside a string", errCompression)
+				}
+				out.WriteByte(byte(sym))
+				code, length = 0, 0
+				continue
+			}
+			if length == huffmanMaxLength {
+				return "", fmt.Errorf("%w: Huffman code is incorrect", errCompression)
+			}
+		}
+	}
+	// What is left has to be padding: fewer than 8 bits, all ones, the start of end-of-string.
+	if length >= 8 || code != 1<<length-1 {
+		return "", fmt.Errorf("%w: Huffman padding is incorrect", errCompression)
+	}
+	return out.String(), nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func appendHuffman(buf []byte, s string) []byte {
+	var acc uint64
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		length := int(huffmanCodeLen[s[i]])
+		acc = acc<<length | uint64(huffmanCodes[s[i]])
+		bits += length
+		for bits >= 8 {
+			bits -= 8
+			buf = append(buf, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		// Pad with the most significant bits of end-of-string, which are all ones.
+		buf = append(buf, byte(acc<<(8-bits))|byte(1<<(8-bits)-1))
+	}
+	return buf
+}
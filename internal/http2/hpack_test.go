@@ -0,0 +1,158 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestInt(t *testing.T) {
+	tests := []struct {
+		v          uint64
+		prefixBits uint8
+		encoded    string
+	}{
+		{10, 5, "0a"},
+		{1337, 5, "1f9a0a"},
+		{42, 8, "2a"},
+		{31, 5, "1f00"},
+	}
+	for _, tt := range tests {
+		// Test: Integers use the prefix and continuation bytes of RFC 7541 C.1
+		assert.Equal(t, tt.encoded, hex.EncodeToString(appendInt(nil, tt.prefixBits, 0, tt.v)))
+		v, rest, err := readInt(mustHex(t, tt.encoded), tt.prefixBits)
+		require.NoError(t, err)
+		assert.Equal(t, tt.v, v)
+		assert.Empty(t, rest)
+	}
+
+	// Test: Integers that never end or would overflow are refused
+	_, _, err := readInt(mustHex(t, "1f9a"), 5)
+	assert.ErrorIs(t, err, errCompression)
+	_, _, err = readInt(mustHex(t, "1fffffffffff0f"), 5)
+	assert.ErrorIs(t, err, errCompression)
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: Strings from RFC 7541 C.4 decode
+	s, err := huffmanDecode(mustHex(t, "f1e3 c2e5 f23a 6ba0 ab90 f4ff"))
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", s)
+	s, err = huffmanDecode(mustHex(t, "a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, "no-cache", s)
+
+	// Test: Every byte survives encoding and decoding
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	for _, in := range []string{"", "a", "custom-key", all.String()} {
+		encoded := appendHuffman(nil, in)
+		assert.Len(t, encoded, huffmanEncodedLen(in))
+		out, err := huffmanDecode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, in, out)
+	}
+
+	// Test: Padding that is too long or not all ones is refused
+	for _, bad := range []string{"ff", "f1e3 c2e5 f23a 6ba0 ab90 f4ff ff", "00fe", "fffffffc"} {
+		_, err := huffmanDecode(mustHex(t, bad))
+		assert.ErrorIs(t, err, errCompression, bad)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	blocks := []struct {
+		name   string
+		block  string
+		fields []headerField
+		size   uint32
+	}{
+		{
+			name:  "C.3.1 first request",
+			block: "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			fields: []headerField{
+				{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+			},
+			size: 57,
+		},
+		{
+			name:  "C.3.2 second request",
+			block: "8286 84be 5808 6e6f 2d63 6163 6865",
+			fields: []headerField{
+				{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}, {"cache-control", "no-cache"},
+			},
+			size: 110,
+		},
+		{
+			name:  "C.4.3 third request, Huffman coded",
+			block: "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+			fields: []headerField{
+				{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"}, {"custom-key", "custom-value"},
+			},
+			size: 164,
+		},
+	}
+	d := newDecoder(4096, maxHeaderListSize)
+	for _, tt := range blocks {
+		// Test: Blocks decode against the dynamic table the earlier ones built
+		fields, err := d.decode(mustHex(t, tt.block))
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.fields, fields, tt.name)
+		assert.Equal(t, tt.size, d.size, tt.name)
+	}
+
+	// Test: A smaller table evicts the oldest entries first
+	fields, err := d.decode(mustHex(t, "3f 2b be"))
+	require.NoError(t, err)
+	assert.Equal(t, []headerField{{"custom-key", "custom-value"}}, fields)
+	assert.Equal(t, uint32(54), d.size)
+
+	// Test: Blocks the table cannot make sense of are refused
+	for _, bad := range []string{"80", "ff00", "3fe21f", "82 20", "4088 25a8", "0f"} {
+		_, err := newDecoder(4096, maxHeaderListSize).decode(mustHex(t, bad))
+		assert.ErrorIs(t, err, errCompression, bad)
+	}
+
+	// Test: A header list over the limit is refused but still read to the end
+	d = newDecoder(4096, 100)
+	_, err = d.decode(appendHeaderField(mustHex(t, "40 01 61 01 62"), headerField{"x", strings.Repeat("y", 100)}))
+	assert.ErrorIs(t, err, errHeaderListTooLarge)
+	assert.Equal(t, []headerField{{"a", "b"}}, d.dynamic)
+}
+
+func TestEncoder(t *testing.T) {
+	fields := []headerField{
+		{":status", "200"},
+		{":status", "201"},
+		{"content-type", "text/plain"},
+		{"set-cookie", "id=1"},
+		{"x-custom", "value"},
+		{"x-empty", ""},
+	}
+	var block []byte
+	for _, hf := range fields {
+		block = appendHeaderField(block, hf)
+	}
+
+	// Test: A field the static table holds whole is a single byte
+	assert.Equal(t, byte(0x88), block[0])
+
+	// Test: Encoded fields decode back, without touching the dynamic table
+	d := newDecoder(4096, maxHeaderListSize)
+	got, err := d.decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, got)
+	assert.Empty(t, d.dynamic)
+}
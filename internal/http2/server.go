@@ -0,0 +1,1087 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// prefaceTimeout bounds how long the client has to send its connection preface.
+	prefaceTimeout = 5 * time.Second
+	// idleTimeout is how long a connection with no streams open is kept before it is closed
+	// with a GOAWAY.
+	idleTimeout = 2 * time.Minute
+	// shutdownTimeout is how long streams get to finish after the server starts shutting down.
+	shutdownTimeout = 5 * time.Second
+
+	// DefaultMaxConcurrentStreams is how many streams a client may have open at once, unless
+	// WithMaxConcurrentStreams says otherwise.
+	DefaultMaxConcurrentStreams = 100
+	// DefaultMaxBodySize is how big a request body may grow, unless WithMaxBodySize says
+	// otherwise. Bodies are held in memory until the handler runs.
+	DefaultMaxBodySize = 10 << 20
+	// maxHeaderListSize bounds the decoded size of a request's header fields.
+	maxHeaderListSize = 1 << 20
+	headerTableSize   = 4096
+)
+
+// ErrStreamClosed is returned by writes to a stream the client has reset or whose connection
+// is gone.
+var ErrStreamClosed = errors.New("stream closed")
+
+// ErrStreamReset is the default cause a request's context is cancelled with when the client
+// resets its stream or drops the connection; see WithDisconnectCause.
+var ErrStreamReset = errors.New("stream reset by client")
+
+// Handler has the shape of server.Handler, which converts to it.
+type Handler func(w *response.Writer, req *request.Request)
+
+type Option func(*serverConn)
+
+// WithBaseContext makes ctx the parent of every request's context. When it ends, the
+// connection is shut down gracefully: the client is sent a GOAWAY, no new streams are taken
+// and the connection closes once the open ones are done.
+func WithBaseContext(ctx context.Context) Option {
+	return func(sc *serverConn) {
+		sc.baseCtx = ctx
+	}
+}
+
+// WithHandlerTimeout gives every handler a deadline of d on its request's context.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(sc *serverConn) {
+		sc.handlerTimeout = d
+	}
+}
+
+// WithDisconnectCause sets the cause request contexts are cancelled with when the client
+// resets a stream or the connection drops, so handlers see the same error on both protocols.
+func WithDisconnectCause(err error) Option {
+	return func(sc *serverConn) {
+		sc.disconnectCause = err
+	}
+}
+
+// WithMaxConcurrentStreams sets how many streams a client may have open at once. Streams past
+// the limit are refused, which tells the client it may retry them. A stream the client resets
+// keeps its place until its handler returns.
+func WithMaxConcurrentStreams(n uint32) Option {
+	return func(sc *serverConn) {
+		sc.maxConcurrentStreams = n
+	}
+}
+
+// WithMaxBodySize sets how big a request body may grow. Requests with bigger ones are answered
+// with 413 and their stream is reset.
+func WithMaxBodySize(n int64) Option {
+	return func(sc *serverConn) {
+		sc.maxBodySize = n
+	}
+}
+
+// WithUpgrade serves a connection that is switching to HTTP/2 in answer to req, an HTTP/1.1
+// request with "Upgrade: h2c" that passed IsUpgrade. The 101 response is written first, and the
+// response to req goes out on stream 1.
+func WithUpgrade(req *request.Request) Option {
+	return func(sc *serverConn) {
+		sc.upgrade = req
+	}
+}
+
+type streamState int
+
+const (
+	// stateOpen streams are still receiving their request body.
+	stateOpen streamState = iota
+	// stateHalfClosed streams have the whole request and are being answered.
+	stateHalfClosed
+	stateClosed
+)
+
+type serverConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	handler Handler
+
+	baseCtx              context.Context
+	handlerTimeout       time.Duration
+	disconnectCause      error
+	maxConcurrentStreams uint32
+	maxBodySize          int64
+	upgrade              *request.Request
+
+	// Used by the read loop only.
+	decoder      *decoder
+	recvWindow   int64
+	headerStream uint32
+	headerFlags  uint8
+	headerBlock  []byte
+	seq          int
+	// headerErr is a stream error found in the HEADERS frame, returned once its block is
+	// decoded.
+	headerErr error
+
+	// writeMu keeps frames whole and header blocks unbroken on the wire.
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	runningHandlers   uint32
+	lastStreamID      uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	goingAway         bool
+	goAwaySent        bool
+	closed            bool
+
+	handlers sync.WaitGroup
+}
+
+type stream struct {
+	sc *serverConn
+	id uint32
+
+	// Guarded by sc.mu.
+	state      streamState
+	sendWindow int64
+	// ended is set once a frame carrying END_STREAM has gone out.
+	ended bool
+
+	// Used by the read loop until the handler starts.
+	req           *request.Request
+	recvWindow    int64
+	contentLength int
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away, the connection fails or the
+// base context ends, then closes conn. Unless WithUpgrade is given, the client is expected to
+// start with ClientPreface, which the caller may have peeked at but must not have consumed.
+// Every request is passed to handler on its own goroutine, with a response.Writer that frames
+// the response as HTTP/2.
+func ServeConn(conn net.Conn, handler Handler, opts ...Option) {
+	sc := &serverConn{
+		conn:                 conn,
+		br:                   bufio.NewReader(conn),
+		bw:                   bufio.NewWriter(conn),
+		handler:              handler,
+		baseCtx:              context.Background(),
+		disconnectCause:      ErrStreamReset,
+		maxConcurrentStreams: DefaultMaxConcurrentStreams,
+		maxBodySize:          DefaultMaxBodySize,
+		decoder:              newDecoder(headerTableSize, maxHeaderListSize),
+		recvWindow:           defaultWindowSize,
+		streams:              make(map[uint32]*stream),
+		sendWindow:           defaultWindowSize,
+		peerInitialWindow:    defaultWindowSize,
+		peerMaxFrameSize:     defaultMaxFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	for _, opt := range opts {
+		opt(sc)
+	}
+	sc.serve()
+}
+
+func (sc *serverConn) serve() {
+	defer sc.close()
+
+	if sc.upgrade != nil {
+		settings, _ := upgradeSettings(sc.upgrade)
+		if err := sc.applySettings(settings); err != nil {
+			return
+		}
+		if _, err := io.WriteString(sc.bw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+			return
+		}
+	}
+	err := sc.writeFrame(frameSettings, 0, 0, appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.maxConcurrentStreams},
+		setting{settingMaxHeaderListSize, maxHeaderListSize},
+		setting{settingEnablePush, 0},
+	))
+	if err != nil {
+		return
+	}
+
+	sc.conn.SetReadDeadline(time.Now().Add(prefaceTimeout))
+	if !sc.readPreface() {
+		return
+	}
+	sc.conn.SetReadDeadline(time.Time{})
+
+	if sc.upgrade != nil {
+		sc.startUpgradeStream()
+	} else {
+		sc.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	}
+	stop := context.AfterFunc(sc.baseCtx, sc.shutdown)
+	defer stop()
+
+	for {
+		f, err := readFrame(sc.br, defaultMaxFrameSize)
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+		var se streamError
+		if errors.As(err, &se) {
+			sc.resetStream(se.streamID, se.code)
+			continue
+		}
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+	}
+}
+
+func (sc *serverConn) readPreface() bool {
+	buf := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, buf); err != nil {
+		return false
+	}
+	if string(buf) != ClientPreface {
+		sc.writeGoAway(errCodeProtocol, "connection preface is incorrect")
+		return false
+	}
+	return true
+}
+
+// fail ends the connection after the read loop stops. A protocol violation is reported in a
+// GOAWAY; a connection that went quiet with nothing open gets a polite one; a connection the
+// client dropped gets nothing.
+func (sc *serverConn) fail(err error) {
+	var ce connError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &ce):
+		sc.writeGoAway(ce.code, ce.reason)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		sc.writeGoAway(errCodeNo, "")
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed), errors.Is(err, io.ErrClosedPipe):
+	default:
+		log.Printf("Error reading HTTP/2 frame: %v", err)
+	}
+}
+
+// close tears the connection down and waits for every handler to return. Handlers still
+// running see their contexts cancelled and their writes fail.
+func (sc *serverConn) close() {
+	sc.conn.Close()
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.state = stateClosed
+		st.cancel(sc.disconnectCause)
+	}
+	sc.mu.Unlock()
+	sc.cond.Broadcast()
+	sc.handlers.Wait()
+}
+
+// shutdown starts a graceful close when the base context ends. Streams already open get
+// shutdownTimeout to finish; the connection then closes regardless.
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.goingAway = true
+	sc.mu.Unlock()
+	sc.writeGoAway(errCodeNo, "")
+	sc.mu.Lock()
+	sc.goAwaySent = true
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+	if idle {
+		sc.conn.Close()
+		return
+	}
+	time.AfterFunc(shutdownTimeout, func() { sc.conn.Close() })
+}
+
+func (sc *serverConn) processFrame(f *frame) error {
+	if sc.headerStream != 0 && (f.typ != frameContinuation || f.streamID != sc.headerStream) {
+		return connError{errCodeProtocol, "header block was interrupted"}
+	}
+
+	switch f.typ {
+	case frameData:
+		return sc.processData(f)
+	case frameHeaders:
+		return sc.processHeaders(f)
+	case frameContinuation:
+		return sc.processContinuation(f)
+	case framePriority:
+		if f.streamID == 0 {
+			return connError{errCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, errCodeFrameSize, "PRIORITY is not 5 bytes"}
+		}
+		return nil
+	case frameRSTStream:
+		return sc.processRSTStream(f)
+	case frameSettings:
+		return sc.processSettings(f)
+	case framePushPromise:
+		return connError{errCodeProtocol, "clients cannot push"}
+	case framePing:
+		if f.streamID != 0 {
+			return connError{errCodeProtocol, "PING on a stream"}
+		}
+		if len(f.payload) != 8 {
+			return connError{errCodeFrameSize, "PING is not 8 bytes"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, f.payload)
+	case frameGoAway:
+		if f.streamID != 0 {
+			return connError{errCodeProtocol, "GOAWAY on a stream"}
+		}
+		// The client opens no more streams; the ones it has are still answered.
+		return nil
+	case frameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+	// Unknown frame types are ignored (RFC 9113 section 4.1).
+	return nil
+}
+
+func (sc *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return connError{errCodeProtocol, "SETTINGS on a stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError{errCodeFrameSize, "SETTINGS acknowledgement has a payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingEnablePush:
+			if s.val > 1 {
+				return connError{errCodeProtocol, "SETTINGS_ENABLE_PUSH is not 0 or 1"}
+			}
+		case settingInitialWindowSize:
+			if s.val > maxWindowSize {
+				return connError{errCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE is too large"}
+			}
+			// The change applies to every open stream's window (RFC 9113 section 6.9.2).
+			delta := int64(s.val) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(s.val)
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError{errCodeFlowControl, "stream window is too large"}
+				}
+			}
+		case settingMaxFrameSize:
+			if s.val < defaultMaxFrameSize || s.val > maxFrameSizeLimit {
+				return connError{errCodeProtocol, "SETTINGS_MAX_FRAME_SIZE is out of range"}
+			}
+			sc.peerMaxFrameSize = s.val
+		}
+		// The encoder never uses a dynamic table, so SETTINGS_HEADER_TABLE_SIZE does not
+		// matter, and this server neither pushes nor opens streams of its own.
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return connError{errCodeFrameSize, "WINDOW_UPDATE is not 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if increment == 0 {
+			return connError{errCodeProtocol, "WINDOW_UPDATE of 0"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError{errCodeFlowControl, "connection window is too large"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastStreamID {
+		return connError{errCodeProtocol, "WINDOW_UPDATE on an idle stream"}
+	}
+	if increment == 0 {
+		return streamError{f.streamID, errCodeProtocol, "WINDOW_UPDATE of 0"}
+	}
+	st := sc.streams[f.streamID]
+	if st == nil {
+		// Updates can cross a stream being closed.
+		return nil
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError{f.streamID, errCodeFlowControl, "stream window is too large"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(f *frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(f.payload) != 4 {
+		return connError{errCodeFrameSize, "RST_STREAM is not 4 bytes"}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID > sc.lastStreamID {
+		return connError{errCodeProtocol, "RST_STREAM on an idle stream"}
+	}
+	if st := sc.streams[f.streamID]; st != nil {
+		sc.closeStreamLocked(st, sc.disconnectCause)
+	}
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "HEADERS on stream 0"}
+	}
+	block, err := f.unpad()
+	if err != nil {
+		return err
+	}
+	sc.headerErr = nil
+	if f.has(flagPriority) {
+		if len(block) < 5 {
+			return connError{errCodeFrameSize, "HEADERS is too short for its priority"}
+		}
+		if binary.BigEndian.Uint32(block)&(1<<31-1) == f.streamID {
+			sc.headerErr = streamError{f.streamID, errCodeProtocol, "stream depends on itself"}
+		}
+		block = block[5:]
+	}
+
+	sc.headerStream = f.streamID
+	sc.headerFlags = f.flags
+	sc.headerBlock = append(sc.headerBlock[:0], block...)
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	return sc.endHeaderBlock()
+}
+
+func (sc *serverConn) processContinuation(f *frame) error {
+	if sc.headerStream == 0 {
+		return connError{errCodeProtocol, "CONTINUATION without HEADERS"}
+	}
+	sc.headerBlock = append(sc.headerBlock, f.payload...)
+	if len(sc.headerBlock) > maxHeaderListSize {
+		return connError{errCodeProtocol, "header block is too large"}
+	}
+	if !f.has(flagEndHeaders) {
+		return nil
+	}
+	return sc.endHeaderBlock()
+}
+
+// endHeaderBlock handles a complete header block: a new request, or the trailers of one
+// whose body is still coming in.
+func (sc *serverConn) endHeaderBlock() error {
+	id, endStream := sc.headerStream, sc.headerFlags&flagEndStream != 0
+	sc.headerStream = 0
+	fields, err := sc.decoder.decode(sc.headerBlock)
+	if errors.Is(err, errCompression) {
+		return connError{errCodeCompression, err.Error()}
+	}
+
+	sc.mu.Lock()
+	if id%2 == 0 {
+		sc.mu.Unlock()
+		return connError{errCodeProtocol, "client opened an even-numbered stream"}
+	}
+	if headerErr := sc.headerErr; headerErr != nil {
+		// The block is decoded all the same, or the decoder's table would drift from the
+		// client's.
+		sc.headerErr = nil
+		sc.lastStreamID = max(sc.lastStreamID, id)
+		sc.mu.Unlock()
+		return headerErr
+	}
+	if id <= sc.lastStreamID {
+		st := sc.streams[id]
+		sc.mu.Unlock()
+		return sc.processTrailers(st, id, fields, err, endStream)
+	}
+	sc.lastStreamID = id
+	if sc.goingAway {
+		// Past the GOAWAY's last stream, so the client knows it was not processed.
+		sc.mu.Unlock()
+		return nil
+	}
+	if sc.activeStreamsLocked() >= sc.maxConcurrentStreams {
+		sc.mu.Unlock()
+		return streamError{id, errCodeRefusedStream, "too many streams"}
+	}
+	sc.mu.Unlock()
+
+	if err != nil {
+		return streamError{id, errCodeProtocol, err.Error()}
+	}
+	req, err := sc.newRequest(fields)
+	if err != nil {
+		return streamError{id, errCodeProtocol, err.Error()}
+	}
+	st := sc.openStream(id, req)
+	if endStream {
+		return sc.endRequest(st)
+	}
+	if int64(st.contentLength) > sc.maxBodySize {
+		return sc.refuseBody(st)
+	}
+	if req.Headers.HasToken("expect", "100-continue") {
+		return sc.writeHeaders(st, []headerField{{":status", "100"}}, false)
+	}
+	return nil
+}
+
+func (sc *serverConn) processTrailers(st *stream, id uint32, fields []headerField, err error, endStream bool) error {
+	if st == nil {
+		return connError{errCodeStreamClosed, "HEADERS on a closed stream"}
+	}
+	sc.mu.Lock()
+	state := st.state
+	sc.mu.Unlock()
+	if state != stateOpen {
+		return streamError{id, errCodeStreamClosed, "HEADERS after the end of the stream"}
+	}
+	if err != nil {
+		return streamError{id, errCodeProtocol, err.Error()}
+	}
+	if !endStream {
+		return streamError{id, errCodeProtocol, "trailers do not end the stream"}
+	}
+	for _, hf := range fields {
+		if strings.HasPrefix(hf.name, ":") {
+			return streamError{id, errCodeProtocol, "pseudo-header in trailers"}
+		}
+	}
+	return sc.endRequest(st)
+}
+
+func (sc *serverConn) processData(f *frame) error {
+	if f.streamID == 0 {
+		return connError{errCodeProtocol, "DATA on stream 0"}
+	}
+
+	// Padding counts against the windows too.
+	length := int64(len(f.payload))
+	if length > sc.recvWindow {
+		return connError{errCodeFlowControl, "DATA beyond the connection window"}
+	}
+	sc.recvWindow -= length
+	// The connection gets its window back straight away: what each stream may hold is bounded
+	// below, and data for streams that are gone is dropped.
+	if err := sc.refundConnWindow(length); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	idle := f.streamID > sc.lastStreamID
+	open := st != nil && st.state == stateOpen
+	sc.mu.Unlock()
+	if idle {
+		return connError{errCodeProtocol, "DATA on an idle stream"}
+	}
+	if !open {
+		return streamError{f.streamID, errCodeStreamClosed, "DATA after the end of the stream"}
+	}
+	if length > st.recvWindow {
+		return streamError{f.streamID, errCodeFlowControl, "DATA beyond the stream window"}
+	}
+	st.recvWindow -= length
+
+	data, err := f.unpad()
+	if err != nil {
+		return err
+	}
+	st.req.Body = append(st.req.Body, data...)
+	if st.contentLength >= 0 && len(st.req.Body) > st.contentLength {
+		return streamError{f.streamID, errCodeProtocol, "body is longer than its content-length"}
+	}
+	if int64(len(st.req.Body)) > sc.maxBodySize {
+		return sc.refuseBody(st)
+	}
+	if f.has(flagEndStream) {
+		return sc.endRequest(st)
+	}
+
+	// The body is held in memory until the handler runs rather than read by it as it arrives,
+	// so the stream's window is only topped up as far as maxBodySize and one byte more. A
+	// client that keeps sending past that is answered with 413, and one that sends past its
+	// window gets FLOW_CONTROL_ERROR.
+	increment := min(length, sc.maxBodySize+1-int64(len(st.req.Body))-st.recvWindow)
+	if increment <= 0 {
+		return nil
+	}
+	st.recvWindow += increment
+	return sc.writeWindowUpdate(st.id, increment)
+}
+
+func (sc *serverConn) refundConnWindow(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	sc.recvWindow += n
+	return sc.writeWindowUpdate(0, n)
+}
+
+// refuseBody answers a request whose body is over maxBodySize with 413 and resets its stream,
+// which tells the client to stop sending the rest (RFC 9113 section 8.1).
+func (sc *serverConn) refuseBody(st *stream) error {
+	if err := sc.writeHeaders(st, []headerField{{":status", "413"}, {"content-length", "0"}}, true); err != nil {
+		return err
+	}
+	return streamError{st.id, errCodeNo, "body is too large"}
+}
+
+// newRequest builds a request from a stream's header fields, refusing the ones RFC 9113
+// section 8.2 and 8.3 call malformed.
+func (sc *serverConn) newRequest(fields []headerField) (*request.Request, error) {
+	pseudo := map[string]string{}
+	h := headers.Headers{}
+	regular := false
+	for _, hf := range fields {
+		if name, ok := strings.CutPrefix(hf.name, ":"); ok {
+			if regular {
+				return nil, errors.New("pseudo-header after a regular field")
+			}
+			if name != "method" && name != "scheme" && name != "path" && name != "authority" {
+				return nil, fmt.Errorf("unknown pseudo-header %s", hf.name)
+			}
+			if _, ok := pseudo[name]; ok {
+				return nil, fmt.Errorf("pseudo-header %s is repeated", hf.name)
+			}
+			pseudo[name] = hf.value
+			continue
+		}
+		regular = true
+		if err := checkField(hf); err != nil {
+			return nil, err
+		}
+		switch hf.name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return nil, fmt.Errorf("connection-specific field %s", hf.name)
+		case "te":
+			if hf.value != "trailers" {
+				return nil, errors.New("te is not trailers")
+			}
+		}
+		if val, ok := h[hf.name]; ok {
+			// Cookies may be split into several fields, and are joined back with "; "
+			// (RFC 9113 section 8.2.3). Anything else joins the way the HTTP/1 parser does.
+			sep := ", "
+			if hf.name == "cookie" {
+				sep = "; "
+			}
+			hf.value = val + sep + hf.value
+		}
+		h[hf.name] = hf.value
+	}
+
+	method := pseudo["method"]
+	target := pseudo["path"]
+	if method == "CONNECT" {
+		target = pseudo["authority"]
+		if _, ok := pseudo["scheme"]; ok {
+			return nil, errors.New("CONNECT with a scheme")
+		}
+		if _, ok := pseudo["path"]; ok {
+			return nil, errors.New("CONNECT with a path")
+		}
+	} else if pseudo["scheme"] == "" {
+		return nil, errors.New("scheme is missing")
+	}
+	if err := request.CheckTarget(method, target); err != nil {
+		return nil, err
+	}
+	if authority, ok := pseudo["authority"]; ok {
+		if _, ok := h["host"]; !ok {
+			h["host"] = authority
+		}
+	}
+	if _, ok := h["host"]; !ok {
+		return nil, errors.New("authority is missing")
+	}
+
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "2"},
+		Headers:     h,
+		Body:        make([]byte, 0),
+		ParserState: "PARSING_DONE",
+	}, nil
+}
+
+// checkField refuses field names with uppercase letters, which HTTP/2 forbids, and anything
+// the HTTP/1 parser would not accept in a name or value either.
+func checkField(hf headerField) error {
+	if hf.name == "" {
+		return errors.New("field name is empty")
+	}
+	for i := 0; i < len(hf.name); i++ {
+		c := hf.name[i]
+		if c >= 'A' && c <= 'Z' || c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return fmt.Errorf("field name %q is incorrect", hf.name)
+		}
+	}
+	if strings.ContainsAny(hf.value, "\r\n\x00") {
+		return fmt.Errorf("field %s has an incorrect value", hf.name)
+	}
+	return nil
+}
+
+func (sc *serverConn) openStream(id uint32, req *request.Request) *stream {
+	sc.seq++
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	req.LocalAddr = sc.conn.LocalAddr().String()
+	req.ConnSeq = sc.seq
+	if tlsConn, ok := sc.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	st := &stream{
+		sc:            sc,
+		id:            id,
+		state:         stateOpen,
+		req:           req,
+		recvWindow:    defaultWindowSize,
+		contentLength: -1,
+	}
+	if contentLength, err := req.ContentLength(); err == nil {
+		st.contentLength = contentLength
+	}
+	st.ctx, st.cancel = sc.requestContext()
+
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	sc.mu.Unlock()
+	sc.conn.SetReadDeadline(time.Time{})
+	return st
+}
+
+// requestContext returns the context for the next request, which ends at the latest when the
+// base context does or the handler's deadline passes.
+func (sc *serverConn) requestContext() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(sc.baseCtx)
+	if sc.handlerTimeout <= 0 {
+		return ctx, cancel
+	}
+	ctx, cancelTimeout := context.WithTimeout(ctx, sc.handlerTimeout)
+	return ctx, func(cause error) {
+		cancel(cause)
+		cancelTimeout()
+	}
+}
+
+// startUpgradeStream answers the request that asked for the upgrade on stream 1, which the
+// client treats as already half-closed.
+func (sc *serverConn) startUpgradeStream() {
+	req := *sc.upgrade
+	req.Headers = headers.Headers{}
+	for k, v := range sc.upgrade.Headers {
+		switch k {
+		case "connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection", "transfer-encoding":
+			continue
+		}
+		req.Headers[k] = v
+	}
+	req.RequestLine.HttpVersion = "2"
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	sc.mu.Unlock()
+	sc.endRequest(sc.openStream(1, &req))
+}
+
+// activeStreamsLocked counts what a new stream has to fit beside under maxConcurrentStreams:
+// streams still receiving their request, and handlers that have not returned, whether or not
+// the client has reset their stream since. Counting the handlers is what stops a client that
+// opens and resets streams in a loop from starting handlers without end.
+func (sc *serverConn) activeStreamsLocked() uint32 {
+	n := sc.runningHandlers
+	for _, st := range sc.streams {
+		if st.state == stateOpen {
+			n++
+		}
+	}
+	return n
+}
+
+// endRequest runs the handler once a stream's request is complete.
+func (sc *serverConn) endRequest(st *stream) error {
+	if st.contentLength >= 0 && len(st.req.Body) != st.contentLength {
+		return streamError{st.id, errCodeProtocol, "body is shorter than its content-length"}
+	}
+	sc.mu.Lock()
+	st.state = stateHalfClosed
+	sc.runningHandlers++
+	sc.mu.Unlock()
+
+	req := st.req.WithContext(st.ctx)
+	st.req = nil
+	sc.handlers.Add(1)
+	go sc.runHandler(st, req)
+	return nil
+}
+
+func (sc *serverConn) runHandler(st *stream, req *request.Request) {
+	defer sc.handlers.Done()
+	defer func() {
+		sc.mu.Lock()
+		sc.runningHandlers--
+		sc.mu.Unlock()
+	}()
+	w := response.NewStreamWriter(st)
+	w.SetMethod(req.RequestLine.Method)
+	if req.RequestLine.Method == "CONNECT" {
+		writeMethodNotAllowed(w)
+	} else {
+		sc.handler(w, req)
+	}
+	st.cancel(nil)
+
+	err := w.Finish()
+	sc.mu.Lock()
+	ended, closed := st.ended, st.state == stateClosed
+	sc.mu.Unlock()
+	if closed {
+		// The client reset the stream, so nothing more is owed on it.
+		return
+	}
+	if err != nil || !w.KeepAlive() {
+		// The response could not be completed, which the client has to hear about rather
+		// than take what it got for the whole thing.
+		sc.resetStream(st.id, errCodeInternal)
+		return
+	}
+	if !ended {
+		if err := sc.writeData(st, nil, true); err != nil && !errors.Is(err, ErrStreamClosed) {
+			sc.resetStream(st.id, errCodeInternal)
+			return
+		}
+	}
+	sc.closeStream(st, nil)
+}
+
+func writeMethodNotAllowed(w *response.Writer) {
+	w.WriteRequestLine(response.StatusMethodNotAllowed)
+	body := []byte("CONNECT is not supported")
+	h := response.GetDefaultHeaders(len(body))
+	h["Allow"] = "GET, HEAD, POST, PUT, PATCH, DELETE"
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// WriteHeaders sends the response's status and header fields. Names are lowercased as HTTP/2
+// requires.
+func (st *stream) WriteHeaders(statusCode response.StatusCode, h headers.Headers, cookies []string) error {
+	fields := []headerField{{":status", strconv.Itoa(int(statusCode))}}
+	for k, v := range h {
+		fields = append(fields, headerField{strings.ToLower(k), v})
+	}
+	for _, cookie := range cookies {
+		fields = append(fields, headerField{"set-cookie", cookie})
+	}
+	return st.sc.writeHeaders(st, fields, false)
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := st.sc.writeData(st, p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteTrailers ends the stream with trailer fields.
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	fields := make([]headerField, 0, len(h))
+	for k, v := range h {
+		fields = append(fields, headerField{strings.ToLower(k), v})
+	}
+	return st.sc.writeHeaders(st, fields, true)
+}
+
+// writeData sends p on st as DATA frames no bigger than the peer accepts, waiting for window
+// when flow control calls for it. With endStream the last frame ends the stream; an empty p
+// then sends just that.
+func (sc *serverConn) writeData(st *stream, p []byte, endStream bool) error {
+	for {
+		sc.mu.Lock()
+		for len(p) > 0 && st.state != stateClosed && (st.sendWindow <= 0 || sc.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if st.state == stateClosed {
+			sc.mu.Unlock()
+			return ErrStreamClosed
+		}
+		n := min(int64(len(p)), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		st.sendWindow -= n
+		sc.sendWindow -= n
+		last := n == int64(len(p))
+		if last && endStream {
+			st.ended = true
+		}
+		sc.mu.Unlock()
+
+		var flags uint8
+		if last && endStream {
+			flags = flagEndStream
+		}
+		if err := sc.writeFrame(frameData, flags, st.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+		if last {
+			return nil
+		}
+	}
+}
+
+// writeHeaders sends a header block on st, split into HEADERS and CONTINUATION frames as
+// needed.
+func (sc *serverConn) writeHeaders(st *stream, fields []headerField, endStream bool) error {
+	var block []byte
+	for _, hf := range fields {
+		block = appendHeaderField(block, hf)
+	}
+
+	sc.mu.Lock()
+	closed := st.state == stateClosed
+	maxFrameSize := int(sc.peerMaxFrameSize)
+	if endStream {
+		st.ended = true
+	}
+	sc.mu.Unlock()
+	if closed {
+		return ErrStreamClosed
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	typ := frameHeaders
+	for {
+		n := min(len(block), maxFrameSize)
+		var flags uint8
+		if typ == frameHeaders && endStream {
+			flags |= flagEndStream
+		}
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		sc.bw.Write(appendFrame(nil, typ, flags, st.id, block[:n]))
+		block = block[n:]
+		typ = frameContinuation
+		if len(block) == 0 {
+			return sc.bw.Flush()
+		}
+	}
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	if _, err := sc.bw.Write(appendFrame(nil, typ, flags, streamID, payload)); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment int64) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+func (sc *serverConn) writeGoAway(code errCode, reason string) {
+	sc.mu.Lock()
+	lastStreamID := sc.lastStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.writeFrame(frameGoAway, 0, 0, append(payload, reason...))
+}
+
+// resetStream ends a stream with RST_STREAM. The stream's handler, if it has one running, sees
+// its context cancelled and its writes fail.
+func (sc *serverConn) resetStream(id uint32, code errCode) {
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if st := sc.streams[id]; st != nil {
+		sc.closeStreamLocked(st, sc.disconnectCause)
+	}
+}
+
+func (sc *serverConn) closeStream(st *stream, cause error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.closeStreamLocked(st, cause)
+}
+
+// closeStreamLocked forgets a stream. Once none are left the connection starts its idle
+// timer, or closes if the server is shutting down.
+func (sc *serverConn) closeStreamLocked(st *stream, cause error) {
+	if sc.streams[st.id] != st {
+		return
+	}
+	st.state = stateClosed
+	st.cancel(cause)
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+	if len(sc.streams) > 0 || sc.closed {
+		return
+	}
+	if sc.goAwaySent {
+		sc.conn.Close()
+		return
+	}
+	sc.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+}
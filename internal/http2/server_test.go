@@ -0,0 +1,599 @@
+package http2
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listen serves HTTP/2 with prior knowledge on a local port and returns its address.
+func listen(t *testing.T, handler Handler, opts ...Option) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ServeConn(conn, handler, opts...)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// h2Client speaks HTTP/2 with prior knowledge and nothing else.
+func h2Client() *http.Client {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body := fmt.Appendf(nil, "%s %s %s %d", req.RequestLine.Method, req.RequestLine.RequestTarget, req.Headers["host"], len(req.Body))
+	w.WriteRequestLine(response.StatusOK)
+	h := response.GetDefaultHeaders(len(body))
+	h["X-Proto"] = req.RequestLine.HttpVersion
+	h["X-Cookie"] = req.Headers["cookie"]
+	h["X-Seq"] = strconv.Itoa(req.ConnSeq)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestServeConnClient(t *testing.T) {
+	addr := listen(t, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/big":
+			w.WriteRequestLine(response.StatusOK)
+			w.AddSetCookie("a=1")
+			w.AddSetCookie("b=2")
+			w.WriteHeaders(headers.Headers{"Content-Type": "application/octet-stream", "Content-Length": "1000000"})
+			for i := 0; i < 100; i++ {
+				w.WriteBody([]byte(strings.Repeat(string(rune('a'+i%26)), 10000)))
+			}
+		case "/trailers":
+			w.WriteRequestLine(response.StatusOK)
+			w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Trailer": "X-Sum"})
+			w.WriteChunkedBody([]byte("part one,"))
+			w.WriteChunkedBody([]byte("part two"))
+			w.WriteChunkedBodyDone()
+			w.WriteTrailers(headers.Headers{"X-Sum": "17"})
+		default:
+			echoHandler(w, req)
+		}
+	})
+	client := h2Client()
+
+	// Test: Requests are answered over HTTP/2 with the same handler API
+	req, err := http.NewRequest("GET", "http://"+addr+"/path?q=1", nil)
+	require.NoError(t, err)
+	req.Header.Add("Cookie", "a=1")
+	req.Header.Add("Cookie", "b=2")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "GET /path?q=1 "+addr+" 0", string(body))
+	assert.Equal(t, "2", resp.Header.Get("X-Proto"))
+	assert.Equal(t, "a=1; b=2", resp.Header.Get("X-Cookie"))
+	assert.Empty(t, resp.Header.Get("Connection"))
+
+	// Test: Bodies bigger than the flow-control windows get through both ways
+	upload := strings.Repeat("x", 300000)
+	resp, err = client.Post("http://"+addr+"/upload", "text/plain", strings.NewReader(upload))
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "POST /upload "+addr+" 300000", string(body))
+
+	resp, err = client.Get("http://" + addr + "/big")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Len(t, body, 1000000)
+	assert.Equal(t, strings.Repeat("b", 10000), string(body[10000:20000]))
+	assert.Equal(t, []string{"a=1", "b=2"}, resp.Header.Values("Set-Cookie"))
+
+	// Test: Trailers follow the body
+	resp, err = client.Get("http://" + addr + "/trailers")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "part one,part two", string(body))
+	assert.Equal(t, "17", resp.Trailer.Get("X-Sum"))
+
+	// Test: HEAD gets the headers without the body
+	resp, err = client.Head("http://" + addr + "/big")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(1000000), resp.ContentLength)
+
+	// Test: Concurrent requests share the connection
+	var wg sync.WaitGroup
+	seqs := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://" + addr + "/concurrent")
+			if !assert.NoError(t, err) {
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			seqs <- resp.Header.Get("X-Seq")
+		}()
+	}
+	wg.Wait()
+	close(seqs)
+	seen := map[string]bool{}
+	for seq := range seqs {
+		seen[seq] = true
+	}
+	assert.Len(t, seen, 20)
+	assert.True(t, seen["25"])
+}
+
+// rawClient speaks HTTP/2 frame by frame, so tests can send what a well-behaved client would
+// not.
+type rawClient struct {
+	t      *testing.T
+	conn   net.Conn
+	frames chan *frame
+	writes chan []byte
+}
+
+func newRawClient(t *testing.T, handler Handler, opts ...Option) *rawClient {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go ServeConn(serverConn, handler, opts...)
+	c := &rawClient{t: t, conn: clientConn}
+	t.Cleanup(func() { clientConn.Close() })
+	c.start(clientConn)
+	c.send([]byte(ClientPreface))
+	c.write(frameSettings, 0, 0, nil)
+	settings := c.expect(frameSettings)
+	assert.False(t, settings.has(flagAck))
+	c.write(frameSettings, flagAck, 0, nil)
+	assert.True(t, c.expect(frameSettings).has(flagAck))
+	return c
+}
+
+func (c *rawClient) start(r io.Reader) {
+	c.frames = make(chan *frame, 100)
+	c.writes = make(chan []byte, 100)
+	go func() {
+		for buf := range c.writes {
+			if _, err := c.conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	c.t.Cleanup(func() { close(c.writes) })
+	go func() {
+		defer close(c.frames)
+		for {
+			f, err := readFrame(r, maxFrameSizeLimit)
+			if err != nil {
+				return
+			}
+			c.frames <- f
+		}
+	}()
+}
+
+// send queues buf for the writer goroutine, since writes on a pipe block until the server
+// reads them.
+func (c *rawClient) send(buf []byte) {
+	c.writes <- buf
+}
+
+func (c *rawClient) write(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	c.send(appendFrame(nil, typ, flags, streamID, payload))
+}
+
+// next returns the next frame, skipping the window updates the server sends as it reads.
+func (c *rawClient) next() *frame {
+	c.t.Helper()
+	for {
+		select {
+		case f, ok := <-c.frames:
+			if !ok {
+				return nil
+			}
+			if f.typ == frameWindowUpdate {
+				continue
+			}
+			return f
+		case <-time.After(2 * time.Second):
+			c.t.Fatal("no frame arrived")
+			return nil
+		}
+	}
+}
+
+func (c *rawClient) expect(typ frameType) *frame {
+	c.t.Helper()
+	f := c.next()
+	require.NotNil(c.t, f, "connection closed")
+	require.Equal(c.t, typ, f.typ)
+	return f
+}
+
+func (c *rawClient) expectGoAway(code errCode) {
+	c.t.Helper()
+	f := c.expect(frameGoAway)
+	assert.Equal(c.t, code, errCode(binary.BigEndian.Uint32(f.payload[4:])))
+	assert.Nil(c.t, c.next(), "connection stayed open")
+}
+
+func (c *rawClient) expectReset(streamID uint32, code errCode) {
+	c.t.Helper()
+	f := c.expect(frameRSTStream)
+	assert.Equal(c.t, streamID, f.streamID)
+	assert.Equal(c.t, code, errCode(binary.BigEndian.Uint32(f.payload)))
+}
+
+func (c *rawClient) headerBlock(fields ...headerField) []byte {
+	var block []byte
+	for _, hf := range fields {
+		block = appendHeaderField(block, hf)
+	}
+	return block
+}
+
+func getFields(path string) []headerField {
+	return []headerField{{":method", "GET"}, {":scheme", "http"}, {":path", path}, {":authority", "example.test"}}
+}
+
+func postFields(path string) []headerField {
+	return []headerField{{":method", "POST"}, {":scheme", "http"}, {":path", path}, {":authority", "example.test"}}
+}
+
+// readResponse collects a response's header fields and body off streamID.
+func (c *rawClient) readResponse(streamID uint32) ([]headerField, string) {
+	c.t.Helper()
+	f := c.next()
+	for f != nil && f.typ == frameSettings && f.has(flagAck) {
+		// The server acknowledges the client's settings whenever it gets to them.
+		f = c.next()
+	}
+	require.NotNil(c.t, f, "connection closed")
+	require.Equal(c.t, frameHeaders, f.typ)
+	require.Equal(c.t, streamID, f.streamID)
+	fields, err := newDecoder(4096, maxHeaderListSize).decode(f.payload)
+	require.NoError(c.t, err)
+	var body strings.Builder
+	for !f.has(flagEndStream) {
+		f = c.next()
+		require.NotNil(c.t, f, "connection closed")
+		if f.typ == frameSettings && f.has(flagAck) {
+			continue
+		}
+		require.Equal(c.t, frameData, f.typ)
+		body.Write(f.payload)
+	}
+	return fields, body.String()
+}
+
+func TestServeConnFrames(t *testing.T) {
+	// Test: PING is answered with its payload
+	c := newRawClient(t, echoHandler)
+	c.write(framePing, 0, 0, []byte("12345678"))
+	f := c.expect(framePing)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+
+	// Test: A header block split over CONTINUATION frames makes one request
+	block := c.headerBlock(getFields("/split")...)
+	c.write(frameHeaders, flagEndStream, 1, block[:3])
+	c.write(frameContinuation, 0, 1, block[3:6])
+	c.write(frameContinuation, flagEndHeaders, 1, block[6:])
+	fields, body := c.readResponse(1)
+	assert.Equal(t, headerField{":status", "200"}, fields[0])
+	assert.Contains(t, fields, headerField{"content-type", "text/plain"})
+	assert.Equal(t, "GET /split example.test 0", body)
+
+	// Test: A request body arrives before the handler runs
+	c.write(frameHeaders, flagEndHeaders, 3, c.headerBlock(append(getFields("/post"), headerField{"content-length", "5"})...))
+	c.write(frameData, flagPadded, 3, []byte("\x02abc\x00\x00"))
+	c.write(frameData, flagEndStream, 3, []byte("de"))
+	_, body = c.readResponse(3)
+	assert.Equal(t, "GET /post example.test 5", body)
+
+	// Test: A malformed request resets its stream and leaves the connection up
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 5, c.headerBlock(append(getFields("/"), headerField{"X-Upper", "1"})...))
+	c.expectReset(5, errCodeProtocol)
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 7, c.headerBlock(append(getFields("/"), headerField{"connection", "close"})...))
+	c.expectReset(7, errCodeProtocol)
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 9, c.headerBlock(getFields("relative")...))
+	c.expectReset(9, errCodeProtocol)
+	c.write(frameHeaders, flagEndHeaders, 11, c.headerBlock(append(getFields("/"), headerField{"content-length", "5"})...))
+	c.write(frameData, flagEndStream, 11, []byte("abc"))
+	c.expectReset(11, errCodeProtocol)
+	c.write(framePing, 0, 0, []byte("still up"))
+	assert.Equal(t, "still up", string(c.expect(framePing).payload))
+
+	// Test: A stream that depends on itself is reset only after its header block is decoded,
+	// so what the block added to the dynamic table is there for the next request
+	block = c.headerBlock(getFields("/self")...)
+	block = appendString(append(block, 0x40), "cookie")
+	block = appendString(block, "kept")
+	priority := binary.BigEndian.AppendUint32(nil, 13)
+	c.write(frameHeaders, flagPriority|flagEndStream, 13, append(append(priority, 16), block[:4]...))
+	c.write(frameContinuation, flagEndHeaders, 13, block[4:])
+	c.expectReset(13, errCodeProtocol)
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 15, append(c.headerBlock(getFields("/next")...), 0x80|62))
+	fields, body = c.readResponse(15)
+	assert.Contains(t, fields, headerField{"x-cookie", "kept"})
+	assert.Equal(t, "GET /next example.test 0", body)
+}
+
+func TestServeConnErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(c *rawClient)
+		code errCode
+	}{
+		{"window update of 0", func(c *rawClient) { c.write(frameWindowUpdate, 0, 0, make([]byte, 4)) }, errCodeProtocol},
+		{"even stream", func(c *rawClient) {
+			c.write(frameHeaders, flagEndHeaders|flagEndStream, 2, c.headerBlock(getFields("/")...))
+		}, errCodeProtocol},
+		{"data on an idle stream", func(c *rawClient) { c.write(frameData, 0, 7, []byte("x")) }, errCodeProtocol},
+		{"frame over the size limit", func(c *rawClient) { c.write(frameData, 0, 1, make([]byte, defaultMaxFrameSize+1)) }, errCodeFrameSize},
+		{"header block that does not decode", func(c *rawClient) { c.write(frameHeaders, flagEndHeaders, 1, []byte{0xff, 0x00}) }, errCodeCompression},
+		{"interrupted header block", func(c *rawClient) {
+			c.write(frameHeaders, 0, 1, c.headerBlock(getFields("/")...))
+			c.write(framePing, 0, 0, make([]byte, 8))
+		}, errCodeProtocol},
+		{"push from the client", func(c *rawClient) { c.write(framePushPromise, flagEndHeaders, 1, make([]byte, 4)) }, errCodeProtocol},
+		{"window past the maximum", func(c *rawClient) {
+			c.write(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+		}, errCodeFlowControl},
+		{"bad max frame size", func(c *rawClient) {
+			c.write(frameSettings, 0, 0, appendSettings(nil, setting{settingMaxFrameSize, 100}))
+		}, errCodeProtocol},
+	}
+	for _, tt := range tests {
+		// Test: Protocol violations end the connection with a GOAWAY naming them
+		c := newRawClient(t, echoHandler)
+		tt.send(c)
+		f := c.expect(frameGoAway)
+		assert.Equal(t, tt.code, errCode(binary.BigEndian.Uint32(f.payload[4:])), tt.name)
+		assert.Nil(t, c.next(), tt.name)
+	}
+
+	// Test: A client that does not open with the preface is turned away
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go ServeConn(serverConn, echoHandler)
+	c := &rawClient{t: t, conn: clientConn}
+	c.start(clientConn)
+	c.send([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	c.expect(frameSettings)
+	c.expectGoAway(errCodeProtocol)
+}
+
+func TestServeConnStreams(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan context.Context, 10)
+	blocking := func(w *response.Writer, req *request.Request) {
+		started <- req.Context()
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return
+		}
+		echoHandler(w, req)
+	}
+	gone := errors.New("client went away")
+
+	// Test: Streams past the limit are refused
+	c := newRawClient(t, blocking, WithMaxConcurrentStreams(1), WithDisconnectCause(gone))
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, c.headerBlock(getFields("/1")...))
+	ctx := <-started
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 3, c.headerBlock(getFields("/3")...))
+	c.expectReset(3, errCodeRefusedStream)
+
+	// Test: Resetting a stream cancels its handler's context
+	c.write(frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(errCodeCancel)))
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled")
+	}
+	assert.ErrorIs(t, context.Cause(ctx), gone)
+
+	// Test: The stream's slot is free again once its handler has returned
+	id := c.openWhenFree(5, "/5", started)
+	close(release)
+	_, body := c.readResponse(id)
+	assert.Equal(t, "GET /5 example.test 0", body)
+
+	// Test: Until then a reset stream still counts, so resetting streams in a loop cannot
+	// start handlers without end
+	stuck := make(chan struct{})
+	c = newRawClient(t, func(w *response.Writer, req *request.Request) {
+		started <- req.Context()
+		<-stuck
+	}, WithMaxConcurrentStreams(1))
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, c.headerBlock(getFields("/1")...))
+	<-started
+	c.write(frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(errCodeCancel)))
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 3, c.headerBlock(getFields("/3")...))
+	c.expectReset(3, errCodeRefusedStream)
+	close(stuck)
+	c.openWhenFree(5, "/5", started)
+}
+
+// openWhenFree opens a stream at id, and at the odd ids after it for as long as the server
+// refuses them, until a handler reports on started that it took one. It returns that id.
+func (c *rawClient) openWhenFree(id uint32, path string, started <-chan context.Context) uint32 {
+	c.t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		c.write(frameHeaders, flagEndHeaders|flagEndStream, id, c.headerBlock(getFields(path)...))
+		select {
+		case <-started:
+			return id
+		case f := <-c.frames:
+			require.NotNil(c.t, f, "connection closed")
+			require.Equal(c.t, frameRSTStream, f.typ)
+			require.Equal(c.t, errCodeRefusedStream, errCode(binary.BigEndian.Uint32(f.payload)))
+			id += 2
+		case <-deadline:
+			c.t.Fatal("the server kept refusing streams")
+		}
+	}
+}
+
+func TestServeConnFlowControl(t *testing.T) {
+	// Test: Response bodies wait for the client's window
+	c := newRawClient(t, func(w *response.Writer, req *request.Request) {
+		w.WriteRequestLine(response.StatusOK)
+		w.WriteHeaders(headers.Headers{"Content-Length": "25"})
+		w.WriteBody([]byte(strings.Repeat("x", 25)))
+	})
+	c.write(frameSettings, 0, 0, appendSettings(nil, setting{settingInitialWindowSize, 10}))
+	assert.True(t, c.expect(frameSettings).has(flagAck))
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, c.headerBlock(getFields("/")...))
+	c.expect(frameHeaders)
+	assert.Len(t, c.expect(frameData).payload, 10)
+	select {
+	case f := <-c.frames:
+		t.Fatalf("frame %v sent beyond the window", f.typ)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.write(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 100))
+	f := c.expect(frameData)
+	assert.Len(t, f.payload, 15)
+	if !f.has(flagEndStream) {
+		assert.True(t, c.expect(frameData).has(flagEndStream))
+	}
+
+	// Test: A client that sends past the stream window the server granted is reset
+	c = newRawClient(t, echoHandler, WithMaxBodySize(70000))
+	c.write(frameHeaders, flagEndHeaders, 3, c.headerBlock(postFields("/")...))
+	chunk := make([]byte, defaultMaxFrameSize)
+	for range 5 {
+		c.write(frameData, 0, 3, chunk)
+	}
+	c.expectReset(3, errCodeFlowControl)
+}
+
+func TestServeConnBodySize(t *testing.T) {
+	// Test: A body that grows past the limit is answered with 413 and its stream reset
+	c := newRawClient(t, echoHandler, WithMaxBodySize(10))
+	c.write(frameHeaders, flagEndHeaders, 1, c.headerBlock(postFields("/")...))
+	c.write(frameData, 0, 1, []byte("0123456789"))
+	c.write(frameData, 0, 1, []byte("x"))
+	fields, body := c.readResponse(1)
+	assert.Contains(t, fields, headerField{":status", "413"})
+	assert.Empty(t, body)
+	c.expectReset(1, errCodeNo)
+
+	// Test: So is one whose content-length is past the limit, before any of it arrives
+	c.write(frameHeaders, flagEndHeaders, 3, c.headerBlock(append(postFields("/"), headerField{"content-length", "11"})...))
+	fields, _ = c.readResponse(3)
+	assert.Contains(t, fields, headerField{":status", "413"})
+	c.expectReset(3, errCodeNo)
+
+	// Test: A body up to the limit still reaches the handler
+	c.write(frameHeaders, flagEndHeaders, 5, c.headerBlock(postFields("/")...))
+	c.write(frameData, flagEndStream, 5, []byte("0123456789"))
+	fields, body = c.readResponse(5)
+	assert.Contains(t, fields, headerField{":status", "200"})
+	assert.Equal(t, "POST / example.test 10", body)
+}
+
+func TestServeConnShutdown(t *testing.T) {
+	// Test: Ending the base context sends a GOAWAY and closes the connection
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newRawClient(t, echoHandler, WithBaseContext(ctx))
+	c.write(frameHeaders, flagEndHeaders|flagEndStream, 1, c.headerBlock(getFields("/")...))
+	c.readResponse(1)
+	cancel()
+	f := c.expect(frameGoAway)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.payload))
+	assert.Equal(t, errCodeNo, errCode(binary.BigEndian.Uint32(f.payload[4:])))
+	assert.Nil(t, c.next())
+}
+
+func upgradeRequest(settings string) *request.Request {
+	h := headers.Headers{
+		"host":           "example.test",
+		"connection":     "Upgrade, HTTP2-Settings",
+		"upgrade":        "h2c",
+		"http2-settings": settings,
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/upgraded", HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        []byte{},
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{settingInitialWindowSize, 1 << 20}))
+
+	// Test: Only well-formed h2c upgrades are taken
+	assert.True(t, IsUpgrade(upgradeRequest(settings)))
+	assert.True(t, IsUpgrade(upgradeRequest("")))
+	assert.False(t, IsUpgrade(upgradeRequest("not base64!")))
+	assert.False(t, IsUpgrade(upgradeRequest("AAEAAA")))
+	req := upgradeRequest(settings)
+	req.Headers["connection"] = "Upgrade"
+	assert.False(t, IsUpgrade(req))
+	req = upgradeRequest(settings)
+	req.Headers["upgrade"] = "websocket"
+	assert.False(t, IsUpgrade(req))
+	req = upgradeRequest(settings)
+	req.RequestLine.HttpVersion = "1.0"
+	assert.False(t, IsUpgrade(req))
+
+	// Test: The connection switches and the request is answered on stream 1
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go ServeConn(serverConn, echoHandler, WithUpgrade(upgradeRequest(settings)))
+	r := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "h2c", resp.Header.Get("Upgrade"))
+
+	c := &rawClient{t: t, conn: clientConn}
+	c.start(r)
+	c.expect(frameSettings)
+	c.send([]byte(ClientPreface))
+	c.write(frameSettings, 0, 0, nil)
+	fields, body := c.readResponse(1)
+	assert.Equal(t, headerField{":status", "200"}, fields[0])
+	assert.Contains(t, fields, headerField{"x-proto", "2"})
+	assert.Equal(t, "GET /upgraded example.test 0", body)
+}
@@ -0,0 +1,34 @@
+package http2
+
+import (
+	"encoding/base64"
+	"httpfromtcp/internal/request"
+	"strings"
+)
+
+// IsUpgrade reports whether req asks to switch its connection to HTTP/2 with "Upgrade: h2c"
+// (RFC 7540 section 3.2) in a way the server can go along with: an HTTP/1.1 request with a
+// well-formed HTTP2-Settings header whose body has been read in full. A client that is still
+// waiting on "100 Continue" is answered over HTTP/1.1 instead, as is any request this
+// returns false for.
+func IsUpgrade(req *request.Request) bool {
+	if req.RequestLine.HttpVersion != "1.1" || req.ExpectsContinue() {
+		return false
+	}
+	if !req.Headers.HasToken("upgrade", "h2c") || !req.Headers.HasToken("connection", "upgrade") || !req.Headers.HasToken("connection", "http2-settings") {
+		return false
+	}
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+// upgradeSettings decodes the client's SETTINGS from the HTTP2-Settings header, which carries
+// the payload of a SETTINGS frame in unpadded base64url.
+func upgradeSettings(req *request.Request) ([]setting, error) {
+	val, _ := req.Headers.Get("HTTP2-Settings")
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(val), "="))
+	if err != nil {
+		return nil, err
+	}
+	return parseSettings(payload)
+}
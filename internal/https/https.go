@@ -0,0 +1,171 @@
+package https
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxAge is how long HSTS tells browsers to remember that a host is https only, unless
+// WithMaxAge says otherwise. Two years is what the preload list asks for.
+const DefaultMaxAge = 2 * 365 * 24 * time.Hour
+
+// Redirect returns a Handler for a plain-http listener that sends every request to the same
+// path and query over https on port. GET and HEAD are answered with 301, other methods with
+// 308 so the client repeats them with the same method and body. The host comes from the Host
+// header; requests without a usable one are answered with 400, since there is nowhere safe to
+// send them.
+func Redirect(port int) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		location, err := redirectURL(req, port)
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		statusCode := response.StatusPermanentRedirect
+		if req.RequestLine.Method == "GET" || req.RequestLine.Method == "HEAD" {
+			statusCode = response.StatusMovedPermanently
+		}
+		w.WriteRequestLine(statusCode)
+		body := []byte("Moved to " + location)
+		h := response.GetDefaultHeaders(len(body))
+		h["Location"] = location
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+	}
+}
+
+func redirectURL(req *request.Request, port int) (string, error) {
+	hostHeader, _ := req.Headers.Get("Host")
+	host, err := hostname(hostHeader)
+	if err != nil {
+		return "", err
+	}
+	if port != 443 {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+	}
+
+	target, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		return "", fmt.Errorf("request target %q is incorrect", req.RequestLine.RequestTarget)
+	}
+	location := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     target.Path,
+		RawPath:  target.RawPath,
+		RawQuery: target.RawQuery,
+	}
+	if location.Path == "" {
+		location.Path = "/"
+	}
+	return location.String(), nil
+}
+
+// hostname returns the host part of a Host header, with brackets kept around an IPv6 address.
+// Anything beyond a plain name or address is refused, so the header can't steer the redirect
+// to a URL of its choosing.
+func hostname(hostHeader string) (string, error) {
+	host := hostHeader
+	if h, _, err := net.SplitHostPort(hostHeader); err == nil {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+	if host == "" {
+		return "", fmt.Errorf("host %q is incorrect", hostHeader)
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		if net.ParseIP(host[1:len(host)-1]) == nil {
+			return "", fmt.Errorf("host %q is incorrect", hostHeader)
+		}
+		return host, nil
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return "", fmt.Errorf("host %q is incorrect", hostHeader)
+		}
+	}
+	return strings.ToLower(host), nil
+}
+
+func writeBadRequest(w *response.Writer, err error) {
+	w.WriteRequestLine(response.StatusBadRequest)
+	body := fmt.Appendf(nil, "Cannot redirect to https: %v", err)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+type hsts struct {
+	maxAge            time.Duration
+	includeSubDomains bool
+	preload           bool
+}
+
+type Option func(*hsts)
+
+// WithMaxAge sets how long browsers keep to https for the host. A max-age of 0 tells them to
+// forget it, which is how HSTS is turned off again.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(h *hsts) {
+		h.maxAge = maxAge
+	}
+}
+
+// WithIncludeSubDomains extends the policy to every subdomain of the host.
+func WithIncludeSubDomains() Option {
+	return func(h *hsts) {
+		h.includeSubDomains = true
+	}
+}
+
+// WithPreload asks to be put on the browsers' built-in HSTS lists. The lists only take hosts
+// that also send includeSubDomains and a max-age of at least a year.
+func WithPreload() Option {
+	return func(h *hsts) {
+		h.preload = true
+	}
+}
+
+// HSTS wraps next so responses sent over TLS carry a Strict-Transport-Security header (RFC
+// 6797), telling browsers to use https for the host from now on. Responses over plain http are
+// left alone since browsers ignore the header there, and a header the handler set itself is
+// kept.
+func HSTS(next server.Handler, opts ...Option) server.Handler {
+	h := &hsts{maxAge: DefaultMaxAge}
+	for _, opt := range opts {
+		opt(h)
+	}
+	value := h.String()
+
+	return func(w *response.Writer, req *request.Request) {
+		if req.TLS != nil {
+			w.OnWriteHeaders(func(statusCode response.StatusCode, hdrs headers.Headers) {
+				if _, ok := hdrs.Get("Strict-Transport-Security"); !ok {
+					hdrs["Strict-Transport-Security"] = value
+				}
+			})
+		}
+		next(w, req)
+	}
+}
+
+func (h *hsts) String() string {
+	value := "max-age=" + strconv.FormatInt(int64(h.maxAge/time.Second), 10)
+	if h.includeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if h.preload {
+		value += "; preload"
+	}
+	return value
+}
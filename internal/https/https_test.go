@@ -0,0 +1,113 @@
+package https
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// run sends one request through handler and parses what it wrote back.
+func run(t *testing.T, handler server.Handler, req *request.Request) *http.Response {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetMethod(req.RequestLine.Method)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), &http.Request{Method: req.RequestLine.Method})
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp
+}
+
+func newRequest(method, target, host string) *request.Request {
+	h := headers.Headers{}
+	if host != "" {
+		h["host"] = host
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+	}
+}
+
+func ok(w *response.Writer, req *request.Request) {
+	w.WriteRequestLine(response.StatusOK)
+	body := []byte("ok")
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *request.Request
+		port     int
+		status   int
+		location string
+	}{
+		{"path and query are kept", newRequest("GET", "/a%2Fb/c?x=1&y=2", "Example.com"), 443, 301, "https://example.com/a%2Fb/c?x=1&y=2"},
+		{"the http port is dropped", newRequest("HEAD", "/", "example.com:80"), 443, 301, "https://example.com/"},
+		{"a non-standard https port is added", newRequest("GET", "/x", "example.com:8080"), 8443, 301, "https://example.com:8443/x"},
+		{"IPv6 hosts stay bracketed", newRequest("GET", "/", "[::1]:80"), 8443, 301, "https://[::1]:8443/"},
+		{"absolute-form targets keep only path and query", newRequest("GET", "http://example.com/p?q", "example.com"), 443, 301, "https://example.com/p?q"},
+		{"other methods keep their method", newRequest("POST", "/form", "example.com"), 443, 308, "https://example.com/form"},
+	}
+	for _, tt := range tests {
+		// Test: Requests are sent to the same resource over https
+		resp := run(t, Redirect(tt.port), tt.req)
+		assert.Equal(t, tt.status, resp.StatusCode, tt.name)
+		assert.Equal(t, tt.location, resp.Header.Get("Location"), tt.name)
+	}
+
+	// Test: Hosts that cannot be redirected to safely are refused
+	for _, host := range []string{"", "evil.com/x", "user@example.com", "example.com\\@evil", "[not-an-ip]"} {
+		resp := run(t, Redirect(443), newRequest("GET", "/", host))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, host)
+		assert.Empty(t, resp.Header.Get("Location"), host)
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	secure := func(req *request.Request) *request.Request {
+		req.TLS = &tls.ConnectionState{HandshakeComplete: true}
+		return req
+	}
+
+	// Test: Responses over TLS get the header with a two-year max-age by default
+	resp := run(t, HSTS(ok), secure(newRequest("GET", "/", "example.com")))
+	assert.Equal(t, "max-age=63072000", resp.Header.Get("Strict-Transport-Security"))
+
+	// Test: Every directive can be configured
+	resp = run(t, HSTS(ok, WithMaxAge(365*24*time.Hour), WithIncludeSubDomains(), WithPreload()), secure(newRequest("GET", "/", "example.com")))
+	assert.Equal(t, "max-age=31536000; includeSubDomains; preload", resp.Header.Get("Strict-Transport-Security"))
+	resp = run(t, HSTS(ok, WithMaxAge(0)), secure(newRequest("GET", "/", "example.com")))
+	assert.Equal(t, "max-age=0", resp.Header.Get("Strict-Transport-Security"))
+
+	// Test: Responses over plain http are left alone
+	resp = run(t, HSTS(ok), newRequest("GET", "/", "example.com"))
+	assert.Empty(t, resp.Header.Get("Strict-Transport-Security"))
+
+	// Test: A header the handler set itself wins
+	own := func(w *response.Writer, req *request.Request) {
+		w.WriteRequestLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		h["Strict-Transport-Security"] = "max-age=60"
+		w.WriteHeaders(h)
+	}
+	resp = run(t, HSTS(own), secure(newRequest("GET", "/", "example.com")))
+	assert.Equal(t, []string{"max-age=60"}, resp.Header.Values("Strict-Transport-Security"))
+}
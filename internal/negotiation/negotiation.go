@@ -0,0 +1,218 @@
+package negotiation
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+)
+
+// Preference is one element of a weighted list such as
+// "text/html;level=1;q=0.8". Params holds the parameters other than q.
+type Preference struct {
+	Value  string
+	Params map[string]string
+	Q      float64
+}
+
+// ParseWeighted parses the comma separated lists used by Accept, Accept-Language and
+// Accept-Encoding. Values are lowercased, and elements without a q parameter get a weight of 1.
+// Empty elements are skipped as RFC 9110 section 5.6.1 asks.
+func ParseWeighted(val string) ([]Preference, error) {
+	prefs := make([]Preference, 0)
+	for _, element := range strings.Split(val, ",") {
+		element = strings.TrimSpace(element)
+		if element == "" {
+			continue
+		}
+
+		parts := strings.Split(element, ";")
+		pref := Preference{
+			Value:  strings.ToLower(strings.TrimSpace(parts[0])),
+			Params: make(map[string]string),
+			Q:      1,
+		}
+		if pref.Value == "" {
+			return nil, fmt.Errorf("weighted list element %q is incorrect", element)
+		}
+
+		for _, param := range parts[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !found || name == "" {
+				return nil, fmt.Errorf("weighted list parameter %q is incorrect", param)
+			}
+			value = strings.Trim(strings.TrimSpace(value), "\"")
+			if name != "q" {
+				pref.Params[name] = value
+				continue
+			}
+			q, err := parseQ(value)
+			if err != nil {
+				return nil, err
+			}
+			pref.Q = q
+		}
+		prefs = append(prefs, pref)
+	}
+	return prefs, nil
+}
+
+// parseQ accepts qvalues as RFC 9110 section 12.4.2 defines them: 0 or 1 with up to three
+// decimals.
+func parseQ(value string) (float64, error) {
+	whole, decimals, _ := strings.Cut(value, ".")
+	if (whole != "0" && whole != "1") || len(decimals) > 3 || strings.Trim(decimals, "0123456789") != "" {
+		return 0, fmt.Errorf("qvalue %q is incorrect", value)
+	}
+	q, err := strconv.ParseFloat(value, 64)
+	if err != nil || q > 1 {
+		return 0, fmt.Errorf("qvalue %q is incorrect", value)
+	}
+	return q, nil
+}
+
+// ContentType picks the offered media type the client likes best according to its Accept
+// header. Ranges match by specificity, so for "text/*;q=0.5, text/html" an offer of text/html
+// gets 1 and text/plain gets 0.5. Ties go to the offer listed first. A missing or malformed
+// header accepts anything.
+func ContentType(h headers.Headers, offers []string) (string, bool) {
+	return best(h, "Accept", offers, func(prefs []Preference, offer string) (float64, bool) {
+		offerType, offerSubtype, _ := strings.Cut(strings.ToLower(offer), "/")
+		q, specificity := 0.0, -1
+		for _, pref := range prefs {
+			prefType, prefSubtype, _ := strings.Cut(pref.Value, "/")
+			s := -1
+			switch {
+			case prefType == offerType && prefSubtype == offerSubtype:
+				s = 2
+			case prefType == offerType && prefSubtype == "*":
+				s = 1
+			case prefType == "*" && prefSubtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = pref.Q, s
+			}
+		}
+		return q, specificity >= 0
+	})
+}
+
+// Language picks the offered language tag the client likes best according to its
+// Accept-Language header, using the prefix matching of RFC 4647 basic filtering: "en" matches
+// "en-US". The longest matching range decides the weight.
+func Language(h headers.Headers, offers []string) (string, bool) {
+	return best(h, "Accept-Language", offers, func(prefs []Preference, offer string) (float64, bool) {
+		offer = strings.ToLower(offer)
+		q, specificity := 0.0, -1
+		for _, pref := range prefs {
+			s := -1
+			switch {
+			case pref.Value == offer || strings.HasPrefix(offer, pref.Value+"-"):
+				s = len(pref.Value)
+			case pref.Value == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = pref.Q, s
+			}
+		}
+		return q, specificity >= 0
+	})
+}
+
+// Encoding picks the offered content coding the client likes best according to its
+// Accept-Encoding header. Identity is acceptable unless the client rules it out with
+// "identity;q=0" or "*;q=0", though it loses to any coding the client actually lists. A missing
+// header only gets identity, which is the safe reading for clients that never asked for
+// compression.
+func Encoding(h headers.Headers, offers []string) (string, bool) {
+	if _, ok := h.Get("Accept-Encoding"); !ok {
+		for _, offer := range offers {
+			if strings.EqualFold(offer, "identity") {
+				return offer, true
+			}
+		}
+		return "", false
+	}
+
+	return best(h, "Accept-Encoding", offers, func(prefs []Preference, offer string) (float64, bool) {
+		offer = strings.ToLower(offer)
+		wildcard := -1.0
+		for _, pref := range prefs {
+			if pref.Value == offer {
+				return pref.Q, true
+			}
+			if pref.Value == "*" {
+				wildcard = pref.Q
+			}
+		}
+		if wildcard >= 0 {
+			return wildcard, true
+		}
+		// Implicit identity is acceptable but ranks below anything the client listed.
+		return 0.001, offer == "identity"
+	})
+}
+
+// best returns the offer with the highest weight, preferring earlier offers on ties. Offers
+// that do not match anything or have a weight of 0 are not acceptable.
+func best(h headers.Headers, key string, offers []string, weigh func([]Preference, string) (float64, bool)) (string, bool) {
+	val, ok := h.Get(key)
+	if !ok {
+		if len(offers) == 0 {
+			return "", false
+		}
+		return offers[0], true
+	}
+	prefs, err := ParseWeighted(val)
+	if err != nil {
+		if len(offers) == 0 {
+			return "", false
+		}
+		return offers[0], true
+	}
+
+	bestOffer, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, matched := weigh(prefs, offer)
+		if matched && q > bestQ {
+			bestOffer, bestQ = offer, q
+		}
+	}
+	return bestOffer, bestQ > 0
+}
+
+// NegotiateContentType runs ContentType for a handler. It adds Accept to the response's Vary
+// header either way, and if nothing offered is acceptable it answers 406 with the list of
+// offers and returns false, in which case the handler should just return.
+func NegotiateContentType(w *response.Writer, req *request.Request, offers []string) (string, bool) {
+	return negotiate(w, req, "Accept", offers, ContentType)
+}
+
+// NegotiateLanguage is NegotiateContentType for Accept-Language.
+func NegotiateLanguage(w *response.Writer, req *request.Request, offers []string) (string, bool) {
+	return negotiate(w, req, "Accept-Language", offers, Language)
+}
+
+// NegotiateEncoding is NegotiateContentType for Accept-Encoding.
+func NegotiateEncoding(w *response.Writer, req *request.Request, offers []string) (string, bool) {
+	return negotiate(w, req, "Accept-Encoding", offers, Encoding)
+}
+
+func negotiate(w *response.Writer, req *request.Request, key string, offers []string, pick func(headers.Headers, []string) (string, bool)) (string, bool) {
+	w.AddVary(key)
+	offer, ok := pick(req.Headers, offers)
+	if ok {
+		return offer, true
+	}
+
+	w.WriteRequestLine(response.StatusNotAcceptable)
+	body := []byte("Not Acceptable. Available: " + strings.Join(offers, ", ") + "\n")
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+	return "", false
+}
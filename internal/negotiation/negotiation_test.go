@@ -0,0 +1,108 @@
+package negotiation
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWeighted(t *testing.T) {
+	// Test: Weights, parameters and empty elements
+	prefs, err := ParseWeighted("text/html;level=1, , text/*;q=0.5, */*;Q=0.001")
+	require.NoError(t, err)
+	require.Len(t, prefs, 3)
+	assert.Equal(t, "text/html", prefs[0].Value)
+	assert.Equal(t, "1", prefs[0].Params["level"])
+	assert.Equal(t, 1.0, prefs[0].Q)
+	assert.Equal(t, 0.5, prefs[1].Q)
+	assert.Equal(t, 0.001, prefs[2].Q)
+
+	// Test: Malformed qvalues
+	for _, val := range []string{"gzip;q=2", "gzip;q=0.1234", "gzip;q=abc", "gzip;q", ";q=1"} {
+		_, err := ParseWeighted(val)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	offers := []string{"application/json", "text/html"}
+
+	// Test: Specific type beats the wildcard's weight
+	offer, ok := ContentType(headers.Headers{"accept": "text/*;q=0.5, text/html, */*;q=0.1"}, offers)
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", offer)
+
+	// Test: Wildcard only, first offer wins the tie
+	offer, ok = ContentType(headers.Headers{"accept": "*/*"}, offers)
+	assert.True(t, ok)
+	assert.Equal(t, "application/json", offer)
+
+	// Test: Explicitly refused type
+	offer, ok = ContentType(headers.Headers{"accept": "application/json;q=0, */*;q=0.2"}, offers)
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", offer)
+
+	// Test: Nothing acceptable
+	_, ok = ContentType(headers.Headers{"accept": "image/png"}, offers)
+	assert.False(t, ok)
+
+	// Test: No header accepts anything
+	offer, ok = ContentType(headers.Headers{}, offers)
+	assert.True(t, ok)
+	assert.Equal(t, "application/json", offer)
+}
+
+func TestLanguageAndEncoding(t *testing.T) {
+	// Test: Language prefix matching
+	offer, ok := Language(headers.Headers{"accept-language": "fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5"}, []string{"en-US", "de", "fr"})
+	assert.True(t, ok)
+	assert.Equal(t, "fr", offer)
+
+	offer, ok = Language(headers.Headers{"accept-language": "en"}, []string{"de", "en-GB"})
+	assert.True(t, ok)
+	assert.Equal(t, "en-GB", offer)
+
+	// Test: Encoding weights and implicit identity
+	offers := []string{"gzip", "deflate", "identity"}
+	offer, ok = Encoding(headers.Headers{"accept-encoding": "deflate, gzip;q=0.5"}, offers)
+	assert.True(t, ok)
+	assert.Equal(t, "deflate", offer)
+
+	offer, ok = Encoding(headers.Headers{"accept-encoding": "br"}, offers)
+	assert.True(t, ok)
+	assert.Equal(t, "identity", offer)
+
+	_, ok = Encoding(headers.Headers{"accept-encoding": "br, *;q=0"}, offers)
+	assert.False(t, ok)
+
+	offer, ok = Encoding(headers.Headers{}, offers)
+	assert.True(t, ok)
+	assert.Equal(t, "identity", offer)
+}
+
+func TestNegotiateThroughWriter(t *testing.T) {
+	// Test: Successful negotiation adds Vary
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	req := &request.Request{Headers: headers.Headers{"accept": "text/html"}}
+	offer, ok := NegotiateContentType(w, req, []string{"application/json", "text/html"})
+	require.True(t, ok)
+	assert.Equal(t, "text/html", offer)
+	w.WriteRequestLine(response.StatusOK)
+	w.WriteHeaders(headers.Headers{"Content-Length": "0", "Vary": "Cookie"})
+	assert.Contains(t, buf.String(), "Vary: Cookie, Accept\r\n")
+
+	// Test: Failed negotiation answers 406
+	buf = &bytes.Buffer{}
+	w = response.NewWriter(buf)
+	req = &request.Request{Headers: headers.Headers{"accept": "image/png"}}
+	_, ok = NegotiateContentType(w, req, []string{"application/json"})
+	require.False(t, ok)
+	assert.Contains(t, buf.String(), "HTTP/1.1 406 Not Acceptable\r\n")
+	assert.Contains(t, buf.String(), "Vary: Accept\r\n")
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrForbidden = errors.New("destination is not allowed")
+
+type aclRule struct {
+	allow bool
+	// Exactly one of host, suffix, prefix or any is set.
+	host   string
+	suffix string
+	prefix netip.Prefix
+	any    bool
+	port   int
+}
+
+// matches reports whether the rule covers a connection to ip:port that was asked for by the
+// name host. Name rules look at the name, address rules at the address actually dialed, so a
+// name that resolves into a denied network stays denied.
+func (r aclRule) matches(host string, ip netip.Addr, port int) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	switch {
+	case r.any:
+		return true
+	case r.host != "":
+		return strings.EqualFold(host, r.host)
+	case r.suffix != "":
+		return len(host) > len(r.suffix) && strings.HasSuffix(strings.ToLower(host), r.suffix)
+	default:
+		return ip.IsValid() && r.prefix.Contains(ip.Unmap())
+	}
+}
+
+// ACL decides which destinations the forward proxy may connect to. Rules are checked in the
+// order they were added and the first that matches decides. Anything no rule matches is
+// denied.
+type ACL struct {
+	rules []aclRule
+}
+
+func NewACL() *ACL {
+	return &ACL{}
+}
+
+// Allow adds a rule letting destinations that match pattern through. A pattern is a host name
+// ("example.com"), a wildcard for its subdomains ("*.example.com"), an address or a network in
+// CIDR notation ("10.0.0.0/8", IPv6 in brackets), or "*" for anything. It may end in ":port" to
+// only cover that port.
+func (a *ACL) Allow(pattern string) error {
+	return a.add(pattern, true)
+}
+
+// Deny adds a rule refusing destinations that match pattern, in the same syntax as Allow.
+func (a *ACL) Deny(pattern string) error {
+	return a.add(pattern, false)
+}
+
+func (a *ACL) add(pattern string, allow bool) error {
+	hostPart, port, err := splitPattern(pattern)
+	if err != nil {
+		return err
+	}
+	rule := aclRule{allow: allow, port: port}
+	switch {
+	case hostPart == "*":
+		rule.any = true
+	case strings.HasPrefix(hostPart, "*."):
+		rule.suffix = strings.ToLower(hostPart[1:])
+	default:
+		if prefix, err := netip.ParsePrefix(hostPart); err == nil {
+			rule.prefix = prefix.Masked()
+		} else if addr, err := netip.ParseAddr(hostPart); err == nil {
+			rule.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		} else if hostPart != "" && !strings.ContainsAny(hostPart, "*/[]") {
+			rule.host = hostPart
+		} else {
+			return fmt.Errorf("acl pattern %q is incorrect", pattern)
+		}
+	}
+	a.rules = append(a.rules, rule)
+	return nil
+}
+
+// splitPattern separates an optional port from the host part of a pattern.
+func splitPattern(pattern string) (string, int, error) {
+	hostPart, portPart := pattern, ""
+	if strings.HasPrefix(pattern, "[") {
+		end := strings.Index(pattern, "]")
+		if end == -1 {
+			return "", 0, fmt.Errorf("acl pattern %q is incorrect", pattern)
+		}
+		hostPart = pattern[1:end]
+		rest := pattern[end+1:]
+		if rest != "" {
+			var ok bool
+			if portPart, ok = strings.CutPrefix(rest, ":"); !ok {
+				return "", 0, fmt.Errorf("acl pattern %q is incorrect", pattern)
+			}
+		}
+	} else if strings.Count(pattern, ":") == 1 {
+		hostPart, portPart, _ = strings.Cut(pattern, ":")
+	}
+
+	if portPart == "" || portPart == "*" {
+		return hostPart, 0, nil
+	}
+	port, err := strconv.Atoi(portPart)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("acl pattern %q has an incorrect port", pattern)
+	}
+	return hostPart, port, nil
+}
+
+// Permits reports whether a connection to ip:port asked for as host is allowed. ip may be the
+// zero Addr when only the name is known yet, in which case rules on addresses are skipped
+// unless host is itself an address.
+func (a *ACL) Permits(host string, ip netip.Addr, port int) bool {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil && !ip.IsValid() {
+		ip = addr
+	}
+	for _, rule := range a.rules {
+		if !rule.any && rule.host == "" && rule.suffix == "" && !ip.IsValid() {
+			// An address rule cannot be judged before the name is resolved.
+			continue
+		}
+		if rule.matches(host, ip, port) {
+			return rule.allow
+		}
+	}
+	return false
+}
+
+// dialer connects to destinations the ACL permits. The check runs on the address each
+// connection attempt actually goes to, after name resolution. Unspecified addresses are never
+// dialed, since the kernel takes them for the local host.
+func (a *ACL) dialer(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		d := &net.Dialer{
+			Timeout: timeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				ipPort, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return err
+				}
+				// Connecting to 0.0.0.0 or :: reaches this machine, whatever the rules say.
+				if ipPort.Addr().Unmap().IsUnspecified() {
+					return fmt.Errorf("%w: %s", ErrForbidden, addr)
+				}
+				if !a.Permits(host, ipPort.Addr(), int(ipPort.Port())) {
+					return fmt.Errorf("%w: %s", ErrForbidden, addr)
+				}
+				return nil
+			},
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
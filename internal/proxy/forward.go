@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// dialTimeout bounds how long the forward proxy waits for a destination to accept a
+	// connection.
+	dialTimeout = 30 * time.Second
+
+	// via is what the proxy adds to the Via header of messages it forwards (RFC 9110 section
+	// 7.6.3).
+	via = "1.1 httpfromtcp"
+)
+
+// Forward returns a Handler that acts as a forward proxy for requests in absolute form
+// ("GET http://example.com/ HTTP/1.1") and passes every other request on to next. Destinations
+// the ACL does not permit are answered with 403. Only plain http is forwarded, since a client
+// wanting https is expected to open a tunnel with CONNECT instead; see Tunnel.
+//
+// Unlike Handler, the client's address is not added to X-Forwarded-For or Forwarded, but Via
+// is. WithRewrite and WithModifyResponse hooks apply as usual. A transport given with
+// WithTransport replaces the one that checks the ACL against the resolved address, so only the
+// destination's name is checked then.
+func Forward(next server.Handler, acl *ACL, opts ...Option) server.Handler {
+	rp := &reverseProxy{transport: newForwardTransport(acl)}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return func(w *response.Writer, req *request.Request) {
+		if !request.IsAbsoluteForm(req.RequestLine.RequestTarget) {
+			next(w, req)
+			return
+		}
+		rp.forward(w, req, acl)
+	}
+}
+
+func newForwardTransport(acl *ACL) http.RoundTripper {
+	t := DefaultTransport.(*http.Transport).Clone()
+	// Destinations are reached directly, never through a proxy from the environment.
+	t.Proxy = nil
+	t.DialContext = acl.dialer(dialTimeout)
+	return t
+}
+
+func (rp *reverseProxy) forward(w *response.Writer, req *request.Request, acl *ACL) {
+	target, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		writeError(w, response.StatusBadRequest, err)
+		return
+	}
+	if target.Scheme != "http" {
+		writeError(w, response.StatusBadRequest, errors.New("only http can be forwarded, use CONNECT for "+target.Scheme))
+		return
+	}
+	port := 80
+	if target.Port() != "" {
+		port, _ = strconv.Atoi(target.Port())
+	}
+	if !acl.Permits(target.Hostname(), netip.Addr{}, port) {
+		writeError(w, response.StatusForbidden, ErrForbidden)
+		return
+	}
+
+	out, err := newUpstreamRequest(req, &url.URL{Scheme: target.Scheme, Host: target.Host})
+	if err != nil {
+		writeError(w, response.StatusBadRequest, err)
+		return
+	}
+	appendHeader(out.Header, "Via", via)
+	for _, rewrite := range rp.rewrites {
+		rewrite(out, req)
+	}
+
+	resp, err := rp.transport.RoundTrip(out)
+	if err != nil {
+		if errors.Is(err, ErrForbidden) {
+			writeError(w, response.StatusForbidden, ErrForbidden)
+			return
+		}
+		if req.Context().Err() != nil {
+			return
+		}
+		log.Printf("Error forwarding to %s: %v", out.URL.Redacted(), err)
+		writeError(w, gatewayStatus(err), errors.New("destination unavailable"))
+		return
+	}
+	removeHopHeaders(resp.Header)
+	appendHeader(resp.Header, "Via", via)
+	rp.respond(w, req, resp)
+}
+
+// Tunnel returns a ConnectHandler that opens a tunnel to the host:port a CONNECT request asks
+// for, if the ACL permits it. Once the destination accepts, the client is answered with 200
+// and bytes are copied both ways until both sides are done. Each side's end of input is passed
+// on to the other as a half-close, so a client can finish sending and still read the reply.
+func Tunnel(acl *ACL) server.ConnectHandler {
+	dial := acl.dialer(dialTimeout)
+	return func(conn net.Conn, req *request.Request) {
+		defer conn.Close()
+
+		target := req.RequestLine.RequestTarget
+		host, portStr, err := net.SplitHostPort(target)
+		if err != nil {
+			writeTunnelError(conn, req, response.StatusBadRequest, err)
+			return
+		}
+		port, _ := strconv.Atoi(portStr)
+		if !acl.Permits(host, netip.Addr{}, port) {
+			writeTunnelError(conn, req, response.StatusForbidden, ErrForbidden)
+			return
+		}
+
+		destination, err := dial(req.Context(), "tcp", target)
+		if err != nil {
+			if errors.Is(err, ErrForbidden) {
+				writeTunnelError(conn, req, response.StatusForbidden, ErrForbidden)
+				return
+			}
+			log.Printf("Error opening tunnel to %s: %v", target, err)
+			writeTunnelError(conn, req, gatewayStatus(err), errors.New("destination unavailable"))
+			return
+		}
+		defer destination.Close()
+		// Tear the tunnel down when the server shuts down.
+		stop := context.AfterFunc(req.Context(), func() {
+			conn.Close()
+			destination.Close()
+		})
+		defer stop()
+
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			return
+		}
+		splice(conn, destination)
+	}
+}
+
+func writeTunnelError(conn net.Conn, req *request.Request, statusCode response.StatusCode, err error) {
+	w := response.NewWriter(conn)
+	w.SetHttpVersion(req.RequestLine.HttpVersion)
+	writeError(w, statusCode, err)
+}
+
+// splice copies between a and b in both directions and returns once both copies are done.
+func splice(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		pipe(a, b)
+		close(done)
+	}()
+	pipe(b, a)
+	<-done
+}
+
+// pipe copies src to dst. When src ends cleanly only dst's write side is closed, leaving the
+// other direction running. Any other failure tears down both connections, since the other
+// direction would otherwise wait on a peer that is gone.
+func pipe(dst, src net.Conn) {
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newACL(t *testing.T, rules ...string) *ACL {
+	t.Helper()
+	acl := NewACL()
+	for _, rule := range rules {
+		pattern, denied := strings.CutPrefix(rule, "!")
+		if denied {
+			require.NoError(t, acl.Deny(pattern))
+		} else {
+			require.NoError(t, acl.Allow(pattern))
+		}
+	}
+	return acl
+}
+
+func TestACL(t *testing.T) {
+	acl := newACL(t,
+		"!admin.example.com",
+		"*.example.com:443",
+		"example.org",
+		"!10.0.0.0/8",
+		"[2001:db8::1]:*",
+		"192.0.2.7:8080",
+		"*:80",
+	)
+	tests := []struct {
+		name string
+		host string
+		ip   string
+		port int
+		want bool
+	}{
+		{"denied name before wildcard", "admin.example.com", "", 443, false},
+		{"subdomain on its port", "www.example.com", "", 443, true},
+		{"subdomain on another port", "www.example.com", "", 8443, false},
+		{"wildcard excludes the bare domain", "example.com", "", 443, false},
+		{"exact name on any port", "EXAMPLE.org", "", 22, true},
+		{"name is still unresolved", "intranet.test", "", 80, true},
+		{"name resolving into a denied network", "intranet.test", "10.1.2.3", 80, false},
+		{"address literal", "10.1.2.3", "", 80, false},
+		{"ipv6 literal", "[2001:db8::1]", "", 22, true},
+		{"address on its port", "192.0.2.7", "", 8080, true},
+		{"address on another port", "192.0.2.7", "", 22, false},
+		{"nothing matches", "example.net", "", 443, false},
+	}
+	for _, tt := range tests {
+		var ip netip.Addr
+		if tt.ip != "" {
+			ip = netip.MustParseAddr(tt.ip)
+		}
+		// Test: Each rule kind matches what its pattern says
+		assert.Equal(t, tt.want, acl.Permits(tt.host, ip, tt.port), tt.name)
+	}
+
+	// Test: Incorrect patterns are rejected
+	for _, pattern := range []string{"", "[::1", "example.com:0", "example.com:http", "a*b.com", "10.0.0.0/33"} {
+		assert.Error(t, NewACL().Allow(pattern), pattern)
+	}
+}
+
+func TestForwardAbsoluteForm(t *testing.T) {
+	var got *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = r
+		io.WriteString(rw, "from upstream")
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	_, port, _ := net.SplitHostPort(host)
+
+	next := func(w *response.Writer, req *request.Request) {
+		w.WriteRequestLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("local"))
+	}
+	handler := Forward(next, newACL(t, "127.0.0.1"))
+
+	// Test: An absolute-form request goes to the host it names
+	resp, body := roundTrip(t, handler, newRequest("GET", upstream.URL+"/path?q=1", headers.Headers{
+		"proxy-connection": "keep-alive",
+		"via":              "1.0 client-side",
+	}, ""))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "from upstream", body)
+	assert.Equal(t, "1.1 httpfromtcp", resp.Header.Get("Via"))
+	require.NotNil(t, got)
+	assert.Equal(t, "/path", got.URL.Path)
+	assert.Equal(t, "q=1", got.URL.RawQuery)
+	assert.Equal(t, host, got.Host)
+	assert.Equal(t, "1.0 client-side, 1.1 httpfromtcp", got.Header.Get("Via"))
+	assert.Empty(t, got.Header.Get("Proxy-Connection"))
+	assert.Empty(t, got.Header.Get("X-Forwarded-For"))
+	assert.Empty(t, got.Header.Get("Forwarded"))
+
+	// Test: Origin-form requests are served locally
+	_, body = roundTrip(t, handler, newRequest("GET", "/path", nil, ""))
+	assert.Equal(t, "local", body)
+	_, body = roundTrip(t, handler, newRequest("GET", "/login?next="+upstream.URL+"/", nil, ""))
+	assert.Equal(t, "local", body)
+
+	// Test: Destinations outside the ACL are refused
+	got = nil
+	handler = Forward(next, newACL(t, "localhost"))
+	resp, _ = roundTrip(t, handler, newRequest("GET", upstream.URL+"/", nil, ""))
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Nil(t, got)
+
+	// Test: A name the ACL allows is still refused when it resolves into a denied network
+	handler = Forward(next, newACL(t, "!127.0.0.0/8", "![::1]", "localhost"))
+	resp, _ = roundTrip(t, handler, newRequest("GET", "http://localhost:"+port+"/", nil, ""))
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Nil(t, got)
+
+	// Test: The unspecified address reaches this machine, so it is refused whatever the ACL says
+	handler = Forward(next, newACL(t, "*"))
+	resp, _ = roundTrip(t, handler, newRequest("GET", "http://0.0.0.0:"+port+"/", nil, ""))
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Nil(t, got)
+
+	// Test: https is left to CONNECT
+	resp, _ = roundTrip(t, handler, newRequest("GET", "https://localhost/", nil, ""))
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+// echoServer answers every connection, once the client has finished sending, with what it sent.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				conn.Write(append([]byte("echo: "), data...))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// tunnel runs handler on the server end of a TCP connection carrying req and returns the
+// client end.
+func tunnel(t *testing.T, handler func(net.Conn, *request.Request), target string) *net.TCPConn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	serverConn, err := listener.Accept()
+	require.NoError(t, err)
+
+	go handler(serverConn, newRequest("CONNECT", target, headers.Headers{"host": target}, ""))
+	return client.(*net.TCPConn)
+}
+
+func TestTunnel(t *testing.T) {
+	target := echoServer(t)
+
+	// Test: Bytes flow both ways and a half-close reaches the destination
+	client := tunnel(t, Tunnel(newACL(t, "127.0.0.1")), target)
+	_, err := io.WriteString(client, "hello")
+	require.NoError(t, err)
+	require.NoError(t, client.CloseWrite())
+	got, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n\r\necho: hello", string(got))
+
+	// Test: Destinations outside the ACL are refused
+	client = tunnel(t, Tunnel(newACL(t, "127.0.0.1:1")), target)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.True(t, resp.Close)
+
+	// Test: So is the unspecified address, even when everything is allowed
+	_, port, _ := net.SplitHostPort(target)
+	client = tunnel(t, Tunnel(newACL(t, "*")), "0.0.0.0:"+port)
+	resp, err = http.ReadResponse(bufio.NewReader(client), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	// Test: A destination that refuses the connection is a bad gateway
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+	client = tunnel(t, Tunnel(newACL(t, "127.0.0.1")), closedAddr)
+	resp, err = http.ReadResponse(bufio.NewReader(client), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 502, resp.StatusCode)
+}
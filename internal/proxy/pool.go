@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"httpfromtcp/internal/request"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxFails is how many failures in a row take an upstream out of rotation.
+	DefaultMaxFails = 3
+	// DefaultEjectTime is how long an ejected upstream is left alone before it is tried again.
+	DefaultEjectTime = 30 * time.Second
+
+	// hashReplicas is how many points each upstream gets on the consistent hash ring. More
+	// points spread keys more evenly at the cost of a bigger ring.
+	hashReplicas = 100
+)
+
+var ErrNoUpstream = errors.New("no upstream available")
+
+type upstream struct {
+	url *url.URL
+
+	// The fields below are guarded by the pool's mutex.
+	healthy      bool
+	active       int
+	failures     int
+	ejectedUntil time.Time
+}
+
+func (u *upstream) available(now time.Time) bool {
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+// Policy decides which upstream of a pool gets the next request.
+type Policy interface {
+	// pick chooses among candidates, which are the pool's upstreams in their original order
+	// with nil in place of the ones that cannot be used right now. It is called with the
+	// pool's mutex held.
+	pick(candidates []*upstream, req *request.Request) *upstream
+}
+
+type roundRobin struct {
+	next int
+}
+
+// RoundRobin hands requests to the upstreams in turn.
+func RoundRobin() Policy {
+	return &roundRobin{}
+}
+
+func (rr *roundRobin) pick(candidates []*upstream, req *request.Request) *upstream {
+	for range candidates {
+		u := candidates[rr.next%len(candidates)]
+		rr.next = (rr.next + 1) % len(candidates)
+		if u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+type leastConnections struct {
+	rr roundRobin
+}
+
+// LeastConnections hands each request to the upstream with the fewest requests in flight,
+// taking turns among those that tie.
+func LeastConnections() Policy {
+	return &leastConnections{}
+}
+
+func (lc *leastConnections) pick(candidates []*upstream, req *request.Request) *upstream {
+	fewest := -1
+	for _, u := range candidates {
+		if u != nil && (fewest < 0 || u.active < fewest) {
+			fewest = u.active
+		}
+	}
+	least := make([]*upstream, len(candidates))
+	for i, u := range candidates {
+		if u != nil && u.active == fewest {
+			least[i] = u
+		}
+	}
+	return lc.rr.pick(least, req)
+}
+
+type consistentHash struct {
+	key    func(*request.Request) string
+	ring   []uint32
+	owners map[uint32]int
+}
+
+// ConsistentHash sends requests with the same key to the same upstream. Each upstream owns
+// several points on a hash ring and a key goes to the next point clockwise from its own hash,
+// so taking one upstream out only moves the keys it owned. Requests without a key are spread
+// like any other key, as the empty string.
+func ConsistentHash(key func(*request.Request) string) Policy {
+	return &consistentHash{key: key}
+}
+
+// HashHeader keys ConsistentHash on the value of a request header, such as a session id.
+func HashHeader(name string) func(*request.Request) string {
+	return func(req *request.Request) string {
+		val, _ := req.Headers.Get(name)
+		return val
+	}
+}
+
+// HashClientIP keys ConsistentHash on the client's IP address.
+func HashClientIP() func(*request.Request) string {
+	return func(req *request.Request) string {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr
+		}
+		return host
+	}
+}
+
+func (ch *consistentHash) pick(candidates []*upstream, req *request.Request) *upstream {
+	if ch.owners == nil {
+		ch.build(candidates)
+	}
+	hash := crc32.ChecksumIEEE([]byte(ch.key(req)))
+	start := sort.Search(len(ch.ring), func(i int) bool { return ch.ring[i] >= hash })
+	for i := range ch.ring {
+		point := ch.ring[(start+i)%len(ch.ring)]
+		if u := candidates[ch.owners[point]]; u != nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// build places every upstream on the ring, whether or not it is usable at the moment, so that
+// keys do not move around as upstreams come and go.
+func (ch *consistentHash) build(candidates []*upstream) {
+	ch.owners = make(map[uint32]int)
+	for i := range candidates {
+		for replica := 0; replica < hashReplicas; replica++ {
+			point := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "-" + strconv.Itoa(replica)))
+			if _, taken := ch.owners[point]; taken {
+				continue
+			}
+			ch.owners[point] = i
+			ch.ring = append(ch.ring, point)
+		}
+	}
+	sort.Slice(ch.ring, func(i, j int) bool { return ch.ring[i] < ch.ring[j] })
+}
+
+type PoolOption func(*Pool)
+
+// WithPolicy sets how the pool picks an upstream. It defaults to RoundRobin.
+func WithPolicy(policy Policy) PoolOption {
+	return func(p *Pool) {
+		p.policy = policy
+	}
+}
+
+// WithHealthCheck probes every upstream with a GET for path each interval. An upstream that
+// does not answer within timeout, or answers with anything but a 2xx or 3xx, is taken out of
+// rotation until a later probe succeeds.
+func WithHealthCheck(path string, interval, timeout time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.checkPath = path
+		p.checkInterval = interval
+		p.checkTimeout = timeout
+	}
+}
+
+// WithPassiveEjection takes an upstream out of rotation for ejectTime once maxFails requests
+// in a row have failed on it, failing meaning no response at all or a 502, 503 or 504. A
+// maxFails of 0 turns ejection off.
+func WithPassiveEjection(maxFails int, ejectTime time.Duration) PoolOption {
+	return func(p *Pool) {
+		p.maxFails = maxFails
+		p.ejectTime = ejectTime
+	}
+}
+
+// Pool is a set of interchangeable upstreams for PoolHandler to spread requests across.
+type Pool struct {
+	mu        sync.Mutex
+	upstreams []*upstream
+	policy    Policy
+	maxFails  int
+	ejectTime time.Duration
+	now       func() time.Time
+
+	checkPath     string
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+	checkClient   *http.Client
+	stop          chan struct{}
+	stopOnce      sync.Once
+}
+
+// NewPool returns a pool of the given upstreams. Passive ejection is on with DefaultMaxFails
+// and DefaultEjectTime unless WithPassiveEjection says otherwise, and if WithHealthCheck is
+// given the probes start right away. Close stops them.
+func NewPool(targets []*url.URL, opts ...PoolOption) (*Pool, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("pool needs at least one upstream")
+	}
+	p := &Pool{
+		policy:    RoundRobin(),
+		maxFails:  DefaultMaxFails,
+		ejectTime: DefaultEjectTime,
+		now:       time.Now,
+		stop:      make(chan struct{}),
+	}
+	for _, target := range targets {
+		if target.Scheme == "" || target.Host == "" {
+			return nil, errors.New("upstream " + strconv.Quote(target.String()) + " needs a scheme and a host")
+		}
+		p.upstreams = append(p.upstreams, &upstream{url: target, healthy: true})
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.checkPath != "" && p.checkInterval > 0 {
+		p.checkClient = &http.Client{
+			Transport: DefaultTransport,
+			Timeout:   p.checkTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		go p.runHealthChecks()
+	}
+	return p, nil
+}
+
+// Close stops the health checks.
+func (p *Pool) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return nil
+}
+
+// acquire picks an upstream for req among those not in tried and counts the request against
+// it. It returns ErrNoUpstream if every upstream is down, ejected or already tried.
+func (p *Pool) acquire(req *request.Request, tried map[*upstream]bool) (*upstream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	candidates := make([]*upstream, len(p.upstreams))
+	found := false
+	for i, u := range p.upstreams {
+		if u.available(now) && !tried[u] {
+			candidates[i] = u
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrNoUpstream
+	}
+	u := p.policy.pick(candidates, req)
+	if u == nil {
+		return nil, ErrNoUpstream
+	}
+	u.active++
+	return u, nil
+}
+
+// release records how a request that acquire handed to u turned out.
+func (p *Pool) release(u *upstream, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u.active--
+	if ok {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if p.maxFails > 0 && u.failures >= p.maxFails {
+		u.failures = 0
+		u.ejectedUntil = p.now().Add(p.ejectTime)
+	}
+}
+
+// abandon gives back a request that acquire handed to u without judging u by it.
+func (p *Pool) abandon(u *upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u.active--
+}
+
+func (p *Pool) runHealthChecks() {
+	ticker := time.NewTicker(p.checkInterval)
+	defer ticker.Stop()
+	for {
+		p.checkAll()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy := p.probe(u)
+			p.mu.Lock()
+			u.healthy = healthy
+			p.mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(u *upstream) bool {
+	target := *u.url
+	target.Path = joinPath(u.url.Path, p.checkPath)
+	target.RawPath = ""
+	target.RawQuery = ""
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.checkClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBackend starts an upstream that answers with its name and counts its requests.
+func newBackend(t *testing.T, name string, hits *atomic.Int32) *url.URL {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if hits != nil {
+			hits.Add(1)
+		}
+		io.WriteString(rw, name)
+	}))
+	t.Cleanup(backend.Close)
+	return mustParse(t, backend.URL)
+}
+
+// deadBackend returns the address of an upstream that is no longer listening.
+func deadBackend(t *testing.T) *url.URL {
+	t.Helper()
+	backend := httptest.NewServer(http.NotFoundHandler())
+	u := mustParse(t, backend.URL)
+	backend.Close()
+	return u
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool, err := NewPool([]*url.URL{newBackend(t, "a", nil), newBackend(t, "b", nil), newBackend(t, "c", nil)})
+	require.NoError(t, err)
+	defer pool.Close()
+	handler := PoolHandler(pool)
+
+	// Test: Requests take turns
+	got := ""
+	for range 6 {
+		_, body := roundTrip(t, handler, newRequest("GET", "/", nil, ""))
+		got += body
+	}
+	assert.Equal(t, "abcabc", got)
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	pool, err := NewPool([]*url.URL{mustParse(t, "http://a"), mustParse(t, "http://b"), mustParse(t, "http://c")},
+		WithPolicy(LeastConnections()))
+	require.NoError(t, err)
+	req := newRequest("GET", "/", headers.Headers{}, "")
+
+	// Test: Busy upstreams are passed over
+	first, err := pool.acquire(req, nil)
+	require.NoError(t, err)
+	second, err := pool.acquire(req, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	pool.release(first, true)
+
+	third, err := pool.acquire(req, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, second, third)
+	fourth, err := pool.acquire(req, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, second, fourth)
+	assert.NotEqual(t, third, fourth)
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	targets := make([]*url.URL, 0)
+	for i := range 4 {
+		targets = append(targets, mustParse(t, fmt.Sprintf("http://backend-%d", i)))
+	}
+	pool, err := NewPool(targets, WithPolicy(ConsistentHash(HashHeader("X-Session"))))
+	require.NoError(t, err)
+
+	pick := func(session string) *upstream {
+		u, err := pool.acquire(newRequest("GET", "/", headers.Headers{"x-session": session}, ""), nil)
+		require.NoError(t, err)
+		pool.release(u, true)
+		return u
+	}
+
+	// Test: The same key always lands on the same upstream, and keys spread out
+	before := make(map[string]*upstream)
+	used := make(map[*upstream]bool)
+	for i := range 200 {
+		session := fmt.Sprintf("session-%d", i)
+		before[session] = pick(session)
+		used[before[session]] = true
+		assert.Equal(t, before[session], pick(session))
+	}
+	assert.Len(t, used, 4)
+
+	// Test: Taking one upstream out only moves the keys it owned
+	gone := pool.upstreams[1]
+	gone.healthy = false
+	for session, u := range before {
+		if u == gone {
+			assert.NotEqual(t, gone, pick(session))
+		} else {
+			assert.Equal(t, u, pick(session))
+		}
+	}
+
+	// Test: Client IP keys ignore the port
+	key := HashClientIP()
+	assert.Equal(t, "192.0.2.1", key(&request.Request{RemoteAddr: "192.0.2.1:1234"}))
+	assert.Equal(t, "2001:db8::1", key(&request.Request{RemoteAddr: "[2001:db8::1]:1234"}))
+}
+
+func TestPoolPassiveEjection(t *testing.T) {
+	var hits atomic.Int32
+	pool, err := NewPool([]*url.URL{deadBackend(t), newBackend(t, "alive", &hits)},
+		WithPassiveEjection(2, time.Minute))
+	require.NoError(t, err)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+	handler := PoolHandler(pool)
+
+	// Test: Failures are passed on until the upstream is ejected
+	statuses := make([]int, 0)
+	for range 6 {
+		resp, _ := roundTrip(t, handler, newRequest("GET", "/", nil, ""))
+		statuses = append(statuses, resp.StatusCode)
+	}
+	assert.Equal(t, []int{502, 200, 502, 200, 200, 200}, statuses)
+	assert.Equal(t, int32(4), hits.Load())
+
+	// Test: Ejected upstreams come back once the time is up
+	now = now.Add(2 * time.Minute)
+	resp, _ := roundTrip(t, handler, newRequest("GET", "/", nil, ""))
+	resp2, _ := roundTrip(t, handler, newRequest("GET", "/", nil, ""))
+	assert.ElementsMatch(t, []int{502, 200}, []int{resp.StatusCode, resp2.StatusCode})
+
+	// Test: Requests that cannot be forwarded are the client's fault and eject nobody
+	now = now.Add(2 * time.Minute)
+	pool.upstreams[0].ejectedUntil = time.Time{}
+	pool.upstreams[0].failures = 0
+	for range 4 {
+		resp, _ = roundTrip(t, handler, newRequest("GET", "/%zz", nil, ""))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+	for _, u := range pool.upstreams {
+		assert.Zero(t, u.failures)
+		assert.True(t, u.available(now))
+	}
+
+	// Test: With everything ejected the client gets 503
+	pool.upstreams[1].ejectedUntil = now.Add(time.Minute)
+	pool.upstreams[0].ejectedUntil = now.Add(time.Minute)
+	resp, _ = roundTrip(t, handler, newRequest("GET", "/", nil, ""))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestPoolRetries(t *testing.T) {
+	var hits atomic.Int32
+	pool, err := NewPool([]*url.URL{deadBackend(t), newBackend(t, "alive", &hits)},
+		WithPassiveEjection(0, 0))
+	require.NoError(t, err)
+	handler := PoolHandler(pool, WithRetries(1))
+
+	// Test: Idempotent requests move on to the next upstream
+	for range 4 {
+		resp, body := roundTrip(t, handler, newRequest("GET", "/", nil, ""))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "alive", body)
+	}
+
+	// Test: Other methods are not retried
+	statuses := make([]int, 0)
+	for range 2 {
+		resp, _ := roundTrip(t, handler, newRequest("POST", "/", headers.Headers{"content-length": "2"}, "hi"))
+		statuses = append(statuses, resp.StatusCode)
+	}
+	assert.ElementsMatch(t, []int{502, 200}, statuses)
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy.Load() {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	pool, err := NewPool([]*url.URL{mustParse(t, backend.URL)},
+		WithHealthCheck("/healthz", 10*time.Millisecond, time.Second))
+	require.NoError(t, err)
+	defer pool.Close()
+	isHealthy := func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.upstreams[0].healthy
+	}
+
+	// Test: A failing probe takes the upstream out, and a passing one brings it back
+	healthy.Store(false)
+	assert.Eventually(t, func() bool { return !isHealthy() }, time.Second, 5*time.Millisecond)
+	resp, _ := roundTrip(t, PoolHandler(pool), newRequest("GET", "/", nil, ""))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	healthy.Store(true)
+	assert.Eventually(t, isHealthy, time.Second, 5*time.Millisecond)
+}
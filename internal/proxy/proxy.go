@@ -0,0 +1,433 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const copyBufferSize = 32 * 1024
+
+// hopHeaders only concern a single connection and are never forwarded, in either direction
+// (RFC 9110 section 7.6.1). Headers named in Connection are dropped as well.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// DefaultTransport talks to upstreams when no other transport is given, and is what a cache or
+// another wrapping transport should sit in front of. Compression is left to the client and the
+// upstream, otherwise the transport would ask for gzip on its own and hand back a decoded body
+// with its length stripped.
+var DefaultTransport = newDefaultTransport()
+
+func newDefaultTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableCompression = true
+	return t
+}
+
+type Option func(*reverseProxy)
+
+// WithTransport sets what carries requests to the upstream. It defaults to a clone of
+// http.DefaultTransport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(rp *reverseProxy) {
+		rp.transport = transport
+	}
+}
+
+// WithRewrite adds a hook that may edit the outgoing request after the proxy has built it, for
+// example to strip a path prefix or to change the Host. Hooks run in the order they were added.
+func WithRewrite(fn func(out *http.Request, in *request.Request)) Option {
+	return func(rp *reverseProxy) {
+		rp.rewrites = append(rp.rewrites, fn)
+	}
+}
+
+// WithModifyResponse adds a hook that may edit the upstream's response before it is copied
+// back. Hop-by-hop headers are already gone by then. If a hook returns an error the client gets
+// 502 instead.
+func WithModifyResponse(fn func(resp *http.Response) error) Option {
+	return func(rp *reverseProxy) {
+		rp.modifyResponses = append(rp.modifyResponses, fn)
+	}
+}
+
+// WithRetries lets a request that failed on one upstream be tried on up to n others. Only
+// idempotent methods are retried, since the first upstream may have acted on the request
+// before failing. A failure is no response at all or a 502, 503 or 504.
+func WithRetries(n int) Option {
+	return func(rp *reverseProxy) {
+		rp.retries = n
+	}
+}
+
+type reverseProxy struct {
+	pool            *Pool
+	transport       http.RoundTripper
+	retries         int
+	rewrites        []func(*http.Request, *request.Request)
+	modifyResponses []func(*http.Response) error
+}
+
+// Handler returns a Handler that forwards every request to target. The request path is
+// appended to target's path and the queries are merged. Method, headers and body go upstream
+// without hop-by-hop headers, with the client added to X-Forwarded-For and Forwarded, and
+// with the Host set to target's. The upstream's status, headers, body and trailers come back
+// the same way. An upstream that cannot be reached is answered with 502, or 504 on a timeout.
+func Handler(target *url.URL, opts ...Option) server.Handler {
+	// A lone upstream is never ejected; there would be nowhere else to go.
+	pool := &Pool{
+		upstreams: []*upstream{{url: target, healthy: true}},
+		policy:    RoundRobin(),
+		now:       time.Now,
+		stop:      make(chan struct{}),
+	}
+	return PoolHandler(pool, opts...)
+}
+
+// PoolHandler is Handler for a pool of upstreams: each request goes to the upstream the pool's
+// policy picks, and the outcome feeds the pool's passive ejection. If no upstream is available
+// the client gets 503.
+func PoolHandler(pool *Pool, opts ...Option) server.Handler {
+	rp := &reverseProxy{pool: pool, transport: DefaultTransport}
+	for _, opt := range opts {
+		opt(rp)
+	}
+	return rp.serve
+}
+
+func (rp *reverseProxy) serve(w *response.Writer, req *request.Request) {
+	attempts := 1
+	if isIdempotent(req.RequestLine.Method) {
+		attempts += rp.retries
+	}
+
+	tried := make(map[*upstream]bool)
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		u, err := rp.pool.acquire(req, tried)
+		if err != nil {
+			break
+		}
+		tried[u] = true
+
+		resp, err := rp.roundTrip(req, u)
+		if err != nil && req.Context().Err() != nil {
+			// The client went away, which says nothing about the upstream.
+			rp.pool.abandon(u)
+			return
+		}
+		if errors.Is(err, errBadRequest) {
+			// The client's request is at fault, not the upstream.
+			rp.pool.abandon(u)
+			writeError(w, response.StatusBadRequest, err)
+			return
+		}
+		if err != nil {
+			rp.pool.release(u, false)
+			lastErr = err
+			continue
+		}
+
+		failed := isGatewayFailure(resp.StatusCode)
+		if failed && attempt+1 < attempts {
+			resp.Body.Close()
+			rp.pool.release(u, false)
+			lastErr = fmt.Errorf("upstream answered %d", resp.StatusCode)
+			continue
+		}
+		rp.respond(w, req, resp)
+		rp.pool.release(u, !failed)
+		return
+	}
+
+	if lastErr == nil {
+		writeError(w, response.StatusServiceUnavailable, ErrNoUpstream)
+		return
+	}
+	writeError(w, gatewayStatus(lastErr), errors.New("upstream unavailable"))
+}
+
+// errBadRequest marks errors that come from the client's request rather than the upstream.
+var errBadRequest = errors.New("request cannot be forwarded")
+
+// roundTrip sends req to u and returns the upstream's response with hop-by-hop headers gone.
+func (rp *reverseProxy) roundTrip(req *request.Request, u *upstream) (*http.Response, error) {
+	out, err := newUpstreamRequest(req, u.url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	addForwardedHeaders(out.Header, req)
+	for _, rewrite := range rp.rewrites {
+		rewrite(out, req)
+	}
+
+	resp, err := rp.transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("Error proxying to %s: %v", out.URL.Redacted(), err)
+		return nil, err
+	}
+	removeHopHeaders(resp.Header)
+	return resp, nil
+}
+
+func (rp *reverseProxy) respond(w *response.Writer, req *request.Request, resp *http.Response) {
+	defer resp.Body.Close()
+	for _, modify := range rp.modifyResponses {
+		if err := modify(resp); err != nil {
+			log.Printf("Error modifying upstream response: %v", err)
+			writeError(w, response.StatusBadGateway, errors.New("bad upstream response"))
+			return
+		}
+	}
+	copyResponse(w, req, resp)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func isGatewayFailure(statusCode int) bool {
+	return statusCode == 502 || statusCode == 503 || statusCode == 504
+}
+
+// newUpstreamRequest translates req into the request sent to target.
+func newUpstreamRequest(req *request.Request, target *url.URL) (*http.Request, error) {
+	body, err := req.ReadBody()
+	if err != nil {
+		return nil, err
+	}
+	in, err := url.ParseRequestURI(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *target
+	escaped := joinPath(target.EscapedPath(), in.EscapedPath())
+	u.Path, err = url.PathUnescape(escaped)
+	if err != nil {
+		return nil, err
+	}
+	u.RawPath = escaped
+	switch {
+	case target.RawQuery == "":
+		u.RawQuery = in.RawQuery
+	case in.RawQuery != "":
+		u.RawQuery = target.RawQuery + "&" + in.RawQuery
+	}
+
+	out, err := http.NewRequestWithContext(req.Context(), req.RequestLine.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Headers {
+		out.Header.Add(k, v)
+	}
+	// A client that accepts trailers still does; the upstream may send them through.
+	acceptsTrailers := req.Headers.HasToken("te", "trailers")
+	removeHopHeaders(out.Header)
+	if acceptsTrailers {
+		out.Header.Set("Te", "trailers")
+	}
+
+	// The body is already here, so there is nothing left for the upstream to expect. Host and
+	// the length come from the request itself rather than its headers.
+	out.Header.Del("Expect")
+	out.Header.Del("Host")
+	out.Header.Del("Content-Length")
+	if _, ok := out.Header["User-Agent"]; !ok {
+		// Keep the transport from adding its own.
+		out.Header.Set("User-Agent", "")
+	}
+	return out, nil
+}
+
+func joinPath(base, p string) string {
+	if base == "" || base == "/" {
+		return p
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(p, "/")
+}
+
+// addForwardedHeaders records the client and the host it asked for, both in the de facto
+// X-Forwarded-* headers and in Forwarded from RFC 7239, appending to whatever earlier proxies
+// put there.
+func addForwardedHeaders(h http.Header, req *request.Request) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = ""
+	}
+	host, _ := req.Headers.Get("Host")
+
+	if clientIP != "" {
+		appendHeader(h, "X-Forwarded-For", clientIP)
+	}
+	if host != "" {
+		h.Set("X-Forwarded-Host", host)
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	h.Set("X-Forwarded-Proto", proto)
+
+	node := "unknown"
+	if clientIP != "" {
+		node = clientIP
+		if strings.Contains(clientIP, ":") {
+			node = "\"[" + clientIP + "]\""
+		}
+	}
+	element := "for=" + node
+	if host != "" {
+		element += ";host=" + quoteIfNeeded(host)
+	}
+	element += ";proto=" + proto
+	appendHeader(h, "Forwarded", element)
+}
+
+func appendHeader(h http.Header, key, value string) {
+	if prior := h.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(key, value)
+}
+
+func quoteIfNeeded(value string) string {
+	if strings.ContainsAny(value, ":[]\"") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any the Connection header
+// names.
+func removeHopHeaders(h http.Header) {
+	for _, val := range h.Values("Connection") {
+		for _, field := range strings.Split(val, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				h.Del(field)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+}
+
+// copyResponse writes resp back to the client. A body of known length keeps it, anything else
+// is sent chunked, and so is a body with trailers, which only chunked framing can carry.
+func copyResponse(w *response.Writer, req *request.Request, resp *http.Response) {
+	h := make(headers.Headers)
+	for k, vs := range resp.Header {
+		if k == "Set-Cookie" {
+			for _, v := range vs {
+				if err := w.AddSetCookie(v); err != nil {
+					log.Printf("Dropping cookie from upstream: %v", err)
+				}
+			}
+			continue
+		}
+		h[k] = strings.Join(vs, ", ")
+	}
+
+	trailerKeys := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		trailerKeys = append(trailerKeys, k)
+	}
+	sort.Strings(trailerKeys)
+
+	chunked := false
+	if resp.StatusCode != 204 && resp.StatusCode != 304 {
+		h.Delete("Content-Length")
+		if resp.ContentLength >= 0 && len(trailerKeys) == 0 {
+			h["Content-Length"] = strconv.FormatInt(resp.ContentLength, 10)
+		} else {
+			chunked = true
+			h["Transfer-Encoding"] = "chunked"
+		}
+		if len(trailerKeys) > 0 {
+			h["Trailer"] = strings.Join(trailerKeys, ", ")
+		}
+	}
+
+	w.WriteRequestLine(response.StatusCode(resp.StatusCode))
+	w.WriteHeaders(h)
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.WriteChunkedBody(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading upstream body: %v", err)
+			w.Abort()
+			return
+		}
+	}
+	if !chunked {
+		return
+	}
+
+	if _, err := w.WriteChunkedBodyDone(); err != nil {
+		return
+	}
+	trailers := make(headers.Headers)
+	for _, k := range trailerKeys {
+		if vs := resp.Trailer[k]; len(vs) > 0 {
+			trailers[k] = strings.Join(vs, ", ")
+		}
+	}
+	w.WriteTrailers(trailers)
+}
+
+func gatewayStatus(err error) response.StatusCode {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return response.StatusGatewayTimeout
+	}
+	return response.StatusBadGateway
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, err error) {
+	body := fmt.Appendf(nil, "%v\n", err)
+	w.WriteRequestLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
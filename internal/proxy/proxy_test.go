@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip sends one request through handler and parses what it wrote back.
+func roundTrip(t *testing.T, handler server.Handler, req *request.Request) (*http.Response, string) {
+	t.Helper()
+	if req.Headers == nil {
+		req.Headers = headers.Headers{}
+	}
+	req.Headers["host"] = "proxy.example"
+	if req.RemoteAddr == "" {
+		req.RemoteAddr = "192.0.2.10:54321"
+	}
+
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetKeepAlive(true)
+	w.SetMethod(req.RequestLine.Method)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(buf), &http.Request{Method: req.RequestLine.Method})
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func newRequest(method, target string, h headers.Headers, body string) *request.Request {
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        []byte(body),
+	}
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+func TestProxyForwardsRequest(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		rw.Header().Set("Connection", "X-Upstream-Hop")
+		rw.Header().Set("X-Upstream-Hop", "secret")
+		rw.Header().Set("X-Upstream", "yes")
+		rw.Header().Add("Set-Cookie", "a=1; Path=/")
+		rw.Header().Add("Set-Cookie", "b=2; HttpOnly")
+		rw.WriteHeader(http.StatusCreated)
+		io.WriteString(rw, "created")
+	}))
+	defer upstream.Close()
+
+	handler := Handler(mustParse(t, upstream.URL+"/base?key=1"))
+	resp, body := roundTrip(t, handler, newRequest("POST", "/items/a%2Fb?x=y", headers.Headers{
+		"content-type":    "application/json",
+		"content-length":  "13",
+		"connection":      "X-Client-Hop",
+		"x-client-hop":    "secret",
+		"keep-alive":      "timeout=5",
+		"x-forwarded-for": "198.51.100.1",
+		"forwarded":       "for=198.51.100.1",
+		"te":              "trailers, deflate",
+	}, `{"name":"a"}`+"\n"))
+
+	// Test: Method, path, query, headers and body reach the upstream
+	require.NotNil(t, got)
+	assert.Equal(t, "POST", got.Method)
+	assert.Equal(t, "/base/items/a%2Fb", got.URL.EscapedPath())
+	assert.Equal(t, "key=1&x=y", got.URL.RawQuery)
+	assert.Equal(t, "application/json", got.Header.Get("Content-Type"))
+	assert.Equal(t, `{"name":"a"}`+"\n", string(gotBody))
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), got.Host)
+	assert.Empty(t, got.Header.Get("User-Agent"))
+
+	// Test: Hop-by-hop headers are stripped, except TE: trailers
+	assert.Empty(t, got.Header.Get("X-Client-Hop"))
+	assert.Empty(t, got.Header.Get("Keep-Alive"))
+	assert.Equal(t, "trailers", got.Header.Get("Te"))
+
+	// Test: The client is appended to the forwarding headers
+	assert.Equal(t, "198.51.100.1, 192.0.2.10", got.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "for=198.51.100.1, for=192.0.2.10;host=proxy.example;proto=http", got.Header.Get("Forwarded"))
+	assert.Equal(t, "proxy.example", got.Header.Get("X-Forwarded-Host"))
+	assert.Equal(t, "http", got.Header.Get("X-Forwarded-Proto"))
+
+	// Test: Upstream status, headers and cookies come back
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "created", body)
+	assert.Equal(t, "yes", resp.Header.Get("X-Upstream"))
+	assert.Empty(t, resp.Header.Get("X-Upstream-Hop"))
+	assert.ElementsMatch(t, []string{"a=1; Path=/", "b=2; HttpOnly"}, resp.Header.Values("Set-Cookie"))
+	assert.Equal(t, int64(7), resp.ContentLength)
+
+	// Test: A request that came in over TLS is forwarded as https
+	req := newRequest("GET", "/", nil, "")
+	req.TLS = &tls.ConnectionState{HandshakeComplete: true}
+	roundTrip(t, handler, req)
+	assert.Equal(t, "https", got.Header.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "for=192.0.2.10;host=proxy.example;proto=https", got.Header.Get("Forwarded"))
+}
+
+func TestProxyStreamsTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.WriteHeader(http.StatusOK)
+		io.WriteString(rw, "part one, ")
+		rw.(http.Flusher).Flush()
+		io.WriteString(rw, "part two")
+		rw.Header().Set("X-Checksum", "abc123")
+	}))
+	defer upstream.Close()
+
+	// Test: Trailers are passed through on a chunked body
+	resp, body := roundTrip(t, Handler(mustParse(t, upstream.URL)), newRequest("GET", "/stream", nil, ""))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, "part one, part two", body)
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+
+	// Test: HEAD gets the headers but no body
+	resp, body = roundTrip(t, Handler(mustParse(t, upstream.URL)), newRequest("HEAD", "/stream", nil, ""))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+}
+
+func TestProxyHooks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Server", "upstream/1.0")
+		io.WriteString(rw, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	handler := Handler(mustParse(t, upstream.URL),
+		WithRewrite(func(out *http.Request, in *request.Request) {
+			out.URL.Path = strings.TrimPrefix(out.URL.Path, "/api")
+			out.URL.RawPath = ""
+		}),
+		WithModifyResponse(func(resp *http.Response) error {
+			resp.Header.Del("Server")
+			resp.Header.Set("X-Proxied", "1")
+			return nil
+		}),
+	)
+
+	// Test: Rewrite and response hooks run
+	resp, body := roundTrip(t, handler, newRequest("GET", "/api/users", nil, ""))
+	assert.Equal(t, "/users", body)
+	assert.Empty(t, resp.Header.Get("Server"))
+	assert.Equal(t, "1", resp.Header.Get("X-Proxied"))
+
+	// Test: A failing response hook gives 502
+	handler = Handler(mustParse(t, upstream.URL), WithModifyResponse(func(resp *http.Response) error {
+		return assert.AnError
+	}))
+	resp, _ = roundTrip(t, handler, newRequest("GET", "/", nil, ""))
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	target := mustParse(t, upstream.URL)
+	upstream.Close()
+
+	// Test: An unreachable upstream gives 502
+	resp, _ := roundTrip(t, Handler(target), newRequest("GET", "/", nil, ""))
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
@@ -0,0 +1,51 @@
+package request
+
+import (
+	"httpfromtcp/internal/headers"
+	"strings"
+)
+
+type Cookie struct {
+	Name  string
+	Value string
+}
+
+// Cookies parses the Cookie header into name/value pairs in the order the client sent them.
+// Pairs are separated by semicolons. Clients that send several Cookie lines end up with them
+// folded together with commas, and since a comma can never appear in a cookie, commas are
+// treated as separators too. Malformed pairs are skipped rather than failing the whole header.
+func (r *Request) Cookies() []Cookie {
+	val, ok := r.Headers["cookie"]
+	if !ok {
+		return nil
+	}
+
+	cookies := make([]Cookie, 0)
+	parts := strings.FieldsFunc(val, func(ch rune) bool {
+		return ch == ';' || ch == ','
+	})
+	for _, part := range parts {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found || !headers.IsCookieNameCorrect(name) {
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if !headers.IsCookieValueCorrect(value) {
+			continue
+		}
+		cookies = append(cookies, Cookie{Name: name, Value: value})
+	}
+	return cookies
+}
+
+// Cookie returns the value of the first cookie with the given name.
+func (r *Request) Cookie(name string) (string, bool) {
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == name {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
@@ -1,10 +1,14 @@
 package request
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -12,11 +16,38 @@ import (
 
 const bufferSize = 8
 
+var (
+	ErrHttpVersionNotSupported = errors.New("http version not supported")
+	ErrExpectationFailed       = errors.New("expectation failed")
+	// ErrTransferEncodingNotImplemented is returned for requests that send a Transfer-Encoding.
+	// Their bodies are not decoded, and taking the framing as anything else would let a proxy
+	// in front of the server see a different request boundary than the server does.
+	ErrTransferEncodingNotImplemented = errors.New("transfer-encoding not implemented")
+)
+
 type Request struct {
 	RequestLine RequestLine 
 	Headers     headers.Headers 
 	Body        []byte 
 	ParserState string 
+
+	// RemoteAddr is the address of the client that sent the request, as the server's
+	// connection reports it. It is empty for requests that did not come off a connection.
+	RemoteAddr string
+	// LocalAddr is the server's own address the request came in on, which tells apart
+	// requests that arrive on different interfaces or ports.
+	LocalAddr string
+	// TLS describes the TLS session the request came over, with the negotiated version,
+	// cipher suite, ALPN protocol and server name. It is nil for plain-text connections.
+	TLS *tls.ConnectionState
+	// ConnSeq counts the requests on the connection this one came over, starting at 1, so a
+	// value above 1 means the connection was kept alive from an earlier request.
+	ConnSeq int
+
+	ctx            context.Context
+	expectContinue bool
+	reader         *Reader
+	bodyErr        error
 }
 
 type RequestLine struct {
@@ -31,6 +62,10 @@ type RequestLine struct {
  well, our code is agnostic) into our program. When we parse, we're taking that data and 
  interpreting it (moving it from a []byte to a RequestLine struct). Once its parsed, we can 
  discard it from the buffer to save memory.
+
+ RequestFromReader expects the reader to hold exactly one request, so bytes that arrive along
+ with it past a declared Content-Length are an error. Use a Reader to pull several requests off
+ the same connection.
 */
 func RequestFromReader(reader io.Reader) (*Request, error) {
 	if conn, ok := reader.(net.Conn); ok {
@@ -38,63 +73,249 @@ func RequestFromReader(reader io.Reader) (*Request, error) {
         defer conn.SetReadDeadline(time.Time{}) 
     }
 
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
-	request := Request{
+	rr := NewReader(reader)
+	request, err := rr.ReadRequest()
+	if err == io.EOF {
+		return nil, fmt.Errorf("incomplete http request, please check method and headers")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	val, ok := request.Headers["content-length"]
+	if !ok {
+		return request, nil
+	}
+	// Only bytes that already arrived are checked: a client waiting for its response sends
+	// nothing more, so another read would just sit out the deadline.
+	if rr.readToIndex > 0 {
+		return nil, fmt.Errorf("request body is longer than content-limit %s", val)
+	}
+	return request, nil
+}
+
+// Reader parses consecutive requests off a single connection. Bytes read past the end of one
+// request stay in the buffer for the next one, which is what lets a keep-alive connection carry
+// more than one request.
+type Reader struct {
+	reader      io.Reader
+	buf         []byte
+	readToIndex int
+	continueFn  func() error
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf:    make([]byte, bufferSize),
+	}
+}
+
+// OnContinue registers the function that sends "100 Continue" to the client. Once it is set,
+// requests carrying "Expect: 100-continue" come back from ReadRequest with their body still
+// unread, and the function runs the first time the handler calls ReadBody. Without it bodies
+// are always read up front.
+func (rr *Reader) OnContinue(fn func() error) {
+	rr.continueFn = fn
+}
+
+// Buffered returns the bytes read off the connection that no request has claimed yet. Whoever
+// takes over the connection after a request, as a CONNECT tunnel does, has to pass them on.
+func (rr *Reader) Buffered() []byte {
+	return rr.buf[:rr.readToIndex]
+}
+
+// ReadRequest reads the next request from the connection. It returns io.EOF if the connection
+// was closed cleanly before the first byte of a new request arrived.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	request := &Request{
 		ParserState: "PARSING_METHOD",
 		Headers:     make(headers.Headers),
 		Body:        make([]byte, 0),
 	}
 
-	for request.ParserState != "PARSING_DONE" {
-		if readToIndex == cap(buf) {
-			newBuf := make([]byte, 2*cap(buf))
-			copy(newBuf, buf)
-			buf = newBuf 
-		}
+	if err := rr.parseUntil(request, "PARSING_BODY"); err != nil {
+		return nil, err
+	}
+	if err := request.parseExpect(); err != nil {
+		return nil, err
+	}
+	if request.expectContinue && rr.continueFn != nil {
+		request.reader = rr
+		return request, nil
+	}
+	request.expectContinue = false
 
-		bytesRead, err := reader.Read(buf[readToIndex:])
-		if err == io.EOF {
-			_, err := request.parse(buf[:readToIndex])
-			if err != nil {
-				return nil, err 
-			}
+	if err := rr.parseUntil(request, "PARSING_DONE"); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
 
-			if request.ParserState != "PARSING_BODY" && request.ParserState != "PARSING_DONE" {
-				return nil, fmt.Errorf("incomplete http request, please check method and headers")
+// parseUntil feeds buffered bytes to the parser, reading more from the connection whenever it
+// runs dry, until the request reaches the given state.
+func (rr *Reader) parseUntil(request *Request, parserState string) error {
+	for {
+		for request.ParserState != parserState {
+			state := request.ParserState
+			bytesParsed, err := request.parse(rr.buf[:rr.readToIndex])
+			if err != nil {
+				return err
 			}
-			
-			val, ok := request.Headers["content-length"]
-			if !ok {
-				return &request, nil 
+			rr.discard(bytesParsed)
+			if bytesParsed == 0 && state == request.ParserState {
+				break
 			}
+		}
+		if request.ParserState == parserState {
+			return nil
+		}
 
-			contentLength, _ := strconv.Atoi(val)
-			if len(request.Body) < contentLength {
-				return nil, fmt.Errorf("request body is shorter than content-limit %d", contentLength)
-			}
-			if len(request.Body) > contentLength {
-				return nil, fmt.Errorf("request body is longer than content-limit %d", contentLength)
-			}
-			
-			request.ParserState = "PARSING_DONE"
-			return &request, nil 
-		} 
-		readToIndex += bytesRead
-
-		bytesParsed, err := request.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err 
+		if rr.readToIndex == len(rr.buf) {
+			newBuf := make([]byte, 2*len(rr.buf))
+			copy(newBuf, rr.buf)
+			rr.buf = newBuf
+		}
+
+		bytesRead, err := rr.reader.Read(rr.buf[rr.readToIndex:])
+		rr.readToIndex += bytesRead
+		if err == io.EOF && bytesRead == 0 {
+			return request.errAtEOF(rr.readToIndex)
 		}
-		if bytesParsed != 0 {
-			newBuf := make([]byte, cap(buf))
-			copy(newBuf, buf[bytesParsed:])
-			buf = newBuf
-			readToIndex -= bytesParsed
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+}
+
+func (rr *Reader) discard(n int) {
+	if n == 0 {
+		return
+	}
+	copy(rr.buf, rr.buf[n:rr.readToIndex])
+	rr.readToIndex -= n
+}
+
+func (r *Request) errAtEOF(buffered int) error {
+	switch r.ParserState {
+	case "PARSING_METHOD":
+		if buffered == 0 {
+			return io.EOF
 		}
+		return fmt.Errorf("incomplete http request, please check method and headers")
+	case "PARSING_HEADERS":
+		return fmt.Errorf("incomplete http request, please check method and headers")
+	default:
+		contentLength, _ := r.contentLength()
+		return fmt.Errorf("request body is shorter than content-limit %d", contentLength)
+	}
+}
+
+// Context returns the request's context. For requests served by the server it is cancelled
+// when the client disconnects, the server shuts down, the handler's deadline passes or the
+// handler returns, whichever comes first; context.Cause says which. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r that carries ctx instead, which is how middleware
+// attaches request-scoped values or a tighter deadline before calling the next handler.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
+}
+
+// KeepAlive reports whether the client asked for the connection to stay open after this
+// request. HTTP/1.1 connections are persistent unless the client sends "Connection: close";
+// HTTP/1.0 connections close unless the client opts in with "Connection: keep-alive".
+func (r *Request) KeepAlive() bool {
+	if r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue" and is still waiting
+// for the go-ahead. A handler that wants to turn the upload down can answer 417 or 413 without
+// calling ReadBody, and the client never sends the body.
+func (r *Request) ExpectsContinue() bool {
+	return r.expectContinue
+}
+
+// ReadBody returns the request body. If the client is waiting on "100 Continue" it is sent
+// first and the body is read off the connection, otherwise the body was read along with the
+// headers and is returned as is.
+//
+// If the body cannot be had, because "100 Continue" could not be sent or the connection failed
+// while reading, the error is returned on this and every later call.
+func (r *Request) ReadBody() ([]byte, error) {
+	if r.bodyErr != nil {
+		return nil, r.bodyErr
+	}
+	if !r.expectContinue {
+		return r.Body, nil
+	}
+	r.expectContinue = false
+
+	if err := r.reader.continueFn(); err != nil {
+		r.bodyErr = fmt.Errorf("sending 100 continue: %w", err)
+		return nil, r.bodyErr
 	}
+	if err := r.reader.parseUntil(r, "PARSING_DONE"); err != nil {
+		r.bodyErr = err
+		return nil, err
+	}
+	return r.Body, nil
+}
+
+// parseExpect checks the Expect header. The only expectation defined is 100-continue, and
+// HTTP/1.0 clients never wait for it, so it is ignored on those.
+func (r *Request) parseExpect() error {
+	val, ok := r.Headers["expect"]
+	if !ok || r.RequestLine.HttpVersion == "1.0" {
+		return nil
+	}
+	if !strings.EqualFold(val, "100-continue") {
+		return fmt.Errorf("%w: %s", ErrExpectationFailed, val)
+	}
+	if contentLength, ok := r.contentLength(); ok && contentLength != 0 {
+		r.expectContinue = true
+	}
+	return nil
+}
+
+// ContentType parses the Content-Type header into its media type and parameters.
+func (r *Request) ContentType() (headers.MediaType, error) {
+	return r.Headers.ContentType()
+}
 
-	return &request, nil
+// ContentLength returns the declared length of the body. It wraps headers.ErrHeaderMissing if
+// the client did not send one.
+func (r *Request) ContentLength() (int, error) {
+	return r.Headers.ContentLength()
+}
+
+// contentLength is the parser's view of ContentLength: whether a length was declared at all,
+// and -1 if it was declared but malformed.
+func (r *Request) contentLength() (int, bool) {
+	contentLength, err := r.Headers.ContentLength()
+	if errors.Is(err, headers.ErrHeaderMissing) {
+		return 0, false
+	}
+	if err != nil {
+		return -1, true
+	}
+	return contentLength, true
 }
 
 func (r *Request) parse(data []byte) (int, error) {
@@ -118,19 +339,33 @@ func (r *Request) parse(data []byte) (int, error) {
 			} else if !done {
 				return bytesParsed, nil
 			} else {
+				if err := r.checkHost(); err != nil {
+					return -1, err
+				}
+				if err := r.checkTransferEncoding(); err != nil {
+					return -1, err
+				}
 				r.ParserState = "PARSING_BODY"
 				return bytesParsed, nil 
 			}
 		case "PARSING_BODY":
-			_, ok := r.Headers["content-length"]
+			contentLength, ok := r.contentLength()
 			if !ok {
 				r.ParserState = "PARSING_DONE"
 				return 0, nil 
 			}
-			newLength := len(r.Body)+len(data)
-			r.Body = append(r.Body, data...)
-			r.Body = r.Body[:newLength]
-			return len(data), nil 
+			if contentLength < 0 {
+				return -1, fmt.Errorf("content-length is incorrect")
+			}
+			remaining := contentLength - len(r.Body)
+			if remaining > len(data) {
+				remaining = len(data)
+			}
+			r.Body = append(r.Body, data[:remaining]...)
+			if len(r.Body) == contentLength {
+				r.ParserState = "PARSING_DONE"
+			}
+			return remaining, nil 
 		default:
 			return -1, fmt.Errorf("unknown state")
 	}
@@ -149,18 +384,14 @@ func (r *Request) parseRequestLine(line string) (int, error) {
 	}
 
 	method := parts2[0]
-	if !isMethodCorrect(method) {
-		return -1, fmt.Errorf("method name is incorrect")
-	}
-
 	requestTarget := parts2[1]
-	if !isTargetCorrect(requestTarget) {
-		return -1, fmt.Errorf("request target is incorrect")
+	if err := CheckTarget(method, requestTarget); err != nil {
+		return -1, err
 	}
 
 	httpVersion := parts2[2]
-	if !isHttpVersionCorrect(httpVersion) {
-		return -1, fmt.Errorf("http version is incorrect")
+	if err := checkHttpVersion(httpVersion); err != nil {
+		return -1, err
 	}
 
 	requestLine := RequestLine{
@@ -173,8 +404,57 @@ func (r *Request) parseRequestLine(line string) (int, error) {
 	return clrfIndex + 2, nil
 }
 
+// CheckTarget checks a method and request target the way the parser checks a request line, for
+// requests that reach the server some other way, such as on an HTTP/2 stream, or that are about
+// to be written.
+func CheckTarget(method, target string) error {
+	if !isMethodCorrect(method) {
+		return fmt.Errorf("method name is incorrect")
+	}
+	// The request line parser never hands over a target with spaces in it, having split on
+	// them, but targets from anywhere else may carry whitespace or control characters.
+	if strings.IndexFunc(target, func(ch rune) bool { return ch <= ' ' || ch == 0x7f }) >= 0 {
+		return fmt.Errorf("request target is incorrect")
+	}
+
+	targetCorrect := false
+	switch {
+	case method == "CONNECT":
+		targetCorrect = isAuthorityCorrect(target)
+	case IsAbsoluteForm(target):
+		targetCorrect = isAbsoluteTargetCorrect(target)
+	default:
+		targetCorrect = isTargetCorrect(target)
+	}
+	if !targetCorrect {
+		return fmt.Errorf("request target is incorrect")
+	}
+	return nil
+}
+
+// IsAbsoluteForm reports whether a request target is in absolute form, that is it begins with
+// a scheme followed by "://" (RFC 3986 section 3.1). Origin-form targets begin with "/" and stay
+// in origin form whatever their query holds, as in "/login?next=http://example.com".
+func IsAbsoluteForm(target string) bool {
+	scheme, _, ok := strings.Cut(target, "://")
+	if !ok || scheme == "" || !isAlpha(scheme[0]) {
+		return false
+	}
+	for i := 1; i < len(scheme); i++ {
+		c := scheme[i]
+		if !isAlpha(c) && !('0' <= c && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
 func isMethodCorrect(method string) bool {
-	if method != "GET" && method != "POST" && method != "PUT" && method != "PATCH" && method != "DELETE" {
+	if method != "GET" && method != "HEAD" && method != "POST" && method != "PUT" && method != "PATCH" && method != "DELETE" && method != "CONNECT" {
 		return false
 	}
 	return true 
@@ -193,9 +473,12 @@ func isTargetCorrect(target string) bool {
 		return false
 	}
 
-	parts := strings.Split(target[1:], "/")
-	for _, part := range parts {
-		if len(part) == 0 {
+	path, _, _ := strings.Cut(target, "?")
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		// A trailing slash is how directory URLs are written, so only the last part may be
+		// empty.
+		if len(part) == 0 && i != len(parts)-1 {
 			return false
 		}
 	}
@@ -203,18 +486,97 @@ func isTargetCorrect(target string) bool {
 	return true
 }
 
-func isHttpVersionCorrect(httpVersion string) bool {
+// isAbsoluteTargetCorrect checks the absolute form that clients send to a forward proxy, such
+// as "http://example.com/index.html" (RFC 9112 section 3.2.2). User info is refused, as the
+// RFC asks.
+func isAbsoluteTargetCorrect(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return false
+	}
+	if strings.Contains(target, "#") {
+		return false
+	}
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path == "" || isTargetCorrect(path)
+}
+
+// isAuthorityCorrect checks the "host:port" form that is only used with CONNECT (RFC 9112
+// section 3.2.3).
+func isAuthorityCorrect(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@") {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// checkHost enforces RFC 9112 section 3.2: an HTTP/1.1 request must carry exactly one Host
+// header. Repeated headers get folded into one comma separated value by the headers parser, and
+// since a host never contains a comma that is how a second Host line shows up here.
+func (r *Request) checkHost() error {
+	host, ok := r.Headers["host"]
+	if !ok {
+		if r.RequestLine.HttpVersion == "1.0" {
+			return nil
+		}
+		return fmt.Errorf("host header is missing")
+	}
+	if strings.Contains(host, ",") {
+		return fmt.Errorf("host header is repeated")
+	}
+	return nil
+}
+
+// checkTransferEncoding refuses every request with a Transfer-Encoding, since only bodies
+// delimited by Content-Length are read. A request with both is refused as malformed outright
+// (RFC 9112 section 6.3), as that is the shape request smuggling takes.
+func (r *Request) checkTransferEncoding() error {
+	te, ok := r.Headers["transfer-encoding"]
+	if !ok {
+		return nil
+	}
+	if _, ok := r.Headers["content-length"]; ok {
+		return fmt.Errorf("request has both transfer-encoding and content-length")
+	}
+	return fmt.Errorf("%w: %s", ErrTransferEncodingNotImplemented, te)
+}
+
+// checkHttpVersion accepts HTTP/1.0 and HTTP/1.1. A well formed version with a major number of 2
+// or more gets ErrHttpVersionNotSupported so the server can answer 505 rather than 400.
+func checkHttpVersion(httpVersion string) error {
 	cnt := strings.Count(httpVersion, "/")
 	if cnt != 1 {
-		return false
+		return fmt.Errorf("http version is incorrect")
 	}
 
 	parts := strings.Split(httpVersion, "/")
 
 	protocol := parts[0]
 	if protocol != "HTTP" {
-		return false
+		return fmt.Errorf("http version is incorrect")
+	}
+
+	version := parts[1]
+	if version == "1.0" || version == "1.1" {
+		return nil
 	}
 
-	return parts[1] == "1.1" 
+	numbers := strings.Split(version, ".")
+	if len(numbers) != 2 || len(numbers[0]) != 1 || len(numbers[1]) != 1 {
+		return fmt.Errorf("http version is incorrect")
+	}
+	major, err1 := strconv.Atoi(numbers[0])
+	_, err2 := strconv.Atoi(numbers[1])
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("http version is incorrect")
+	}
+	if major >= 2 {
+		return fmt.Errorf("%w: %s", ErrHttpVersionNotSupported, httpVersion)
+	}
+	return fmt.Errorf("http version is incorrect")
 }
@@ -0,0 +1,54 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Write sends r to w in HTTP/1.x form, the way the parser reads it back: the request line, the
+// Host header, the other header fields, then the body framed by Content-Length. Transfer-Encoding
+// is never sent and Content-Length is worked out from the body. The request line and every field
+// go through the parser's own checks first and nothing is written if one fails, so a value
+// holding CR or LF cannot pass off the rest as more fields or a second request.
+func (r *Request) Write(w io.Writer) error {
+	if err := CheckTarget(r.RequestLine.Method, r.RequestLine.RequestTarget); err != nil {
+		return err
+	}
+	httpVersion := "HTTP/" + r.RequestLine.HttpVersion
+	if err := checkHttpVersion(httpVersion); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s\r\n", r.RequestLine.Method, r.RequestLine.RequestTarget, httpVersion)
+	keys := slices.Sorted(maps.Keys(r.Headers))
+	// Host goes first, where servers and people reading traces look for it.
+	for _, host := range []bool{true, false} {
+		for _, key := range keys {
+			if strings.EqualFold(key, "host") != host {
+				continue
+			}
+			if strings.EqualFold(key, "content-length") || strings.EqualFold(key, "transfer-encoding") {
+				continue
+			}
+			val := r.Headers[key]
+			if err := headers.CheckField(key, val); err != nil {
+				return err
+			}
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, val)
+		}
+	}
+	if _, ok := r.Headers.Get("Content-Length"); ok || len(r.Body) > 0 {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(r.Body))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(r.Body)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,60 @@
+package request
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOutgoing(method, target string, h headers.Headers, body string) *Request {
+	return &Request{
+		RequestLine: RequestLine{Method: method, RequestTarget: target, HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        []byte(body),
+	}
+}
+
+func TestRequestWrite(t *testing.T) {
+	// Test: A request is written with Host first and its body framed by Content-Length
+	buf := &bytes.Buffer{}
+	req := newOutgoing("POST", "/upload?x=1", headers.Headers{
+		"x-custom":          "value",
+		"host":              "example.test",
+		"accept":            "*/*",
+		"content-length":    "999",
+		"transfer-encoding": "chunked",
+	}, "hello")
+	require.NoError(t, req.Write(buf))
+	assert.Equal(t, "POST /upload?x=1 HTTP/1.1\r\n"+
+		"host: example.test\r\n"+
+		"accept: */*\r\n"+
+		"x-custom: value\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"hello", buf.String())
+
+	// Test: What is written parses back into the same request
+	parsed, err := RequestFromReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, req.RequestLine, parsed.RequestLine)
+	assert.Equal(t, "value", parsed.Headers["x-custom"])
+	assert.Equal(t, "hello", string(parsed.Body))
+
+	// Test: Fields and request lines the parser would refuse are not written at all
+	for name, bad := range map[string]*Request{
+		"CRLF in a value":     newOutgoing("GET", "/", headers.Headers{"host": "a", "x-evil": "1\r\nGET /admin HTTP/1.1"}, ""),
+		"LF in a value":       newOutgoing("GET", "/", headers.Headers{"host": "a", "x-evil": "1\nX-Other: 2"}, ""),
+		"space in a name":     newOutgoing("GET", "/", headers.Headers{"host": "a", "x evil": "1"}, ""),
+		"CRLF in the host":    newOutgoing("GET", "/", headers.Headers{"host": "a\r\nX-Other: 2"}, ""),
+		"space in the target": newOutgoing("GET", "/ HTTP/1.1\r\nX-Other: 2", headers.Headers{"host": "a"}, ""),
+		"unsupported version": {RequestLine: RequestLine{Method: "GET", RequestTarget: "/", HttpVersion: "2"}, Headers: headers.Headers{"host": "a"}},
+		"unsupported method":  newOutgoing("BREW", "/", headers.Headers{"host": "a"}, ""),
+	} {
+		buf := &bytes.Buffer{}
+		assert.Error(t, bad.Write(buf), name)
+		assert.Zero(t, buf.Len(), name)
+	}
+}
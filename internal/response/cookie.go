@@ -0,0 +1,157 @@
+package response
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"strings"
+	"time"
+)
+
+type SameSite int
+
+const (
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie describes a Set-Cookie header. A zero Expires and a zero MaxAge leave those attributes
+// out. A negative MaxAge deletes the cookie and is sent as "Max-Age=0".
+type Cookie struct {
+	Name     string
+	Value    string
+	Expires  time.Time
+	MaxAge   int
+	Domain   string
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+}
+
+// SetCookie queues a cookie to go out with the response headers, each on its own Set-Cookie
+// line since browsers do not accept them comma-joined. It has to be called before WriteHeaders.
+func (w *Writer) SetCookie(c *Cookie) error {
+	if w.writerState != writerStateRequestLine && w.writerState != writerStateHeaders {
+		return fmt.Errorf("cannot set cookie in state %d", w.writerState)
+	}
+
+	line, err := c.format()
+	if err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, line)
+	return nil
+}
+
+// AddSetCookie queues a Set-Cookie value that was built elsewhere, such as one a proxy got from
+// its upstream. Only characters that would break the header line are refused; the attributes
+// are passed on as they are.
+func (w *Writer) AddSetCookie(line string) error {
+	if w.writerState != writerStateRequestLine && w.writerState != writerStateHeaders {
+		return fmt.Errorf("cannot set cookie in state %d", w.writerState)
+	}
+	if !isCookieAttrCorrect(strings.ReplaceAll(line, ";", "")) {
+		return fmt.Errorf("set-cookie value %q is incorrect", line)
+	}
+	w.cookies = append(w.cookies, line)
+	return nil
+}
+
+func (c *Cookie) format() (string, error) {
+	if !headers.IsCookieNameCorrect(c.Name) {
+		return "", fmt.Errorf("cookie name %q is incorrect", c.Name)
+	}
+	if !isCookieValueCorrect(c.Value) {
+		return "", fmt.Errorf("cookie value for %q is incorrect", c.Name)
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + c.Value)
+
+	if c.Path != "" {
+		if !isCookieAttrCorrect(c.Path) {
+			return "", fmt.Errorf("cookie path %q is incorrect", c.Path)
+		}
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		domain := strings.TrimPrefix(c.Domain, ".")
+		if !isCookieDomainCorrect(domain) {
+			return "", fmt.Errorf("cookie domain %q is incorrect", c.Domain)
+		}
+		b.WriteString("; Domain=" + domain)
+	}
+	if !c.Expires.IsZero() {
+		if c.Expires.Year() < 1601 {
+			return "", fmt.Errorf("cookie expiry %v is incorrect", c.Expires)
+		}
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		fmt.Fprintf(&b, "; Max-Age=%d", c.MaxAge)
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+
+	switch c.SameSite {
+	case SameSiteDefault:
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		// Browsers drop SameSite=None cookies that are not also Secure.
+		if !c.Secure {
+			return "", fmt.Errorf("cookie %q with SameSite=None must be Secure", c.Name)
+		}
+		b.WriteString("; SameSite=None")
+	default:
+		return "", fmt.Errorf("cookie same site %d is incorrect", c.SameSite)
+	}
+	return b.String(), nil
+}
+
+// isCookieValueCorrect checks a cookie value the way headers.IsCookieValueCorrect does, allowing
+// it to be wrapped in double quotes.
+func isCookieValueCorrect(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return headers.IsCookieValueCorrect(value)
+}
+
+func isCookieAttrCorrect(value string) bool {
+	for _, ch := range value {
+		if ch < ' ' || ch >= 0x7f || ch == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+func isCookieDomainCorrect(domain string) bool {
+	if len(domain) == 0 || len(domain) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			isLetter := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+			isDigit := ch >= '0' && ch <= '9'
+			if !isLetter && !isDigit && ch != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
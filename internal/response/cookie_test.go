@@ -0,0 +1,68 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetCookie(t *testing.T) {
+	// Test: Every attribute, and each cookie on its own line
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.SetCookie(&Cookie{
+		Name:     "session",
+		Value:    "abc123",
+		Expires:  time.Date(2030, time.January, 2, 15, 4, 5, 0, time.UTC),
+		MaxAge:   3600,
+		Domain:   ".example.com",
+		Path:     "/app",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: SameSiteNone,
+	}))
+	require.NoError(t, w.SetCookie(&Cookie{Name: "theme", Value: "dark", SameSite: SameSiteLax}))
+	require.NoError(t, w.SetCookie(&Cookie{Name: "old", MaxAge: -1}))
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "0"}))
+
+	out := buf.String()
+	assert.Contains(t, out, "Set-Cookie: session=abc123; Path=/app; Domain=example.com; "+
+		"Expires=Wed, 02 Jan 2030 15:04:05 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None\r\n")
+	assert.Contains(t, out, "Set-Cookie: theme=dark; SameSite=Lax\r\n")
+	assert.Contains(t, out, "Set-Cookie: old=; Max-Age=0\r\n")
+	assert.Equal(t, 3, strings.Count(out, "Set-Cookie:"))
+
+	// Test: Too late once the headers are out
+	assert.Error(t, w.SetCookie(&Cookie{Name: "late", Value: "1"}))
+
+	// Test: Invalid names, values and attributes
+	w = NewWriter(&bytes.Buffer{})
+	assert.Error(t, w.SetCookie(&Cookie{Name: "", Value: "x"}))
+	assert.Error(t, w.SetCookie(&Cookie{Name: "bad name", Value: "x"}))
+	assert.Error(t, w.SetCookie(&Cookie{Name: "a", Value: "semi;colon"}))
+	assert.Error(t, w.SetCookie(&Cookie{Name: "a", Value: "x", Path: "/a;b"}))
+	assert.Error(t, w.SetCookie(&Cookie{Name: "a", Value: "x", Domain: "exa mple.com"}))
+	assert.Error(t, w.SetCookie(&Cookie{Name: "a", Value: "x", SameSite: SameSiteNone}))
+	assert.Error(t, w.SetCookie(&Cookie{Name: "a", Value: "x", SameSite: SameSite(42)}))
+}
+
+func TestAddSetCookie(t *testing.T) {
+	// Test: Prebuilt values go out untouched, each on its own line
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.AddSetCookie("a=1; Path=/; Partitioned"))
+	require.NoError(t, w.AddSetCookie("b=2"))
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "0"}))
+	assert.Contains(t, buf.String(), "Set-Cookie: a=1; Path=/; Partitioned\r\nSet-Cookie: b=2\r\n")
+
+	// Test: Line breaks cannot sneak in another header
+	w = NewWriter(&bytes.Buffer{})
+	assert.Error(t, w.AddSetCookie("a=1\r\nX-Injected: yes"))
+}
@@ -3,12 +3,30 @@ package response
 import (
 	"fmt"
 	"httpfromtcp/internal/headers"
+	"time"
 )
 
+// TimeFormat is the IMF-fixdate layout RFC 9110 requires for dates in headers. Times must be
+// in UTC before formatting.
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// ParseTime parses an HTTP date. Besides TimeFormat, RFC 9110 section 5.6.7 asks recipients to
+// accept the obsolete RFC 850 and asctime layouts.
+func ParseTime(val string) (time.Time, error) {
+	for _, layout := range []string{TimeFormat, "Monday, 02-Jan-06 15:04:05 GMT", "Mon Jan _2 15:04:05 2006"} {
+		t, err := time.Parse(layout, val)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("http date %q is incorrect", val)
+}
+
+// GetDefaultHeaders leaves out the Connection header on purpose: the Writer fills it in from
+// what the client asked for and how the body is framed.
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	h := make(headers.Headers)
 	h["Content-Length"] = fmt.Sprintf("%d", contentLen)
-	h["Connection"] = "close"
 	h["Content-Type"] = "text/plain"
 	return h
 }
@@ -0,0 +1,392 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	bufferSize = 1024
+	// maxHeaderBytes bounds the status line and header section of a response, and separately
+	// its trailer section, so a server cannot make the reader buffer without end.
+	maxHeaderBytes = 1 << 20
+	// DefaultMaxBodyBytes bounds a response body, which is held in memory whole, unless
+	// WithMaxBodyBytes says otherwise.
+	DefaultMaxBodyBytes = 10 << 20
+)
+
+var (
+	ErrHeaderTooLarge = errors.New("response header section is too large")
+	ErrBodyTooLarge   = errors.New("response body is too large")
+)
+
+type Response struct {
+	StatusLine StatusLine
+	Headers    headers.Headers
+	// SetCookies holds the Set-Cookie field values one by one. Unlike other fields they cannot
+	// be joined with commas, so they are kept out of Headers.
+	SetCookies []string
+	Body       []byte
+	// Trailers holds the fields sent after a chunked body.
+	Trailers    headers.Headers
+	ParserState string
+
+	method         string
+	maxBodyBytes   int
+	headerBytes    int
+	chunkRemaining int
+	closeDelimited bool
+}
+
+type StatusLine struct {
+	HttpVersion  string
+	StatusCode   StatusCode
+	ReasonPhrase string
+}
+
+// ResponseFromReader is the counterpart of request.RequestFromReader: it expects the reader to
+// hold exactly one response to a request with the given method, so bytes left over past the
+// end of its body are an error. Interim 1xx responses in front of it are skipped. Use a Reader
+// to pull several responses off the same connection.
+func ResponseFromReader(reader io.Reader, method string) (*Response, error) {
+	rr := NewReader(reader)
+	for {
+		response, err := rr.ReadResponse(method)
+		if err == io.EOF {
+			return nil, fmt.Errorf("incomplete http response, please check status line and headers")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if response.isInterim() {
+			continue
+		}
+
+		if response.closeDelimited {
+			return response, nil
+		}
+		if rr.readToIndex == 0 {
+			rr.readToIndex, _ = reader.Read(rr.buf)
+		}
+		if rr.readToIndex > 0 {
+			return nil, fmt.Errorf("response continues past the end of its body")
+		}
+		return response, nil
+	}
+}
+
+// Reader parses consecutive responses off a single connection, the way request.Reader does
+// requests. Bytes read past the end of one response stay in the buffer for the next one.
+type Reader struct {
+	reader       io.Reader
+	buf          []byte
+	readToIndex  int
+	maxBodyBytes int
+}
+
+type ReaderOption func(*Reader)
+
+// WithMaxBodyBytes sets how big a response body may be. Reading one that is bigger fails with
+// ErrBodyTooLarge, as soon as its length is known or once it has grown past the limit.
+func WithMaxBodyBytes(n int) ReaderOption {
+	return func(rr *Reader) {
+		rr.maxBodyBytes = n
+	}
+}
+
+func NewReader(reader io.Reader, opts ...ReaderOption) *Reader {
+	rr := &Reader{
+		reader:       reader,
+		buf:          make([]byte, bufferSize),
+		maxBodyBytes: DefaultMaxBodyBytes,
+	}
+	for _, opt := range opts {
+		opt(rr)
+	}
+	return rr
+}
+
+// Buffered returns the bytes read off the connection that no response has claimed yet.
+func (rr *Reader) Buffered() []byte {
+	return rr.buf[:rr.readToIndex]
+}
+
+// ReadResponse reads the next response, which answers a request with the given method: the
+// response to a HEAD request has no body whatever its headers say. Interim 1xx responses are
+// returned like any other, and the caller reads again for the final one. It returns io.EOF if
+// the connection was closed cleanly before the first byte of a new response arrived.
+func (rr *Reader) ReadResponse(method string) (*Response, error) {
+	response := &Response{
+		ParserState:  "PARSING_STATUS_LINE",
+		Headers:      make(headers.Headers),
+		Trailers:     make(headers.Headers),
+		Body:         make([]byte, 0),
+		method:       method,
+		maxBodyBytes: rr.maxBodyBytes,
+	}
+	if err := rr.parseUntil(response, "PARSING_DONE"); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// parseUntil feeds buffered bytes to the parser, reading more from the connection whenever it
+// runs dry, until the response reaches the given state. A close-delimited body ends when the
+// connection does.
+func (rr *Reader) parseUntil(response *Response, parserState string) error {
+	for {
+		for response.ParserState != parserState {
+			state := response.ParserState
+			bytesParsed, err := response.parse(rr.buf[:rr.readToIndex])
+			if err != nil {
+				return err
+			}
+			rr.discard(bytesParsed)
+			if bytesParsed == 0 && state == response.ParserState {
+				break
+			}
+		}
+		if response.ParserState == parserState {
+			return nil
+		}
+
+		if rr.readToIndex == len(rr.buf) {
+			newBuf := make([]byte, 2*len(rr.buf))
+			copy(newBuf, rr.buf)
+			rr.buf = newBuf
+		}
+
+		bytesRead, err := rr.reader.Read(rr.buf[rr.readToIndex:])
+		rr.readToIndex += bytesRead
+		if err == io.EOF && bytesRead == 0 {
+			if response.ParserState == "PARSING_UNTIL_CLOSE" {
+				response.ParserState = "PARSING_DONE"
+				continue
+			}
+			return response.errAtEOF(rr.readToIndex)
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+}
+
+func (rr *Reader) discard(n int) {
+	if n == 0 {
+		return
+	}
+	copy(rr.buf, rr.buf[n:rr.readToIndex])
+	rr.readToIndex -= n
+}
+
+func (r *Response) errAtEOF(buffered int) error {
+	switch r.ParserState {
+	case "PARSING_STATUS_LINE":
+		if buffered == 0 {
+			return io.EOF
+		}
+		return fmt.Errorf("incomplete http response, please check status line and headers: %w", io.ErrUnexpectedEOF)
+	case "PARSING_HEADERS":
+		return fmt.Errorf("incomplete http response, please check status line and headers: %w", io.ErrUnexpectedEOF)
+	case "PARSING_BODY":
+		contentLength, _ := r.Headers.ContentLength()
+		return fmt.Errorf("response body is shorter than content-length %d: %w", contentLength, io.ErrUnexpectedEOF)
+	default:
+		return fmt.Errorf("chunked response body is incomplete: %w", io.ErrUnexpectedEOF)
+	}
+}
+
+// KeepAlive reports whether the connection can carry another request after this response.
+// HTTP/1.1 connections are persistent unless the server sends "Connection: close"; HTTP/1.0
+// connections close unless it sends "Connection: keep-alive". A body delimited by closing the
+// connection, or a switch to another protocol, ends it either way.
+func (r *Response) KeepAlive() bool {
+	if r.closeDelimited || r.StatusLine.StatusCode == StatusSwitchingProtocols {
+		return false
+	}
+	if r.Headers.HasToken("connection", "close") {
+		return false
+	}
+	if r.StatusLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return true
+}
+
+// isInterim reports whether this is a 1xx response that comes ahead of the final one. 101
+// is final for HTTP: the connection speaks another protocol after it.
+func (r *Response) isInterim() bool {
+	code := r.StatusLine.StatusCode
+	return code >= 100 && code < 200 && code != StatusSwitchingProtocols
+}
+
+func (r *Response) parse(data []byte) (int, error) {
+	switch r.ParserState {
+	case "PARSING_STATUS_LINE":
+		bytesParsed, err := r.parseStatusLine(string(data))
+		if err != nil {
+			return -1, err
+		} else if bytesParsed == 0 {
+			return 0, r.countHeaderBytes(0, len(data))
+		}
+		r.ParserState = "PARSING_HEADERS"
+		return bytesParsed, r.countHeaderBytes(bytesParsed, 0)
+	case "PARSING_HEADERS":
+		bytesParsed, done, err := r.Headers.Parse(data)
+		if err != nil {
+			return -1, err
+		} else if bytesParsed == 0 {
+			return 0, r.countHeaderBytes(0, len(data))
+		}
+		if cookie, ok := r.Headers["set-cookie"]; ok {
+			r.SetCookies = append(r.SetCookies, cookie)
+			delete(r.Headers, "set-cookie")
+		}
+		if done {
+			r.ParserState = r.bodyState()
+			if r.ParserState == "PARSING_UNTIL_CLOSE" {
+				r.closeDelimited = true
+			}
+			r.headerBytes = 0
+			return bytesParsed, nil
+		}
+		return bytesParsed, r.countHeaderBytes(bytesParsed, 0)
+	case "PARSING_BODY":
+		contentLength, err := r.Headers.ContentLength()
+		if err != nil {
+			return -1, err
+		}
+		if contentLength > r.maxBodyBytes {
+			return -1, fmt.Errorf("%w: content-length %d", ErrBodyTooLarge, contentLength)
+		}
+		remaining := contentLength - len(r.Body)
+		if remaining > len(data) {
+			remaining = len(data)
+		}
+		r.Body = append(r.Body, data[:remaining]...)
+		if len(r.Body) == contentLength {
+			r.ParserState = "PARSING_DONE"
+		}
+		return remaining, nil
+	case "PARSING_UNTIL_CLOSE":
+		if len(r.Body)+len(data) > r.maxBodyBytes {
+			return -1, ErrBodyTooLarge
+		}
+		r.Body = append(r.Body, data...)
+		return len(data), nil
+	case "PARSING_CHUNK_SIZE":
+		clrfIndex := strings.Index(string(data), "\r\n")
+		if clrfIndex == -1 {
+			return 0, r.countHeaderBytes(0, len(data))
+		}
+		sizeField, _, _ := strings.Cut(string(data[:clrfIndex]), ";")
+		size, err := strconv.ParseUint(strings.TrimSpace(sizeField), 16, 31)
+		if err != nil {
+			return -1, fmt.Errorf("chunk size %q is incorrect", sizeField)
+		}
+		if int(size) > r.maxBodyBytes-len(r.Body) {
+			return -1, ErrBodyTooLarge
+		}
+		if size == 0 {
+			r.ParserState = "PARSING_TRAILERS"
+		} else {
+			r.chunkRemaining = int(size)
+			r.ParserState = "PARSING_CHUNK_DATA"
+		}
+		return clrfIndex + 2, nil
+	case "PARSING_CHUNK_DATA":
+		n := min(r.chunkRemaining, len(data))
+		r.Body = append(r.Body, data[:n]...)
+		r.chunkRemaining -= n
+		if r.chunkRemaining == 0 {
+			r.ParserState = "PARSING_CHUNK_END"
+		}
+		return n, nil
+	case "PARSING_CHUNK_END":
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if string(data[:2]) != "\r\n" {
+			return -1, fmt.Errorf("chunk is longer than its size")
+		}
+		r.ParserState = "PARSING_CHUNK_SIZE"
+		return 2, nil
+	case "PARSING_TRAILERS":
+		bytesParsed, done, err := r.Trailers.Parse(data)
+		if err != nil {
+			return -1, err
+		} else if bytesParsed == 0 {
+			return 0, r.countHeaderBytes(0, len(data))
+		}
+		if done {
+			r.ParserState = "PARSING_DONE"
+		}
+		return bytesParsed, r.countHeaderBytes(bytesParsed, 0)
+	default:
+		return -1, fmt.Errorf("unknown state")
+	}
+}
+
+// countHeaderBytes adds n bytes consumed from the header or trailer section to its count, and
+// checks the count against maxHeaderBytes with pending bytes of a line that has not ended yet.
+func (r *Response) countHeaderBytes(n, pending int) error {
+	r.headerBytes += n
+	if r.headerBytes+pending > maxHeaderBytes {
+		return ErrHeaderTooLarge
+	}
+	return nil
+}
+
+// parseStatusLine parses "HTTP-version SP status-code SP [reason-phrase]" (RFC 9112 section 4).
+func (r *Response) parseStatusLine(line string) (int, error) {
+	clrfIndex := strings.Index(line, "\r\n")
+	if clrfIndex == -1 {
+		return 0, nil
+	}
+	line = line[:clrfIndex]
+
+	version, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return -1, fmt.Errorf("status line %q is incorrect", line)
+	}
+	if version != "HTTP/1.1" && version != "HTTP/1.0" {
+		return -1, fmt.Errorf("http version %q is not supported", version)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	if len(code) != 3 || strings.Trim(code, "0123456789") != "" || code[0] == '0' {
+		return -1, fmt.Errorf("status code %q is incorrect", code)
+	}
+	statusCode, _ := strconv.Atoi(code)
+
+	r.StatusLine = StatusLine{
+		HttpVersion:  strings.TrimPrefix(version, "HTTP/"),
+		StatusCode:   StatusCode(statusCode),
+		ReasonPhrase: reason,
+	}
+	return clrfIndex + 2, nil
+}
+
+// bodyState works out how the body is delimited, the way RFC 9112 section 6.3 lays out: no body
+// for HEAD, 1xx, 204 and 304; chunked if the last transfer coding is chunked; Content-Length if
+// given; otherwise everything up to the server closing the connection.
+func (r *Response) bodyState() string {
+	code := r.StatusLine.StatusCode
+	if r.method == "HEAD" || code < 200 || code == StatusNoContent || code == StatusNotModified {
+		return "PARSING_DONE"
+	}
+	if te, ok := r.Headers.Get("Transfer-Encoding"); ok {
+		codings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return "PARSING_CHUNK_SIZE"
+		}
+		return "PARSING_UNTIL_CLOSE"
+	}
+	if _, ok := r.Headers.Get("Content-Length"); ok {
+		return "PARSING_BODY"
+	}
+	return "PARSING_UNTIL_CLOSE"
+}
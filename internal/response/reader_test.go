@@ -0,0 +1,329 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		method    string
+		keepAlive bool
+		write     func(w *Writer)
+		status    StatusCode
+		headers   headers.Headers
+		cookies   []string
+		body      string
+		trailers  headers.Headers
+	}{
+		{
+			name:      "content-length",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusOK)
+				w.WriteHeaders(GetDefaultHeaders(5))
+				w.WriteBody([]byte("hello"))
+			},
+			status:  StatusOK,
+			headers: headers.Headers{"content-length": "5", "content-type": "text/plain"},
+			body:    "hello",
+		},
+		{
+			name:      "chunked with trailers",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusOK)
+				w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Trailer": "X-Sum, X-Count"})
+				w.WriteChunkedBody([]byte("hello, "))
+				w.WriteChunkedBody(bytes.Repeat([]byte("w"), 5000))
+				w.WriteChunkedBodyDone()
+				w.WriteTrailers(headers.Headers{"X-Sum": "5007", "X-Count": "2"})
+			},
+			status:   StatusOK,
+			headers:  headers.Headers{"transfer-encoding": "chunked", "trailer": "X-Sum, X-Count"},
+			body:     "hello, " + strings.Repeat("w", 5000),
+			trailers: headers.Headers{"x-sum": "5007", "x-count": "2"},
+		},
+		{
+			name:      "close-delimited without a length",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusOK)
+				w.WriteHeaders(headers.Headers{"Content-Type": "text/plain"})
+				w.WriteBody([]byte("until the end"))
+			},
+			status:  StatusOK,
+			headers: headers.Headers{"content-type": "text/plain", "connection": "close"},
+			body:    "until the end",
+		},
+		{
+			name:      "chunked turned close-delimited for HTTP/1.0",
+			version:   "1.0",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusOK)
+				w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked", "Trailer": "X-Sum"})
+				w.WriteChunkedBody([]byte("one "))
+				w.WriteChunkedBody([]byte("two"))
+				w.WriteChunkedBodyDone()
+				w.WriteTrailers(headers.Headers{"X-Sum": "7"})
+			},
+			status:  StatusOK,
+			headers: headers.Headers{"connection": "close"},
+			body:    "one two",
+		},
+		{
+			name:      "HTTP/1.0 keep-alive",
+			version:   "1.0",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusNotFound)
+				w.WriteHeaders(GetDefaultHeaders(0))
+			},
+			status:  StatusNotFound,
+			headers: headers.Headers{"content-length": "0", "content-type": "text/plain", "connection": "keep-alive"},
+		},
+		{
+			name: "connection close",
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusBadRequest)
+				w.WriteHeaders(GetDefaultHeaders(3))
+				w.WriteBody([]byte("bad"))
+			},
+			status:  StatusBadRequest,
+			headers: headers.Headers{"content-length": "3", "content-type": "text/plain", "connection": "close"},
+			body:    "bad",
+		},
+		{
+			name:      "HEAD",
+			method:    "HEAD",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusOK)
+				w.WriteHeaders(GetDefaultHeaders(100))
+				w.WriteBody(bytes.Repeat([]byte("x"), 100))
+			},
+			status:  StatusOK,
+			headers: headers.Headers{"content-length": "100", "content-type": "text/plain"},
+		},
+		{
+			name:      "not modified",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusNotModified)
+				w.WriteHeaders(headers.Headers{"ETag": `"v1"`})
+			},
+			status:  StatusNotModified,
+			headers: headers.Headers{"etag": `"v1"`},
+		},
+		{
+			name:      "cookies and vary",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteRequestLine(StatusOK)
+				w.AddSetCookie("id=1; Path=/")
+				w.AddSetCookie("theme=dark; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+				w.AddVary("Accept-Encoding")
+				w.WriteHeaders(GetDefaultHeaders(0))
+			},
+			status:  StatusOK,
+			headers: headers.Headers{"content-length": "0", "content-type": "text/plain", "vary": "Accept-Encoding"},
+			cookies: []string{"id=1; Path=/", "theme=dark; Expires=Wed, 21 Oct 2026 07:28:00 GMT"},
+		},
+		{
+			name:      "interim continue before the response",
+			keepAlive: true,
+			write: func(w *Writer) {
+				w.WriteContinue()
+				w.WriteRequestLine(StatusOK)
+				w.WriteHeaders(GetDefaultHeaders(2))
+				w.WriteBody([]byte("ok"))
+			},
+			status:  StatusOK,
+			headers: headers.Headers{"content-length": "2", "content-type": "text/plain"},
+			body:    "ok",
+		},
+		{
+			name:      "finished by Finish",
+			keepAlive: true,
+			write:     func(w *Writer) {},
+			status:    StatusOK,
+			headers:   headers.Headers{"content-length": "0"},
+		},
+	}
+	for _, tt := range tests {
+		// Test: What the Writer produces parses back into the same response
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		if tt.version != "" {
+			w.SetHttpVersion(tt.version)
+		}
+		method := "GET"
+		if tt.method != "" {
+			method = tt.method
+			w.SetMethod(method)
+		}
+		w.SetKeepAlive(tt.keepAlive)
+		tt.write(w)
+		require.NoError(t, w.Finish(), tt.name)
+
+		resp, err := ResponseFromReader(buf, method)
+		require.NoError(t, err, tt.name)
+		version := tt.version
+		if version == "" {
+			version = "1.1"
+		}
+		assert.Equal(t, tt.status, resp.StatusLine.StatusCode, tt.name)
+		statusLine := fmt.Sprintf("HTTP/%s %d %s\r\n", resp.StatusLine.HttpVersion, resp.StatusLine.StatusCode, resp.StatusLine.ReasonPhrase)
+		assert.Equal(t, string(getStatusLine(version, tt.status)), statusLine, tt.name)
+		assert.Equal(t, tt.headers, resp.Headers, tt.name)
+		assert.Equal(t, tt.cookies, resp.SetCookies, tt.name)
+		assert.Equal(t, tt.body, string(resp.Body), tt.name)
+		if tt.trailers == nil {
+			tt.trailers = headers.Headers{}
+		}
+		assert.Equal(t, tt.trailers, resp.Trailers, tt.name)
+		assert.Equal(t, w.KeepAlive(), resp.KeepAlive(), tt.name)
+	}
+}
+
+func TestResponseRoundTripEncoded(t *testing.T) {
+	// Test: A compressed body parses back into what was compressed
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.EncodeBody(func(dst io.Writer) io.WriteCloser { return gzip.NewWriter(dst) }))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Encoding": "gzip", "Transfer-Encoding": "chunked"}))
+	_, err := w.WriteChunkedBody([]byte(strings.Repeat("compress me ", 100)))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+
+	resp, err := ResponseFromReader(buf, "GET")
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", resp.Headers["content-encoding"])
+	zr, err := gzip.NewReader(bytes.NewReader(resp.Body))
+	require.NoError(t, err)
+	body, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("compress me ", 100), string(body))
+}
+
+// chunkReader hands out its data a few bytes at a time, the way a slow connection would.
+type chunkReader struct {
+	data            []byte
+	numBytesPerRead int
+	pos             int
+}
+
+func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.pos >= len(cr.data) {
+		return 0, io.EOF
+	}
+	endIndex := min(cr.pos+cr.numBytesPerRead, len(cr.data))
+	n = copy(p, cr.data[cr.pos:endIndex])
+	cr.pos += n
+	return n, nil
+}
+
+func TestReader(t *testing.T) {
+	// Test: Responses on a kept-alive connection are read one after another, whatever the reads
+	// are cut into
+	raw := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3;ext=1\r\nabc\r\n0\r\nX-Sum: 3\r\n\r\n" +
+		"HTTP/1.1 204 No Content\r\n\r\n"
+	for _, n := range []int{1, 3, 7, len(raw)} {
+		rr := NewReader(&chunkReader{data: []byte(raw), numBytesPerRead: n})
+		resp, err := rr.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, StatusContinue, resp.StatusLine.StatusCode)
+		resp, err = rr.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(resp.Body))
+		resp, err = rr.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, "abc", string(resp.Body))
+		assert.Equal(t, "3", resp.Trailers["x-sum"])
+		resp, err = rr.ReadResponse("GET")
+		require.NoError(t, err)
+		assert.Equal(t, StatusNoContent, resp.StatusLine.StatusCode)
+		_, err = rr.ReadResponse("GET")
+		assert.Equal(t, io.EOF, err)
+	}
+
+	// Test: A response that switches protocols leaves what follows it unread
+	rr := NewReader(strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x02hi"))
+	resp, err := rr.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, StatusSwitchingProtocols, resp.StatusLine.StatusCode)
+	assert.False(t, resp.KeepAlive())
+	assert.Equal(t, "\x81\x02hi", string(rr.Buffered()))
+}
+
+func TestResponseFromReaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"empty", ""},
+		{"not HTTP", "SSH-2.0-OpenSSH_9.6\r\n"},
+		{"unsupported version", "HTTP/2.0 200 OK\r\n\r\n"},
+		{"bad status code", "HTTP/1.1 20 OK\r\n\r\n"},
+		{"status code with letters", "HTTP/1.1 2x0 OK\r\n\r\n"},
+		{"bad header", "HTTP/1.1 200 OK\r\nBad Header: x\r\n\r\n"},
+		{"headers cut short", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n"},
+		{"bad content-length", "HTTP/1.1 200 OK\r\nContent-Length: five\r\n\r\nhello"},
+		{"body shorter than content-length", "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"},
+		{"body longer than content-length", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhello"},
+		{"bad chunk size", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n"},
+		{"chunk longer than its size", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n"},
+		{"missing last chunk", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nab\r\n"},
+		{"header section too large", "HTTP/1.1 200 OK\r\nX-Big: " + strings.Repeat("a", maxHeaderBytes) + "\r\n\r\n"},
+		{"only an interim response", "HTTP/1.1 100 Continue\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		// Test: Malformed responses are errors
+		_, err := ResponseFromReader(strings.NewReader(tt.raw), "GET")
+		assert.Error(t, err, tt.name)
+	}
+
+	// Test: Cut-off responses say so
+	_, err := NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello")).ReadResponse("GET")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nX-Big: " + strings.Repeat("a", maxHeaderBytes))).ReadResponse("GET")
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+}
+
+func TestReaderMaxBodyBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"content-length", "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\n"},
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n"},
+		{"close-delimited", "HTTP/1.1 200 OK\r\n\r\nabcdef"},
+	}
+	for _, tt := range tests {
+		// Test: A body past the limit is an error however it is delimited
+		rr := NewReader(&chunkReader{data: []byte(tt.raw), numBytesPerRead: 4}, WithMaxBodyBytes(5))
+		_, err := rr.ReadResponse("GET")
+		assert.ErrorIs(t, err, ErrBodyTooLarge, tt.name)
+	}
+
+	// Test: A body right at the limit is read
+	rr := NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"), WithMaxBodyBytes(5))
+	resp, err := rr.ReadResponse("GET")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp.Body))
+}
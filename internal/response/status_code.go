@@ -7,20 +7,95 @@ import (
 type StatusCode int
 
 const (
-	StatusOK                  StatusCode = 200
-	StatusBadRequest          StatusCode = 400
-	StatusInternalServerError StatusCode = 500
+	StatusContinue                StatusCode = 100
+	StatusSwitchingProtocols      StatusCode = 101
+	StatusOK                      StatusCode = 200
+	StatusNoContent               StatusCode = 204
+	StatusPartialContent          StatusCode = 206
+	StatusMovedPermanently        StatusCode = 301
+	StatusFound                   StatusCode = 302
+	StatusSeeOther                StatusCode = 303
+	StatusNotModified             StatusCode = 304
+	StatusTemporaryRedirect       StatusCode = 307
+	StatusPermanentRedirect       StatusCode = 308
+	StatusBadRequest              StatusCode = 400
+	StatusForbidden               StatusCode = 403
+	StatusNotFound                StatusCode = 404
+	StatusMethodNotAllowed        StatusCode = 405
+	StatusNotAcceptable           StatusCode = 406
+	StatusPreconditionFailed      StatusCode = 412
+	StatusContentTooLarge         StatusCode = 413
+	StatusUnsupportedMediaType    StatusCode = 415
+	StatusRangeNotSatisfiable     StatusCode = 416
+	StatusExpectationFailed       StatusCode = 417
+	StatusUpgradeRequired         StatusCode = 426
+	StatusInternalServerError     StatusCode = 500
+	StatusNotImplemented          StatusCode = 501
+	StatusBadGateway              StatusCode = 502
+	StatusServiceUnavailable      StatusCode = 503
+	StatusGatewayTimeout          StatusCode = 504
+	StatusHttpVersionNotSupported StatusCode = 505
 )
 
-func getStatusLine(statusCode StatusCode) []byte {
+func getStatusLine(httpVersion string, statusCode StatusCode) []byte {
 	reasonPhrase := ""
 	switch statusCode {
+	case StatusContinue:
+		reasonPhrase = "Continue"
+	case StatusSwitchingProtocols:
+		reasonPhrase = "Switching Protocols"
 	case StatusOK:
 		reasonPhrase = "OK"
+	case StatusNoContent:
+		reasonPhrase = "No Content"
+	case StatusPartialContent:
+		reasonPhrase = "Partial Content"
+	case StatusMovedPermanently:
+		reasonPhrase = "Moved Permanently"
+	case StatusFound:
+		reasonPhrase = "Found"
+	case StatusSeeOther:
+		reasonPhrase = "See Other"
+	case StatusNotModified:
+		reasonPhrase = "Not Modified"
+	case StatusTemporaryRedirect:
+		reasonPhrase = "Temporary Redirect"
+	case StatusPermanentRedirect:
+		reasonPhrase = "Permanent Redirect"
 	case StatusBadRequest:
 		reasonPhrase = "Bad Request"
+	case StatusForbidden:
+		reasonPhrase = "Forbidden"
+	case StatusNotFound:
+		reasonPhrase = "Not Found"
+	case StatusMethodNotAllowed:
+		reasonPhrase = "Method Not Allowed"
+	case StatusNotAcceptable:
+		reasonPhrase = "Not Acceptable"
+	case StatusPreconditionFailed:
+		reasonPhrase = "Precondition Failed"
+	case StatusContentTooLarge:
+		reasonPhrase = "Content Too Large"
+	case StatusUnsupportedMediaType:
+		reasonPhrase = "Unsupported Media Type"
+	case StatusRangeNotSatisfiable:
+		reasonPhrase = "Range Not Satisfiable"
+	case StatusExpectationFailed:
+		reasonPhrase = "Expectation Failed"
+	case StatusUpgradeRequired:
+		reasonPhrase = "Upgrade Required"
 	case StatusInternalServerError:
 		reasonPhrase = "Internal Server Error"
+	case StatusNotImplemented:
+		reasonPhrase = "Not Implemented"
+	case StatusBadGateway:
+		reasonPhrase = "Bad Gateway"
+	case StatusServiceUnavailable:
+		reasonPhrase = "Service Unavailable"
+	case StatusGatewayTimeout:
+		reasonPhrase = "Gateway Timeout"
+	case StatusHttpVersionNotSupported:
+		reasonPhrase = "HTTP Version Not Supported"
 	}
-	return fmt.Appendf(nil, "HTTP/1.1 %d %s\r\n", statusCode, reasonPhrase)
+	return fmt.Appendf(nil, "HTTP/%s %d %s\r\n", httpVersion, statusCode, reasonPhrase)
 }
@@ -1,9 +1,14 @@
 package response
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
+	"strconv"
+	"strings"
 )
 
 type WriterState int
@@ -13,30 +18,204 @@ const (
 	writerStateHeaders       WriterState = 2
 	writerStateBody          WriterState = 3
 	writeTrailers            WriterState = 4
+	writerStateDone          WriterState = 5
 )
 
 type Writer struct {
-	writerState WriterState
-	writer      io.Writer
+	writerState   WriterState
+	writer        io.Writer
+	httpVersion   string
+	keepAlive     bool
+	statusCode    StatusCode
+	chunked       bool
+	contentLength int
+	bytesWritten  int
+	cookies       []string
+	vary          []string
+	headerHooks   []func(StatusCode, headers.Headers)
+	headOnly      bool
+	encoder       io.WriteCloser
+	hijacker      func() (net.Conn, *bufio.Reader)
+	hijacked      bool
+	stream        Stream
 }
 
+// Stream carries a response over a protocol that frames messages itself, such as an HTTP/2
+// stream, in place of the HTTP/1.x bytes a Writer normally produces. The Writer keeps its state
+// machine, hooks and encoders, and hands the Stream the results.
+type Stream interface {
+	// WriteHeaders sends the status code and header fields, or an interim response when
+	// statusCode is 1xx. cookies holds the values of the Set-Cookie fields.
+	WriteHeaders(statusCode StatusCode, h headers.Headers, cookies []string) error
+	// Write sends body bytes.
+	Write(p []byte) (int, error)
+	// WriteTrailers sends trailer fields, which ends the response.
+	WriteTrailers(h headers.Headers) error
+}
+
+var (
+	ErrNotHijackable = errors.New("connection cannot be hijacked")
+	ErrHijacked      = errors.New("connection has already been hijacked")
+)
+
+// NewWriter returns a Writer that speaks HTTP/1.1 and closes the connection after the response.
+// The server relaxes both with SetHttpVersion and SetKeepAlive once it has parsed the request.
 func NewWriter(writerToWrap io.Writer) *Writer {
 	return &Writer {
-		writerState: writerStateRequestLine,
-		writer:      writerToWrap,
+		writerState:   writerStateRequestLine,
+		writer:        writerToWrap,
+		httpVersion:   "1.1",
+		contentLength: -1,
 	}
 }
 
+// NewStreamWriter returns a Writer that sends the response over s. Handlers use it exactly as
+// they use one from NewWriter. Connection management does not apply: KeepAlive only turns
+// false if the response could not be completed, in which case the stream should be reset
+// rather than ended.
+func NewStreamWriter(s Stream) *Writer {
+	return &Writer{
+		writerState:   writerStateRequestLine,
+		writer:        s,
+		httpVersion:   "2",
+		keepAlive:     true,
+		contentLength: -1,
+		stream:        s,
+	}
+}
+
+// SetHttpVersion sets the protocol version written in the status line. It should match the
+// request, since an HTTP/1.0 client cannot be sent a chunked body.
+func (w *Writer) SetHttpVersion(httpVersion string) {
+	w.httpVersion = httpVersion
+}
+
+// SetKeepAlive records whether the client is willing to reuse the connection.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetMethod tells the Writer which method it is answering. A response to HEAD carries the same
+// headers a GET would, but its body is dropped.
+func (w *Writer) SetMethod(method string) {
+	w.headOnly = method == "HEAD"
+}
+
+// KeepAlive reports whether the connection can carry another request once this response is
+// finished. It turns false if the handler asked to close, if the body has no length framing or
+// if the handler wrote fewer bytes than it announced.
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive
+}
+
+// AddVary records a request header the response depends on. The names are merged into any Vary
+// header the handler passes to WriteHeaders, so helpers that look at request headers can say so
+// without the handler having to know. It has to be called before WriteHeaders.
+func (w *Writer) AddVary(fields ...string) error {
+	if w.writerState != writerStateRequestLine && w.writerState != writerStateHeaders {
+		return fmt.Errorf("cannot add vary in state %d", w.writerState)
+	}
+	w.vary = append(w.vary, fields...)
+	return nil
+}
+
+// OnWriteHeaders registers a function that runs just before the headers go out. It gets the
+// status code and a copy of the handler's headers that it may edit, which lets middleware add
+// or rewrite headers without the handler's cooperation. Hooks run in the order they were added.
+func (w *Writer) OnWriteHeaders(fn func(statusCode StatusCode, h headers.Headers)) error {
+	if w.writerState != writerStateRequestLine && w.writerState != writerStateHeaders {
+		return fmt.Errorf("cannot add header hook in state %d", w.writerState)
+	}
+	w.headerHooks = append(w.headerHooks, fn)
+	return nil
+}
+
+// EncodeBody routes everything the handler writes through an encoder such as a gzip writer.
+// It is meant to be called from an OnWriteHeaders hook, which is also where the hook should
+// drop Content-Length and ask for chunked framing, since the encoded length is not known up
+// front. The encoder is closed when the body ends.
+func (w *Writer) EncodeBody(wrap func(io.Writer) io.WriteCloser) error {
+	if w.writerState != writerStateHeaders {
+		return fmt.Errorf("cannot encode body in state %d", w.writerState)
+	}
+	w.encoder = wrap(bodySink{w})
+	return nil
+}
+
+// bodySink takes the encoder's output and frames it for the wire.
+type bodySink struct {
+	w *Writer
+}
+
+func (bs bodySink) Write(p []byte) (int, error) {
+	if len(p) == 0 || bs.w.headOnly {
+		return 0, nil
+	}
+	if !bs.w.chunked || bs.w.stream != nil {
+		n, err := bs.w.writer.Write(p)
+		bs.w.bytesWritten += n
+		return n, err
+	}
+	chunk := fmt.Sprintf("%x\r\n", len(p)) + string(p) + "\r\n"
+	if _, err := bs.w.writer.Write([]byte(chunk)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// closeEncoder flushes whatever the encoder is still holding.
+func (w *Writer) closeEncoder() error {
+	if w.encoder == nil {
+		return nil
+	}
+	encoder := w.encoder
+	w.encoder = nil
+	return encoder.Close()
+}
+
+// Flush pushes out body bytes an encoder is still holding, for responses such as event streams
+// where each piece has to reach the client as soon as it is written. Without an encoder the body
+// already goes straight out and there is nothing to flush.
+func (w *Writer) Flush() error {
+	if w.writerState != writerStateBody {
+		return fmt.Errorf("cannot flush body in state %d", w.writerState)
+	}
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// WriteContinue sends the interim "100 Continue" response that tells a client waiting on
+// "Expect: 100-continue" to go ahead with the body. It must come before the final status line.
+func (w *Writer) WriteContinue() error {
+	if w.writerState != writerStateRequestLine {
+		return fmt.Errorf("cannot write 100 continue in state %d", w.writerState)
+	}
+	if w.stream != nil {
+		return w.stream.WriteHeaders(StatusContinue, nil, nil)
+	}
+
+	statusLine := getStatusLine(w.httpVersion, StatusContinue)
+	_, err := w.writer.Write(append(statusLine, "\r\n"...))
+	return err
+}
+
 func (w *Writer) WriteRequestLine(statusCode StatusCode) error {
 	if w.writerState != writerStateRequestLine {
 		return fmt.Errorf("cannot write status line in state %d", w.writerState)
 	}
 
-	defer func() { 
-		w.writerState = writerStateHeaders 
+	defer func() {
+		w.writerState = writerStateHeaders
 	}()
 
-	_, err := w.writer.Write(getStatusLine(statusCode))
+	w.statusCode = statusCode
+	if w.stream != nil {
+		// The status goes out with the headers.
+		return nil
+	}
+	_, err := w.writer.Write(getStatusLine(w.httpVersion, statusCode))
 	return err
 }
 
@@ -44,32 +223,128 @@ func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.writerState != writerStateHeaders {
 		return fmt.Errorf("cannot write headers in state %d", w.writerState)
 	}
-	defer func() { 
-		w.writerState = writerStateBody 
+	defer func() {
+		w.writerState = writerStateBody
 	}()
 
+	copied := make(headers.Headers, len(h)+1)
+	for k, v := range h {
+		copied[k] = v
+	}
+	for _, hook := range w.headerHooks {
+		hook(w.statusCode, copied)
+	}
+
+	h = w.frameHeaders(copied)
+	if w.stream != nil {
+		return w.stream.WriteHeaders(w.statusCode, h, w.cookies)
+	}
 	for k, v := range h {
 		_, err := w.writer.Write(fmt.Appendf(nil, "%s: %s\r\n", k, v))
 		if err != nil {
 			return err
 		}
 	}
+	for _, cookie := range w.cookies {
+		_, err := w.writer.Write(fmt.Appendf(nil, "Set-Cookie: %s\r\n", cookie))
+		if err != nil {
+			return err
+		}
+	}
 	_, err := w.writer.Write([]byte("\r\n"))
 	return err
 }
 
+// frameHeaders works out how the body will be delimited and fills in the Connection header to
+// match.
+func (w *Writer) frameHeaders(framed headers.Headers) headers.Headers {
+	w.chunked = framed.HasToken("Transfer-Encoding", "chunked")
+	if w.chunked && w.httpVersion == "1.0" {
+		// HTTP/1.0 has no chunked coding, so the body is sent as is and delimited by closing
+		// the connection.
+		framed.Delete("Transfer-Encoding")
+		framed.Delete("Trailer")
+		w.chunked = false
+		w.keepAlive = false
+	}
+
+	if val, ok := framed.Get("Content-Length"); ok && !w.chunked {
+		contentLength, err := strconv.Atoi(val)
+		if err == nil && contentLength >= 0 {
+			w.contentLength = contentLength
+		}
+	}
+	if w.statusCode == 204 || w.statusCode == 304 {
+		w.contentLength = 0
+	}
+	if !w.chunked && w.contentLength < 0 && w.stream == nil {
+		w.keepAlive = false
+	}
+
+	w.addVary(framed)
+
+	if w.stream != nil {
+		// The stream's own framing delimits the body, and connection management belongs to
+		// the protocol underneath.
+		for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"} {
+			framed.Delete(name)
+		}
+		return framed
+	}
+	if framed.HasToken("Connection", "close") {
+		w.keepAlive = false
+	}
+	framed.Delete("Connection")
+	if !w.keepAlive {
+		framed["Connection"] = "close"
+	} else if w.httpVersion == "1.0" {
+		framed["Connection"] = "keep-alive"
+	}
+	return framed
+}
+
+// addVary merges the fields recorded with AddVary into the Vary header.
+func (w *Writer) addVary(framed headers.Headers) {
+	if len(w.vary) == 0 {
+		return
+	}
+	vary, _ := framed.Get("Vary")
+	for _, field := range w.vary {
+		if !framed.HasToken("Vary", field) && !framed.HasToken("Vary", "*") {
+			vary = strings.TrimPrefix(vary+", "+field, ", ")
+			framed.Delete("Vary")
+			framed["Vary"] = vary
+		}
+	}
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.writerState != writerStateBody {
 		return 0, fmt.Errorf("cannot write body in state %d", w.writerState)
 	}
+	if w.headOnly {
+		return len(p), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
 
-	return w.writer.Write(p)
+	n, err := w.writer.Write(p)
+	w.bytesWritten += n
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.writerState != writerStateBody {
 		return 0, fmt.Errorf("cannot write chunked body in state %d", w.writerState)
 	}
+	if len(p) == 0 {
+		// An empty chunk would read as the last chunk and end the body early.
+		return 0, nil
+	}
+	if !w.chunked || w.encoder != nil || w.headOnly || w.stream != nil {
+		return w.WriteBody(p)
+	}
 
 	chunk := fmt.Sprintf("%x\r\n", len(p)) + string(p) + "\r\n"
 	return w.writer.Write([]byte(chunk))
@@ -84,6 +359,12 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		w.writerState = writeTrailers
 	}()
 
+	if err := w.closeEncoder(); err != nil {
+		return 0, err
+	}
+	if !w.chunked || w.headOnly || w.stream != nil {
+		return 0, nil
+	}
 	lastChunk := "0\r\n"
 	return w.writer.Write([]byte(lastChunk))
 }
@@ -92,7 +373,19 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	if w.writerState != writeTrailers {
 		return fmt.Errorf("cannot write trailers in state %d", w.writerState)
 	}
+	defer func() {
+		w.writerState = writerStateDone
+	}()
 
+	if w.stream != nil {
+		if len(h) == 0 || w.headOnly {
+			return nil
+		}
+		return w.stream.WriteTrailers(h)
+	}
+	if !w.chunked || w.headOnly {
+		return nil
+	}
 	for k, v := range h {
 		_, err := w.writer.Write(fmt.Appendf(nil, "%s: %s\r\n", k, v))
 		if err != nil {
@@ -101,4 +394,79 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 	}
 	_, err := w.writer.Write([]byte("\r\n"))
 	return err
-}
\ No newline at end of file
+}
+
+// Abort gives up on a response whose body cannot be completed, for example because the source
+// it was copied from failed halfway. Finish then leaves the body unterminated and the connection
+// is closed, so the client sees a truncated response rather than one that looks whole.
+func (w *Writer) Abort() {
+	w.encoder = nil
+	w.writerState = writerStateDone
+	w.keepAlive = false
+}
+
+// SetHijacker gives the Writer a way to hand the connection it writes to over to the handler.
+// The server sets it; a Writer without one cannot be hijacked.
+func (w *Writer) SetHijacker(fn func() (net.Conn, *bufio.Reader)) {
+	w.hijacker = fn
+}
+
+// Hijack takes over the connection the response was going to, for protocols that stop
+// speaking HTTP after the request, such as WebSocket. It returns the connection and a reader
+// that first yields any bytes the server had already read past the request. From then on the
+// caller owns the connection and has to close it; the server neither writes to it, reads from it
+// nor closes it, and the Writer refuses further writes. Anything written before the hijack has
+// already gone out on the connection.
+func (w *Writer) Hijack() (net.Conn, *bufio.Reader, error) {
+	if w.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	w.hijacked = true
+	w.encoder = nil
+	w.writerState = writerStateDone
+	w.keepAlive = false
+	conn, reader := w.hijacker()
+	return conn, reader, nil
+}
+
+// Hijacked reports whether Hijack took the connection over.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// Finish completes whatever the handler left unfinished: an empty 200 if nothing was written,
+// the closing chunk and trailer section of a chunked body, and so on. A Content-Length body that
+// came up short cannot be repaired, so the connection is marked for closing instead.
+func (w *Writer) Finish() error {
+	switch w.writerState {
+	case writerStateRequestLine:
+		if err := w.WriteRequestLine(StatusOK); err != nil {
+			return err
+		}
+		return w.WriteHeaders(headers.Headers{"Content-Length": "0"})
+	case writerStateHeaders:
+		if err := w.WriteHeaders(headers.Headers{"Content-Length": "0"}); err != nil {
+			return err
+		}
+	case writerStateBody:
+		if w.chunked {
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return err
+			}
+			return w.WriteTrailers(nil)
+		}
+		if err := w.closeEncoder(); err != nil {
+			return err
+		}
+	case writeTrailers:
+		return w.WriteTrailers(nil)
+	}
+
+	if !w.chunked && !w.headOnly && w.contentLength >= 0 && w.bytesWritten != w.contentLength {
+		w.keepAlive = false
+	}
+	return nil
+}
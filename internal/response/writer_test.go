@@ -0,0 +1,226 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"httpfromtcp/internal/headers"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterConnectionHeaders(t *testing.T) {
+	// Test: HTTP/1.1 keep-alive response with a content length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "2"}))
+	_, err := w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: HTTP/1.0 keep-alive response echoes the Connection header
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetHttpVersion("1.0")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "0"}))
+	require.NoError(t, w.Finish())
+	assert.Contains(t, buf.String(), "HTTP/1.0 200 OK\r\n")
+	assert.Contains(t, buf.String(), "Connection: keep-alive\r\n")
+	assert.True(t, w.KeepAlive())
+
+	// Test: Short body forces the connection closed
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "10"}))
+	_, err = w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterChunkedHttp10(t *testing.T) {
+	// Test: HTTP/1.0 never gets chunked framing
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetHttpVersion("1.0")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{
+		"Transfer-Encoding": "chunked",
+		"Trailer":           "X-Content-Length",
+	}))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.Headers{"X-Content-Length": "11"}))
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nhello world", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: HTTP/1.1 chunked body gets its terminating CRLF from Finish
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriterAbort(t *testing.T) {
+	// Test: An aborted chunked body is left unterminated and the connection closes
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+	_, err := w.WriteChunkedBody([]byte("hel"))
+	require.NoError(t, err)
+	w.Abort()
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterHijack(t *testing.T) {
+	// Test: A Writer without a hijacker cannot be hijacked
+	w := NewWriter(&bytes.Buffer{})
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+	assert.False(t, w.Hijacked())
+
+	// Test: Hijacking hands over the connection and stops the Writer
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	reader := bufio.NewReader(strings.NewReader("early"))
+	w = NewWriter(serverConn)
+	w.SetKeepAlive(true)
+	w.SetHijacker(func() (net.Conn, *bufio.Reader) { return serverConn, reader })
+	conn, r, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, serverConn, conn)
+	assert.Equal(t, reader, r)
+	assert.True(t, w.Hijacked())
+	assert.False(t, w.KeepAlive())
+	assert.Error(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.Finish())
+
+	// Test: A connection can only be hijacked once
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+}
+
+func TestWriterFlush(t *testing.T) {
+	// Test: Flush pushes out what the encoder is holding as a chunk
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	w.OnWriteHeaders(func(statusCode StatusCode, h headers.Headers) {
+		w.EncodeBody(func(dst io.Writer) io.WriteCloser { return gzip.NewWriter(dst) })
+	})
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Transfer-Encoding": "chunked"}))
+	headLen := buf.Len()
+	_, err := w.WriteChunkedBody([]byte("data: hello\n\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Greater(t, buf.Len(), headLen)
+
+	// Test: Flush only applies while the body is being written
+	assert.Error(t, NewWriter(&bytes.Buffer{}).Flush())
+}
+
+// fakeStream records what a stream-mode Writer hands it.
+type fakeStream struct {
+	statuses []StatusCode
+	headers  headers.Headers
+	cookies  []string
+	body     bytes.Buffer
+	trailers headers.Headers
+}
+
+func (s *fakeStream) WriteHeaders(statusCode StatusCode, h headers.Headers, cookies []string) error {
+	s.statuses = append(s.statuses, statusCode)
+	if statusCode >= 200 {
+		s.headers, s.cookies = h, cookies
+	}
+	return nil
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) {
+	return s.body.Write(p)
+}
+
+func (s *fakeStream) WriteTrailers(h headers.Headers) error {
+	s.trailers = h
+	return nil
+}
+
+func TestStreamWriter(t *testing.T) {
+	// Test: A chunked response goes out as plain data, without connection-specific headers
+	s := &fakeStream{}
+	w := NewStreamWriter(s)
+	require.NoError(t, w.WriteContinue())
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	w.AddSetCookie("id=1")
+	require.NoError(t, w.WriteHeaders(headers.Headers{
+		"Transfer-Encoding": "chunked",
+		"Connection":        "keep-alive",
+		"Trailer":           "X-Sum",
+	}))
+	_, err := w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.Headers{"X-Sum": "11"}))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, []StatusCode{StatusContinue, StatusOK}, s.statuses)
+	assert.Equal(t, headers.Headers{"Trailer": "X-Sum"}, s.headers)
+	assert.Equal(t, []string{"id=1"}, s.cookies)
+	assert.Equal(t, "hello world", s.body.String())
+	assert.Equal(t, headers.Headers{"X-Sum": "11"}, s.trailers)
+	assert.True(t, w.KeepAlive())
+
+	// Test: A body of unknown length keeps the stream usable
+	s = &fakeStream{}
+	w = NewStreamWriter(s)
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Type": "text/plain"}))
+	_, err = w.WriteBody([]byte("streamed"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "streamed", s.body.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A HEAD response sends no body
+	s = &fakeStream{}
+	w = NewStreamWriter(s)
+	w.SetMethod("HEAD")
+	require.NoError(t, w.WriteRequestLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(headers.Headers{"Content-Length": "8"}))
+	_, err = w.WriteBody([]byte("withheld"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "8", s.headers["Content-Length"])
+	assert.Empty(t, s.body.String())
+}
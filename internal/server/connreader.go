@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is a read deadline that has already passed, which makes a pending read return
+// at once.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader sits between a connection and the request parser. While a handler runs and the
+// request has been read, it keeps one read going in the background so that a client hanging up
+// is noticed straight away. Any byte that read brings in, such as the start of a pipelined
+// request, is handed to the parser on its next read, so the background read never takes
+// anything from it.
+type connReader struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	inRead  bool
+	aborted bool
+	byteBuf [1]byte
+	hasByte bool
+	err     error
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+// startBackgroundRead starts watching the connection. onClose runs if the client hangs up or
+// the connection fails before abortPendingRead is called.
+func (cr *connReader) startBackgroundRead(onClose func()) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead || cr.hasByte || cr.err != nil {
+		// Either a read is already out, or the client has already sent more and is still
+		// there, or it has already gone.
+		if cr.err != nil {
+			onClose()
+		}
+		return
+	}
+	cr.inRead = true
+	go cr.backgroundRead(onClose)
+}
+
+func (cr *connReader) backgroundRead(onClose func()) {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+
+	cr.mu.Lock()
+	if n == 1 {
+		cr.hasByte = true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && cr.aborted {
+		// abortPendingRead ended the read on purpose; the client is still there.
+	} else if err != nil {
+		cr.err = err
+		onClose()
+	}
+	cr.aborted = false
+	cr.inRead = false
+	cr.mu.Unlock()
+	cr.cond.Broadcast()
+}
+
+// abortPendingRead stops the background read and waits for it to finish. The connection is left
+// without a read deadline, so callers that want one set it afterwards.
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.SetReadDeadline(aLongTimeAgo)
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(time.Time{})
+}
+
+// unread returns the byte the background read brought in, if any, and forgets it.
+func (cr *connReader) unread() []byte {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.hasByte {
+		return nil
+	}
+	cr.hasByte = false
+	return []byte{cr.byteBuf[0]}
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.abortPendingRead()
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	cr.mu.Lock()
+	if cr.hasByte {
+		p[0] = cr.byteBuf[0]
+		cr.hasByte = false
+		cr.mu.Unlock()
+		return 1, nil
+	}
+	if err := cr.err; err != nil {
+		cr.mu.Unlock()
+		return 0, err
+	}
+	cr.mu.Unlock()
+	return cr.conn.Read(p)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"strings"
+)
+
+// HostMux picks a Handler by the request's Host header, so one server can carry several
+// virtual hosts. Patterns are either exact host names ("example.com") or wildcards that match
+// any subdomain ("*.example.com"). When several wildcards match, the longest one wins. Requests
+// that match nothing, including HTTP/1.0 requests with no Host at all, go to the fallback.
+//
+// Register hosts before passing Dispatch to Serve; HostMux is not safe for concurrent updates.
+type HostMux struct {
+	hosts     map[string]Handler
+	wildcards map[string]Handler
+	fallback  Handler
+}
+
+// NewHostMux returns an empty HostMux. A nil fallback answers unmatched hosts with 404.
+func NewHostMux(fallback Handler) *HostMux {
+	return &HostMux{
+		hosts:     make(map[string]Handler),
+		wildcards: make(map[string]Handler),
+		fallback:  fallback,
+	}
+}
+
+func (m *HostMux) AddHost(pattern string, handler Handler) error {
+	host := normalizeHost(pattern)
+	if host == "" || handler == nil {
+		return fmt.Errorf("host pattern %q is incorrect", pattern)
+	}
+
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		if suffix == "" || strings.Contains(suffix, "*") {
+			return fmt.Errorf("host pattern %q is incorrect", pattern)
+		}
+		m.wildcards["."+suffix] = handler
+		return nil
+	}
+	if strings.Contains(host, "*") {
+		return fmt.Errorf("host pattern %q is incorrect", pattern)
+	}
+	m.hosts[host] = handler
+	return nil
+}
+
+// Dispatch has the Handler signature so a HostMux can be handed straight to Serve.
+func (m *HostMux) Dispatch(w *response.Writer, req *request.Request) {
+	m.handler(req.Headers["host"])(w, req)
+}
+
+func (m *HostMux) handler(hostHeader string) Handler {
+	host := normalizeHost(hostHeader)
+	if handler, ok := m.hosts[host]; ok {
+		return handler
+	}
+
+	var best Handler
+	bestLen := 0
+	for suffix, handler := range m.wildcards {
+		if len(host) > len(suffix) && strings.HasSuffix(host, suffix) && len(suffix) > bestLen {
+			best = handler
+			bestLen = len(suffix)
+		}
+	}
+	if best != nil {
+		return best
+	}
+
+	if m.fallback != nil {
+		return m.fallback
+	}
+	return notFound
+}
+
+// normalizeHost lowercases a host, strips any port and the trailing dot of a fully qualified
+// name.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+	return strings.TrimSuffix(host, ".")
+}
+
+func notFound(w *response.Writer, req *request.Request) {
+	w.WriteRequestLine(response.StatusNotFound)
+	body := []byte("Not Found")
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
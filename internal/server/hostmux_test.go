@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostMuxDispatch(t *testing.T) {
+	called := ""
+	named := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			called = name
+		}
+	}
+
+	mux := NewHostMux(named("fallback"))
+	require.NoError(t, mux.AddHost("example.com", named("example")))
+	require.NoError(t, mux.AddHost("*.example.com", named("wildcard")))
+	require.NoError(t, mux.AddHost("*.api.example.com", named("api")))
+	require.Error(t, mux.AddHost("foo.*.com", named("bad")))
+	require.Error(t, mux.AddHost("*.", named("bad")))
+
+	dispatch := func(host string) string {
+		called = ""
+		req := &request.Request{Headers: headers.Headers{}}
+		if host != "" {
+			req.Headers["host"] = host
+		}
+		mux.Dispatch(response.NewWriter(&bytes.Buffer{}), req)
+		return called
+	}
+
+	// Test: Exact host, with and without port and case
+	assert.Equal(t, "example", dispatch("example.com"))
+	assert.Equal(t, "example", dispatch("EXAMPLE.com:42069"))
+	assert.Equal(t, "example", dispatch("example.com."))
+
+	// Test: Wildcard subdomains, longest suffix wins
+	assert.Equal(t, "wildcard", dispatch("www.example.com"))
+	assert.Equal(t, "wildcard", dispatch("a.b.example.com"))
+	assert.Equal(t, "api", dispatch("v1.api.example.com:8080"))
+
+	// Test: Unmatched or missing hosts use the fallback
+	assert.Equal(t, "fallback", dispatch("notexample.com"))
+	assert.Equal(t, "fallback", dispatch(""))
+
+	// Test: No fallback answers 404
+	buf := &bytes.Buffer{}
+	NewHostMux(nil).Dispatch(response.NewWriter(buf), &request.Request{Headers: headers.Headers{"host": "x"}})
+	assert.Contains(t, buf.String(), "HTTP/1.1 404 Not Found\r\n")
+}
@@ -1,37 +1,106 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/http2"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
 	"log"
 	"net"
+	"strings"
 	"sync/atomic"
+	"time"
 )
 
-type Handler func(w *response.Writer, req *request.Request) 
+const readTimeout = 5 * time.Second
+
+var (
+	// ErrClientDisconnected is the cause a request's context is cancelled with when the client
+	// hangs up while the handler is running.
+	ErrClientDisconnected = errors.New("client disconnected")
+	// ErrServerClosed is the cause request contexts are cancelled with when the server closes.
+	ErrServerClosed = errors.New("server closed")
+)
+
+type Handler func(w *response.Writer, req *request.Request)
+
+// ConnectHandler takes over the connection a CONNECT request came in on. The server stops
+// managing it: it is not read from, timed out or closed by the server again. Bytes the client
+// sent after the request are read back first.
+type ConnectHandler func(conn net.Conn, req *request.Request)
+
+type Option func(*Server)
+
+// WithConnectHandler routes CONNECT requests to h. Without it they are answered with 405.
+func WithConnectHandler(h ConnectHandler) Option {
+	return func(s *Server) {
+		s.connect = h
+	}
+}
+
+// WithHandlerTimeout gives every handler a deadline of d on its request's context. The server
+// does not stop a handler that runs over; handlers are expected to watch the context.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.handlerTimeout = d
+	}
+}
+
+// WithH2C serves HTTP/2 over connections without TLS, to clients that open with the HTTP/2
+// preface (prior knowledge) or ask to switch with "Upgrade: h2c".
+func WithH2C() Option {
+	return func(s *Server) {
+		s.h2c = true
+	}
+}
 
 type Server struct {
-	listener net.Listener
-	handler  Handler
-	closed   atomic.Bool
+	listener       net.Listener
+	handler        Handler
+	connect        ConnectHandler
+	handlerTimeout time.Duration
+	h2c            bool
+	closed         atomic.Bool
+	// onClose runs when the server closes, to stop anything started alongside it.
+	onClose []func()
+
+	// ctx is the parent of every request's context, cancelled when the server closes.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
-	s := &Server{
-		handler: handler,
-		listener: listener,
-	}
+	s := newServer(handler, opts...)
+	s.listener = listener
 	go s.listen()
 	return s, nil
 }
 
+func newServer(handler Handler, opts ...Option) *Server {
+	s := &Server{handler: handler}
+	s.ctx, s.cancel = context.WithCancelCause(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Close stops accepting connections and cancels the context of every request in flight.
 func (s *Server) Close() error {
 	s.closed.Store(true)
+	s.cancel(ErrServerClosed)
+	for _, fn := range s.onClose {
+		fn()
+	}
 	if s.listener != nil {
 		return s.listener.Close()
 	}
@@ -52,16 +121,207 @@ func (s *Server) listen() {
 	}
 }
 
+// handle serves requests off conn until the client or a response asks for the connection to be
+// closed, or the client goes quiet for longer than readTimeout. A connection a handler hijacks or
+// a CONNECT request hands off is left to its new owner. With WithH2C, a connection that turns
+// out to speak HTTP/2 is served by the http2 package instead.
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-	w := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		w.WriteRequestLine(response.StatusBadRequest)
-		body := fmt.Appendf(nil, "Error parsing request: %v", err)
-		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-		w.WriteBody(body)
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			conn.Close()
+		}
+	}()
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS && !handshake(tlsConn) {
 		return
 	}
-	s.handler(w, req)
+	if s.h2c && !isTLS {
+		prefix, isHTTP2 := sniffPreface(conn)
+		if isHTTP2 {
+			s.serveHTTP2(newBufferedConn(conn, prefix))
+			return
+		}
+		conn = newBufferedConn(conn, prefix)
+	}
+	cr := newConnReader(conn)
+	reader := request.NewReader(cr)
+
+	// A client waiting on "100 Continue" is only told to go ahead once the handler reads the
+	// body. Until then the connection is marked for closing, since a handler that answers
+	// without reading leaves the body's fate unknown. The body is read in the foreground, so
+	// disconnects are no longer watched for once it is.
+	var w *response.Writer
+	var keepAlive bool
+	seq := 0
+	reader.OnContinue(func() error {
+		cr.abortPendingRead()
+		err := w.WriteContinue()
+		if err == nil {
+			w.SetKeepAlive(keepAlive)
+		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		return err
+	})
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		req, err := reader.ReadRequest()
+		conn.SetReadDeadline(time.Time{})
+
+		w = response.NewWriter(conn)
+		w.SetHijacker(func() (net.Conn, *bufio.Reader) {
+			handedOff = true
+			cr.abortPendingRead()
+			buffered := append(append([]byte(nil), reader.Buffered()...), cr.unread()...)
+			return conn, bufio.NewReader(newBufferedConn(conn, buffered))
+		})
+		if err != nil {
+			var netErr net.Error
+			if errors.Is(err, io.EOF) || errors.As(err, &netErr) {
+				return
+			}
+			writeParseError(w, err)
+			return
+		}
+
+		seq++
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.LocalAddr = conn.LocalAddr().String()
+		req.ConnSeq = seq
+		if isTLS {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		} else if s.h2c && http2.IsUpgrade(req) {
+			buffered := append(append([]byte(nil), reader.Buffered()...), cr.unread()...)
+			s.serveHTTP2(newBufferedConn(conn, buffered), http2.WithUpgrade(req))
+			return
+		}
+		ctx, cancel := s.requestContext()
+		req = req.WithContext(ctx)
+		if req.RequestLine.Method == "CONNECT" {
+			defer cancel(nil)
+			if s.connect == nil {
+				w.SetHttpVersion(req.RequestLine.HttpVersion)
+				writeMethodNotAllowed(w)
+				return
+			}
+			handedOff = true
+			s.connect(newBufferedConn(conn, reader.Buffered()), req)
+			return
+		}
+		w.SetHttpVersion(req.RequestLine.HttpVersion)
+		w.SetMethod(req.RequestLine.Method)
+		keepAlive = req.KeepAlive()
+		w.SetKeepAlive(keepAlive && !req.ExpectsContinue())
+
+		cr.startBackgroundRead(func() { cancel(ErrClientDisconnected) })
+		s.handler(w, req)
+		cr.abortPendingRead()
+		cancel(nil)
+		if w.Hijacked() {
+			return
+		}
+		if err := w.Finish(); err != nil || !w.KeepAlive() {
+			return
+		}
+	}
+}
+
+// sniffPreface reads from conn for as long as what arrives matches the HTTP/2 client preface,
+// and reports whether all of it did. The bytes read are returned either way, for whichever
+// protocol ends up serving the connection.
+func sniffPreface(conn net.Conn) ([]byte, bool) {
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, len(http2.ClientPreface))
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil || !strings.HasPrefix(http2.ClientPreface, string(buf[:n])) {
+			return buf[:n], false
+		}
+	}
+	return buf, true
+}
+
+// serveHTTP2 hands conn to the HTTP/2 server, with request contexts that end the same way
+// they do over HTTP/1.1.
+func (s *Server) serveHTTP2(conn net.Conn, opts ...http2.Option) {
+	opts = append([]http2.Option{
+		http2.WithBaseContext(s.ctx),
+		http2.WithHandlerTimeout(s.handlerTimeout),
+		http2.WithDisconnectCause(ErrClientDisconnected),
+	}, opts...)
+	http2.ServeConn(conn, http2.Handler(s.handler), opts...)
+}
+
+// requestContext returns the context for the next request, which ends at the latest when the
+// server closes or the handler's deadline passes.
+func (s *Server) requestContext() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	if s.handlerTimeout <= 0 {
+		return ctx, cancel
+	}
+	ctx, cancelTimeout := context.WithTimeout(ctx, s.handlerTimeout)
+	return ctx, func(cause error) {
+		cancel(cause)
+		cancelTimeout()
+	}
+}
+
+func writeParseError(w *response.Writer, err error) {
+	statusCode := response.StatusBadRequest
+	switch {
+	case errors.Is(err, request.ErrHttpVersionNotSupported):
+		statusCode = response.StatusHttpVersionNotSupported
+	case errors.Is(err, request.ErrExpectationFailed):
+		statusCode = response.StatusExpectationFailed
+	case errors.Is(err, request.ErrTransferEncodingNotImplemented):
+		statusCode = response.StatusNotImplemented
+	}
+	w.WriteRequestLine(statusCode)
+	body := fmt.Appendf(nil, "Error parsing request: %v", err)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func writeMethodNotAllowed(w *response.Writer) {
+	w.WriteRequestLine(response.StatusMethodNotAllowed)
+	body := []byte("CONNECT is not supported")
+	h := response.GetDefaultHeaders(len(body))
+	h["Allow"] = "GET, HEAD, POST, PUT, PATCH, DELETE"
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// bufferedConn is a connection whose first reads return bytes that were already read off it.
+type bufferedConn struct {
+	net.Conn
+	buffered []byte
+}
+
+func newBufferedConn(conn net.Conn, buffered []byte) net.Conn {
+	if len(buffered) == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, buffered: append([]byte(nil), buffered...)}
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	if len(bc.buffered) > 0 {
+		n := copy(p, bc.buffered)
+		bc.buffered = bc.buffered[n:]
+		return n, nil
+	}
+	return bc.Conn.Read(p)
+}
+
+// CloseWrite passes half-closes through to a TCP connection underneath.
+func (bc *bufferedConn) CloseWrite() error {
+	if cw, ok := bc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return bc.Conn.Close()
 }
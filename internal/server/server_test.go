@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveConn runs the server's connection loop on one end of an in-memory pipe and hands the
+// other end to the test.
+func serveConn(t *testing.T, handler Handler, opts ...Option) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	s := newServer(handler, opts...)
+	go s.handle(serverConn)
+	t.Cleanup(func() { clientConn.Close() })
+	return clientConn, bufio.NewReader(clientConn)
+}
+
+// readResponseHead reads up to and including the blank line that ends the header section.
+func readResponseHead(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	head := ""
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+		if line == "\r\n" {
+			return head
+		}
+	}
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body, err := req.ReadBody()
+	if err != nil {
+		return
+	}
+	w.WriteRequestLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestServerExpectContinue(t *testing.T) {
+	// Test: 100 Continue is sent before the body is read
+	conn, r := serveConn(t, echoHandler)
+	go io.WriteString(conn, "POST /upload HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Content-Length: 5\r\n"+
+		"Expect: 100-continue\r\n"+
+		"\r\n")
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n", readResponseHead(t, r))
+
+	go io.WriteString(conn, "hello")
+	head := readResponseHead(t, r)
+	assert.Contains(t, head, "HTTP/1.1 200 OK\r\n")
+	assert.NotContains(t, head, "Connection: close")
+	body := make([]byte, 5)
+	_, err := io.ReadFull(r, body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// Test: Handler rejects the upload without reading the body
+	conn, r = serveConn(t, func(w *response.Writer, req *request.Request) {
+		assert.True(t, req.ExpectsContinue())
+		w.WriteRequestLine(response.StatusContentTooLarge)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})
+	go io.WriteString(conn, "PUT /upload HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Content-Length: 1000000\r\n"+
+		"Expect: 100-continue\r\n"+
+		"\r\n")
+	head = readResponseHead(t, r)
+	assert.Contains(t, head, "HTTP/1.1 413 Content Too Large\r\n")
+	assert.Contains(t, head, "Connection: close\r\n")
+
+	// Test: Unknown expectation gets 417
+	conn, r = serveConn(t, echoHandler)
+	go io.WriteString(conn, "POST /upload HTTP/1.1\r\n"+
+		"Host: localhost:42069\r\n"+
+		"Content-Length: 5\r\n"+
+		"Expect: something-else\r\n"+
+		"\r\n")
+	assert.Contains(t, readResponseHead(t, r), "HTTP/1.1 417 Expectation Failed\r\n")
+}
+
+func TestServerTransferEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		status  string
+	}{
+		{"chunked", "Transfer-Encoding: chunked\r\n", "HTTP/1.1 501 Not Implemented\r\n"},
+		{"chunked with content-length", "Transfer-Encoding: chunked\r\nContent-Length: 5\r\n", "HTTP/1.1 400 Bad Request\r\n"},
+	}
+	for _, tt := range tests {
+		// Test: A request smuggled behind a Transfer-Encoding body never reaches the handler
+		var mu sync.Mutex
+		targets := []string{}
+		conn, r := serveConn(t, func(w *response.Writer, req *request.Request) {
+			mu.Lock()
+			targets = append(targets, req.RequestLine.Method+" "+req.RequestLine.RequestTarget)
+			mu.Unlock()
+			echoHandler(w, req)
+		})
+		go io.WriteString(conn, "POST / HTTP/1.1\r\n"+
+			"Host: localhost:42069\r\n"+
+			tt.headers+
+			"\r\n"+
+			"0\r\n"+
+			"\r\n"+
+			"GET /admin HTTP/1.1\r\n"+
+			"Host: localhost:42069\r\n"+
+			"\r\n")
+		assert.Contains(t, readResponseHead(t, r), tt.status, tt.name)
+
+		// Test: The connection is closed rather than read past the refused request
+		_, err := io.ReadAll(r)
+		require.NoError(t, err, tt.name)
+		mu.Lock()
+		assert.Empty(t, targets, tt.name)
+		mu.Unlock()
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	// Test: CONNECT without a connect handler is refused
+	conn, r := serveConn(t, echoHandler)
+	go io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	head := readResponseHead(t, r)
+	assert.Contains(t, head, "HTTP/1.1 405 Method Not Allowed\r\n")
+	assert.Contains(t, head, "Allow: ")
+
+	// Test: The connect handler gets the connection, bytes sent early included
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	got := make(chan string, 1)
+	s := newServer(echoHandler, WithConnectHandler(func(conn net.Conn, req *request.Request) {
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		early := make([]byte, 5)
+		io.ReadFull(conn, early)
+		got <- req.RequestLine.RequestTarget + " " + string(early)
+	}))
+	go s.handle(serverConn)
+
+	go io.WriteString(clientConn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\nhello")
+	r = bufio.NewReader(clientConn)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n\r\n", readResponseHead(t, r))
+	assert.Equal(t, "example.com:443 hello", <-got)
+}
+
+func TestServerHijack(t *testing.T) {
+	// Test: A hijacked connection belongs to the handler, early bytes included
+	done := make(chan struct{})
+	conn, r := serveConn(t, func(w *response.Writer, req *request.Request) {
+		hijacked, reader, err := w.Hijack()
+		require.NoError(t, err)
+		go func() {
+			defer close(done)
+			defer hijacked.Close()
+			io.WriteString(hijacked, "HTTP/1.1 101 Switching Protocols\r\n\r\n")
+			line, _ := reader.ReadString('\n')
+			io.WriteString(hijacked, "got "+line)
+		}()
+	})
+	go io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: localhost:42069\r\n\r\nping\n")
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n\r\n", readResponseHead(t, r))
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "got ping\n", line)
+
+	// Test: The server wrote nothing after the handler returned
+	<-done
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+}
+
+func TestServerRequestContext(t *testing.T) {
+	// Test: A client that hangs up cancels the running handler's context
+	causes := make(chan error, 1)
+	conn, _ := serveConn(t, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		causes <- context.Cause(req.Context())
+	})
+	_, err := io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	require.NoError(t, err)
+	conn.Close()
+	select {
+	case cause := <-causes:
+		assert.ErrorIs(t, cause, ErrClientDisconnected)
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled on disconnect")
+	}
+
+	// Test: A pipelined request neither cancels the first nor loses its bytes to the watcher
+	var mu sync.Mutex
+	var done []context.Context
+	conn, r := serveConn(t, func(w *response.Writer, req *request.Request) {
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, req.Context().Err())
+		mu.Lock()
+		done = append(done, req.Context())
+		mu.Unlock()
+		echoHandler(w, req)
+	})
+	go io.WriteString(conn, "POST /a HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 1\r\n\r\na"+
+		"POST /b HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 1\r\n\r\nb")
+	for _, want := range []string{"a", "b"} {
+		assert.Contains(t, readResponseHead(t, r), "HTTP/1.1 200 OK\r\n")
+		body := make([]byte, 1)
+		_, err := io.ReadFull(r, body)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(body))
+	}
+
+	// Test: The context ends with the handler, which for the first one was before the second
+	// response went out
+	mu.Lock()
+	assert.Error(t, done[0].Err())
+	mu.Unlock()
+
+	// Test: The handler deadline applies
+	conn, r = serveConn(t, func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		causes <- req.Context().Err()
+	}, WithHandlerTimeout(10*time.Millisecond))
+	go io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	assert.Equal(t, context.DeadlineExceeded, <-causes)
+	readResponseHead(t, r)
+
+	// Test: Closing the server cancels requests in flight
+	s := newServer(func(w *response.Writer, req *request.Request) {
+		<-req.Context().Done()
+		causes <- context.Cause(req.Context())
+	})
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go s.handle(serverConn)
+	go io.WriteString(clientConn, "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, <-causes, ErrServerClosed)
+}
+
+// selfSignedCert makes a certificate for the given host names that is valid for an hour.
+func selfSignedCert(t *testing.T, hosts ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServerConnectionInfo(t *testing.T) {
+	reqs := make(chan *request.Request, 2)
+	handler := func(w *response.Writer, req *request.Request) {
+		reqs <- req
+		echoHandler(w, req)
+	}
+
+	// Test: Addresses and the request's place on a keep-alive connection are filled in
+	conn, r := serveConn(t, handler)
+	for _, want := range []int{1, 2} {
+		go io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\n")
+		readResponseHead(t, r)
+		req := <-reqs
+		assert.Equal(t, want, req.ConnSeq)
+		assert.Equal(t, "pipe", req.RemoteAddr)
+		assert.Equal(t, "pipe", req.LocalAddr)
+		assert.Nil(t, req.TLS)
+	}
+
+	// Test: Requests over TLS carry the negotiated session
+	cert := selfSignedCert(t, "example.test")
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	s := newServer(handler)
+	go s.handle(tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"http/1.1"},
+	}))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := tls.Client(clientConn, &tls.Config{
+		ServerName: "example.test",
+		RootCAs:    pool,
+		NextProtos: []string{"http/1.1"},
+	})
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: example.test\r\n\r\n")
+	readResponseHead(t, bufio.NewReader(client))
+	req := <-reqs
+	require.NotNil(t, req.TLS)
+	assert.True(t, req.TLS.HandshakeComplete)
+	assert.Equal(t, "example.test", req.TLS.ServerName)
+	assert.Equal(t, "http/1.1", req.TLS.NegotiatedProtocol)
+	assert.Equal(t, 1, req.ConnSeq)
+}
+
+func TestServerH2C(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		body := []byte(req.RequestLine.HttpVersion)
+		w.WriteRequestLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, WithH2C())
+	require.NoError(t, err)
+	defer s.Close()
+	url := "http://" + s.listener.Addr().String() + "/"
+
+	// Test: Clients with prior knowledge are served HTTP/2
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "2", string(body))
+
+	// Test: HTTP/1.1 clients on the same port are unaffected
+	resp, err = http.Get(url)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "1.1", string(body))
+
+	// Test: An upgrade request switches protocols and the server's SETTINGS follow
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.test\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	head := readResponseHead(t, r)
+	assert.Contains(t, head, "HTTP/1.1 101 Switching Protocols\r\n")
+	assert.Contains(t, head, "Upgrade: h2c\r\n")
+	frameHeader := make([]byte, 9)
+	_, err = io.ReadFull(r, frameHeader)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x4), frameHeader[3])
+}
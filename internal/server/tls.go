@@ -0,0 +1,267 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/response"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultReloadInterval is how often ServeTLS checks its certificate files for changes.
+const DefaultReloadInterval = 10 * time.Second
+
+// ServeTLS is Serve over TLS, presenting the certificate in certFile with the private key in
+// keyFile. The files are read again when they change on disk or the process receives SIGHUP,
+// so a renewed certificate is picked up without a restart. For several certificates picked by
+// host name, fill a CertStore and pass its TLSConfig to ServeTLSConfig.
+func ServeTLS(port int, handler Handler, certFile, keyFile string, opts ...Option) (*Server, error) {
+	store := NewCertStore()
+	if err := store.Add(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	stop := store.Watch(DefaultReloadInterval)
+	s, err := ServeTLSConfig(port, handler, store.TLSConfig(), opts...)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	s.onClose = append(s.onClose, stop)
+	return s, nil
+}
+
+// ServeTLSConfig is Serve over TLS with the given configuration, which must supply a
+// certificate. The server always offers http/1.1 through ALPN, and needs at least TLS 1.2
+// unless config asks otherwise. config is copied, so it can't be changed once the server runs.
+func ServeTLSConfig(port int, handler Handler, config *tls.Config, opts ...Option) (*Server, error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil) {
+		return nil, errors.New("TLS configuration has no certificate")
+	}
+	config = config.Clone()
+	if !slices.Contains(config.NextProtos, "http/1.1") {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	s := newServer(handler, opts...)
+	s.listener = tls.NewListener(listener, config)
+	go s.listen()
+	return s, nil
+}
+
+// handshake completes the TLS handshake on conn within readTimeout. A client that spoke plain
+// HTTP to the TLS port is told so in plain HTTP.
+func handshake(conn *tls.Conn) bool {
+	conn.SetDeadline(time.Now().Add(readTimeout))
+	defer conn.SetDeadline(time.Time{})
+	err := conn.Handshake()
+	if err == nil {
+		return true
+	}
+
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) && recordErr.Conn != nil && looksLikeHTTP(recordErr.RecordHeader[:]) {
+		w := response.NewWriter(recordErr.Conn)
+		w.SetHttpVersion("1.0")
+		w.WriteRequestLine(response.StatusBadRequest)
+		body := []byte("Client sent an HTTP request to an HTTPS server.")
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	return false
+}
+
+// looksLikeHTTP reports whether the first five bytes of a connection could start a request line.
+func looksLikeHTTP(header []byte) bool {
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT"} {
+		start := method + " "
+		if strings.HasPrefix(start, string(header)) || strings.HasPrefix(string(header), start) {
+			return true
+		}
+	}
+	return false
+}
+
+// CertStore holds the certificates a TLS server presents and picks one by the host name the
+// client asks for through SNI. A name matches a certificate's DNS names exactly, or through a
+// wildcard that covers one label ("*.example.com" matches "www.example.com" only). Clients that
+// send no name, or one no certificate covers, get the first certificate added.
+//
+// Certificates are loaded from files so they can be reloaded in place; see Reload and Watch.
+type CertStore struct {
+	mu    sync.RWMutex
+	pairs []*certPair
+}
+
+type certPair struct {
+	certFile, keyFile string
+	cert              *tls.Certificate
+	certMod, keyMod   time.Time
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{}
+}
+
+// Add loads the certificate in certFile with the private key in keyFile.
+func (cs *CertStore) Add(certFile, keyFile string) error {
+	pair := &certPair{certFile: certFile, keyFile: keyFile}
+	if err := pair.load(); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.pairs = append(cs.pairs, pair)
+	return nil
+}
+
+// TLSConfig returns a configuration that serves the store's certificates.
+func (cs *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: cs.GetCertificate}
+}
+
+// GetCertificate has the signature of tls.Config.GetCertificate.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	if len(cs.pairs) == 0 {
+		return nil, errors.New("no certificates loaded")
+	}
+
+	name := normalizeHost(hello.ServerName)
+	var wildcard *tls.Certificate
+	for _, pair := range cs.pairs {
+		if pair.cert.Leaf == nil {
+			continue
+		}
+		for _, dnsName := range pair.cert.Leaf.DNSNames {
+			dnsName = strings.ToLower(dnsName)
+			if dnsName == name {
+				return pair.cert, nil
+			}
+			if wildcard == nil && matchesWildcard(dnsName, name) {
+				wildcard = pair.cert
+			}
+		}
+	}
+	if wildcard != nil {
+		return wildcard, nil
+	}
+	return cs.pairs[0].cert, nil
+}
+
+func matchesWildcard(pattern, name string) bool {
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, ok := strings.Cut(name, ".")
+	return ok && label != "" && rest == suffix
+}
+
+// Reload reads every certificate whose files changed since they were last loaded. A pair that
+// fails to load keeps serving its previous certificate, so a renewal caught halfway through
+// being written is picked up on the next try instead of taking the server down.
+func (cs *CertStore) Reload() error {
+	return cs.reload(false)
+}
+
+func (cs *CertStore) reload(force bool) error {
+	cs.mu.RLock()
+	pairs := slices.Clone(cs.pairs)
+	cs.mu.RUnlock()
+
+	var errs []error
+	for _, pair := range pairs {
+		if !force && !pair.changed() {
+			continue
+		}
+		next := &certPair{certFile: pair.certFile, keyFile: pair.keyFile}
+		if err := next.load(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		cs.mu.Lock()
+		if i := slices.Index(cs.pairs, pair); i >= 0 {
+			cs.pairs[i] = next
+		}
+		cs.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Watch checks the certificate files for changes every interval and reloads every certificate
+// when the process receives SIGHUP, until the returned function is called. Failures are
+// logged.
+func (cs *CertStore) Watch(interval time.Duration) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err = cs.reload(false)
+			case <-hup:
+				err = cs.reload(true)
+			}
+			if err != nil {
+				log.Printf("Error reloading certificates: %v", err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(hup)
+			close(done)
+			<-finished
+		})
+	}
+}
+
+func (p *certPair) load() error {
+	certMod, keyMod := modTime(p.certFile), modTime(p.keyFile)
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", p.certFile, err)
+	}
+	p.cert = &cert
+	p.certMod, p.keyMod = certMod, keyMod
+	return nil
+}
+
+func (p *certPair) changed() bool {
+	return !modTime(p.certFile).Equal(p.certMod) || !modTime(p.keyFile).Equal(p.keyMod)
+}
+
+// modTime returns when file was last changed, or the zero time if it can't be read.
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertFiles stores cert and its key as PEM files in dir and returns their paths.
+func writeCertFiles(t *testing.T, dir string, cert tls.Certificate) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600))
+	return certFile, keyFile
+}
+
+// setModTime makes both files look changed at the given time, which a quick rewrite in a test
+// may not do by itself.
+func setModTime(t *testing.T, at time.Time, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		require.NoError(t, os.Chtimes(file, at, at))
+	}
+}
+
+func servedName(t *testing.T, cs *CertStore, serverName string) string {
+	t.Helper()
+	cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	require.NoError(t, err)
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestCertStore(t *testing.T) {
+	cs := NewCertStore()
+	defaultCert, defaultKey := writeCertFiles(t, t.TempDir(), selfSignedCert(t, "default.test"))
+	require.NoError(t, cs.Add(defaultCert, defaultKey))
+	require.NoError(t, cs.Add(writeCertFiles(t, t.TempDir(), selfSignedCert(t, "*.example.test"))))
+	require.NoError(t, cs.Add(writeCertFiles(t, t.TempDir(), selfSignedCert(t, "api.example.test"))))
+
+	// Test: The certificate is picked by the name the client asks for
+	assert.Equal(t, "api.example.test", servedName(t, cs, "API.example.test"))
+	assert.Equal(t, "*.example.test", servedName(t, cs, "www.example.test"))
+
+	// Test: Wildcards cover one label, and anything else gets the first certificate
+	assert.Equal(t, "default.test", servedName(t, cs, "a.b.example.test"))
+	assert.Equal(t, "default.test", servedName(t, cs, "example.test"))
+	assert.Equal(t, "default.test", servedName(t, cs, ""))
+
+	// Test: Files that have not changed are not read again
+	require.NoError(t, cs.Reload())
+	assert.Equal(t, "default.test", servedName(t, cs, ""))
+
+	// Test: A replaced certificate is served after a reload
+	writeCertFiles(t, filepath.Dir(defaultCert), selfSignedCert(t, "renewed.test"))
+	setModTime(t, time.Now().Add(time.Minute), defaultCert, defaultKey)
+	require.NoError(t, cs.Reload())
+	assert.Equal(t, "renewed.test", servedName(t, cs, ""))
+
+	// Test: A certificate that fails to load leaves the previous one in place
+	require.NoError(t, os.WriteFile(defaultKey, []byte("half written"), 0o600))
+	setModTime(t, time.Now().Add(2*time.Minute), defaultKey)
+	assert.Error(t, cs.Reload())
+	assert.Equal(t, "renewed.test", servedName(t, cs, ""))
+
+	// Test: Files that cannot be loaded are refused up front
+	assert.Error(t, cs.Add(defaultCert, defaultKey))
+	assert.Error(t, cs.Add(filepath.Join(t.TempDir(), "missing.pem"), defaultKey))
+}
+
+func TestCertStoreWatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGHUP cannot be sent on windows")
+	}
+	certFile, keyFile := writeCertFiles(t, t.TempDir(), selfSignedCert(t, "first.test"))
+	cs := NewCertStore()
+	require.NoError(t, cs.Add(certFile, keyFile))
+	stop := cs.Watch(time.Hour)
+	defer func() { stop() }()
+
+	// Test: SIGHUP reloads certificates even when their files look unchanged
+	info, err := os.Stat(certFile)
+	require.NoError(t, err)
+	writeCertFiles(t, filepath.Dir(certFile), selfSignedCert(t, "second.test"))
+	setModTime(t, info.ModTime(), certFile, keyFile)
+	require.NoError(t, cs.Reload())
+	require.Equal(t, "first.test", servedName(t, cs, ""))
+
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, process.Signal(syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		return servedName(t, cs, "") == "second.test"
+	}, time.Second, 5*time.Millisecond)
+
+	// Test: Changed files are found by polling
+	stop()
+	stop = cs.Watch(5 * time.Millisecond)
+	writeCertFiles(t, filepath.Dir(certFile), selfSignedCert(t, "third.test"))
+	setModTime(t, time.Now().Add(time.Minute), certFile, keyFile)
+	assert.Eventually(t, func() bool {
+		return servedName(t, cs, "") == "third.test"
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestServeTLS(t *testing.T) {
+	cert := selfSignedCert(t, "localhost")
+	certFile, keyFile := writeCertFiles(t, t.TempDir(), cert)
+	s, err := ServeTLS(0, echoHandler, certFile, keyFile)
+	require.NoError(t, err)
+	defer s.Close()
+	addr := s.listener.Addr().String()
+
+	// Test: Requests are served over TLS with http/1.1 chosen through ALPN
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    pool,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	_, err = io.WriteString(conn, "GET /tls HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	// Test: Versions older than TLS 1.2 are refused
+	_, err = tls.Dial("tcp", addr, &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    pool,
+		MaxVersion: tls.VersionTLS11,
+	})
+	assert.Error(t, err)
+
+	// Test: A client speaking plain HTTP to the TLS port is told so
+	plain, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = io.WriteString(plain, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(bufio.NewReader(plain), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// Test: A configuration without a certificate is refused
+	_, err = ServeTLSConfig(0, echoHandler, &tls.Config{})
+	assert.Error(t, err)
+}
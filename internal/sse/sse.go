@@ -0,0 +1,247 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeat is how often an idle stream sends a comment, unless WithHeartbeat says
+// otherwise. It keeps proxies from timing the connection out and finds clients that have gone
+// away.
+const DefaultHeartbeat = 15 * time.Second
+
+var ErrClosed = errors.New("event stream is closed")
+
+// Event is one message on the stream. Data may span several lines. A message with neither Data
+// nor Event only updates the client's last event ID or reconnection time.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry, if set, tells the client how long to wait before reconnecting.
+	Retry time.Duration
+}
+
+type Option func(*Stream)
+
+// WithHeartbeat sets how often a comment is sent to keep the stream alive. An interval of 0
+// turns heartbeats off, leaving disconnects to be found by the next Send.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(s *Stream) {
+		s.heartbeat = interval
+	}
+}
+
+// WithRetry sends the client's reconnection time as soon as the stream opens.
+func WithRetry(retry time.Duration) Option {
+	return func(s *Stream) {
+		s.retry = retry
+	}
+}
+
+// Stream writes Server-Sent Events (the text/event-stream format from the HTML standard) to a
+// response. Send and Comment may be called from several goroutines.
+type Stream struct {
+	w           *response.Writer
+	lastEventID string
+	heartbeat   time.Duration
+	retry       time.Duration
+
+	mu        sync.Mutex
+	err       error
+	done      chan struct{}
+	stop      chan struct{}
+	ticker    sync.WaitGroup
+	stopWatch func() bool
+}
+
+// NewStream starts an event stream as the response to req: a 200 with Content-Type
+// text/event-stream, no caching and chunked framing, followed by heartbeats until Close. The
+// stream ends by itself once req's context is done, which for the server's requests includes
+// the client disconnecting. The handler should call Close before it returns.
+func NewStream(w *response.Writer, req *request.Request, opts ...Option) (*Stream, error) {
+	s := &Stream{
+		w:         w,
+		heartbeat: DefaultHeartbeat,
+		done:      make(chan struct{}),
+		stop:      make(chan struct{}),
+	}
+	s.lastEventID, _ = req.Headers.Get("Last-Event-ID")
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := w.WriteRequestLine(response.StatusOK); err != nil {
+		return nil, err
+	}
+	err := w.WriteHeaders(headers.Headers{
+		"Content-Type":      "text/event-stream",
+		"Cache-Control":     "no-cache",
+		"Transfer-Encoding": "chunked",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.retry > 0 {
+		if err := s.Send(Event{Retry: s.retry}); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := req.Context()
+	s.stopWatch = context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.err == nil {
+			s.end(context.Cause(ctx))
+		}
+	})
+	if s.heartbeat > 0 {
+		s.ticker.Add(1)
+		go s.runHeartbeat()
+	}
+	return s, nil
+}
+
+// LastEventID returns the ID of the last event a reconnecting client saw, from its
+// Last-Event-ID header, so the handler can resume after it. It is empty on a first connection.
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream cannot be written to any more, because the client went away,
+// the request's context ended or Close was called.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the stream ended, or nil while it is still open.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Send writes e and flushes it to the client. An ID or event name that spans lines, or an ID
+// with a NUL in it, is refused since the client would not read it back the same.
+func (s *Stream) Send(e Event) error {
+	msg, err := formatEvent(e)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+// Comment writes text as a comment, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(":" + prefixSpace(line) + "\n")
+	}
+	b.WriteString("\n")
+	return s.write([]byte(b.String()))
+}
+
+// Close stops the heartbeats. The response ends when the handler returns.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.err == nil {
+		s.end(ErrClosed)
+	}
+	s.mu.Unlock()
+	s.stopWatch()
+	s.ticker.Wait()
+	return nil
+}
+
+func (s *Stream) write(msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	_, err := s.w.WriteChunkedBody(msg)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.end(err)
+	}
+	return err
+}
+
+// end records why the stream is over. It is called with mu held.
+func (s *Stream) end(err error) {
+	s.err = err
+	close(s.done)
+	close(s.stop)
+}
+
+func (s *Stream) runHeartbeat() {
+	defer s.ticker.Done()
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if s.write([]byte(":\n\n")) != nil {
+				return
+			}
+		}
+	}
+}
+
+func formatEvent(e Event) ([]byte, error) {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return nil, errors.New("event id " + strconv.Quote(e.ID) + " is incorrect")
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return nil, errors.New("event name " + strconv.Quote(e.Event) + " is incorrect")
+	}
+
+	var b strings.Builder
+	if e.Event != "" {
+		b.WriteString("event:" + prefixSpace(e.Event) + "\n")
+	}
+	if e.Data != "" || e.Event != "" {
+		for _, line := range splitLines(e.Data) {
+			b.WriteString("data:" + prefixSpace(line) + "\n")
+		}
+	}
+	if e.ID != "" {
+		b.WriteString("id:" + prefixSpace(e.ID) + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	if b.Len() == 0 {
+		return nil, errors.New("event is empty")
+	}
+	b.WriteString("\n")
+	return []byte(b.String()), nil
+}
+
+// splitLines splits on any of the line endings the event stream format accepts.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
+
+// prefixSpace puts the space after a field name. The client strips exactly one space there, so
+// a value that starts with a space of its own keeps it.
+func prefixSpace(value string) string {
+	if value == "" {
+		return ""
+	}
+	return " " + value
+}
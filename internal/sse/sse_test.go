@@ -0,0 +1,153 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a Buffer the heartbeat goroutine and the test can share.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	broken atomic.Bool
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	if sb.broken.Load() {
+		return 0, errors.New("connection reset by peer")
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func newRequest(h headers.Headers) *request.Request {
+	if h == nil {
+		h = headers.Headers{}
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/events", HttpVersion: "1.1"},
+		Headers:     h,
+	}
+}
+
+func TestFormatEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{"data only", Event{Data: "hello"}, "data: hello\n\n"},
+		{"all fields", Event{ID: "7", Event: "log", Data: "line", Retry: 3 * time.Second}, "event: log\ndata: line\nid: 7\nretry: 3000\n\n"},
+		{"every line ending", Event{Data: "a\nb\r\nc\rd"}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+		{"empty lines are kept", Event{Data: "a\n\nb\n"}, "data: a\ndata:\ndata: b\ndata:\n\n"},
+		{"leading space survives", Event{Data: " indented"}, "data:  indented\n\n"},
+		{"event with no data", Event{Event: "ping"}, "event: ping\ndata:\n\n"},
+		{"id update only", Event{ID: "42"}, "id: 42\n\n"},
+	}
+	for _, tt := range tests {
+		// Test: Fields are written the way the event stream format reads them back
+		got, err := formatEvent(tt.event)
+		require.NoError(t, err, tt.name)
+		assert.Equal(t, tt.want, string(got), tt.name)
+	}
+
+	// Test: Fields that cannot be written are refused
+	for _, e := range []Event{{ID: "a\nb", Data: "x"}, {ID: "a\x00b", Data: "x"}, {Event: "a\rb", Data: "x"}, {}} {
+		_, err := formatEvent(e)
+		assert.Error(t, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	buf := &syncBuffer{}
+	w := response.NewWriter(buf)
+	s, err := NewStream(w, newRequest(headers.Headers{"last-event-id": "41"}), WithHeartbeat(0), WithRetry(time.Second))
+	require.NoError(t, err)
+
+	// Test: A reconnecting client's last event ID is available to the handler
+	assert.Equal(t, "41", s.LastEventID())
+
+	// Test: Each event goes out as soon as it is sent
+	require.NoError(t, s.Send(Event{ID: "42", Data: "first\nsecond"}))
+	assert.True(t, strings.HasSuffix(buf.String(), "data: first\ndata: second\nid: 42\n\n\r\n"))
+	require.NoError(t, s.Comment("still here"))
+
+	// Test: The stream ends as a well-formed chunked response
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+	require.NoError(t, w.Finish())
+
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(buf.String())), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("Cache-Control"))
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "retry: 1000\n\ndata: first\ndata: second\nid: 42\n\n: still here\n\n", string(body))
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	// Test: An idle stream sends heartbeat comments
+	buf := &syncBuffer{}
+	s, err := NewStream(response.NewWriter(buf), newRequest(nil), WithHeartbeat(5*time.Millisecond))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), "3\r\n:\n\n\r\n")
+	}, time.Second, time.Millisecond)
+	require.NoError(t, s.Close())
+
+	// Test: A client that went away is found by the heartbeat
+	buf = &syncBuffer{}
+	s, err = NewStream(response.NewWriter(buf), newRequest(nil), WithHeartbeat(5*time.Millisecond))
+	require.NoError(t, err)
+	buf.broken.Store(true)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("disconnect was not detected")
+	}
+	assert.Error(t, s.Err())
+	assert.Error(t, s.Send(Event{Data: "lost"}))
+	require.NoError(t, s.Close())
+}
+
+func TestStreamContext(t *testing.T) {
+	// Test: The stream ends when the request's context does
+	ctx, cancel := context.WithCancelCause(context.Background())
+	req := newRequest(nil).WithContext(ctx)
+	s, err := NewStream(response.NewWriter(&syncBuffer{}), req, WithHeartbeat(0))
+	require.NoError(t, err)
+	gone := errors.New("client disconnected")
+	cancel(gone)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream did not end with the context")
+	}
+	assert.ErrorIs(t, s.Err(), gone)
+	assert.ErrorIs(t, s.Send(Event{Data: "lost"}), gone)
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,374 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxMessageSize is the largest message a Conn accepts unless WithMaxMessageSize says
+	// otherwise.
+	DefaultMaxMessageSize = 1 << 20
+
+	// closeTimeout is how long Close waits for the peer to answer the closing handshake.
+	closeTimeout = 5 * time.Second
+)
+
+// Close codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	// CloseNoStatus is reported when a close frame carried no code. It is never sent.
+	CloseNoStatus = 1005
+	// CloseAbnormal is reported when the connection ended without a close frame. It is never
+	// sent.
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = opText
+	BinaryMessage MessageType = opBinary
+)
+
+var (
+	ErrMessageTooBig = errors.New("websocket message is too big")
+	ErrInvalidUTF8   = errors.New("websocket text is not valid UTF-8")
+	ErrCloseSent     = errors.New("websocket close frame has already been sent")
+)
+
+// CloseError is what ReadMessage returns once the peer has closed the connection, with the code
+// and reason from its close frame.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Conn is one end of a WebSocket connection. One goroutine may read while others write: whole
+// messages are never interleaved with each other, and control frames are slipped in between
+// the fragments of a message as RFC 6455 allows.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	client         bool
+	subprotocol    string
+	maxMessageSize int64
+
+	readMu      sync.Mutex
+	readErr     error
+	pongHandler func(data []byte)
+
+	// messageMu is held while a data message is written, writeMu while a single frame is.
+	messageMu sync.Mutex
+	writeMu   sync.Mutex
+	closeSent bool
+
+	peerClosed    chan struct{}
+	peerCloseOnce sync.Once
+}
+
+// newConn wraps a connection the handshake has completed on. reader has to read from conn,
+// holding whatever was already read past the handshake. A client masks its frames and expects
+// the server's to be unmasked; a server expects the opposite.
+func newConn(conn net.Conn, reader *bufio.Reader, client bool, subprotocol string, maxMessageSize int64) *Conn {
+	return &Conn{
+		conn:           conn,
+		reader:         reader,
+		client:         client,
+		subprotocol:    subprotocol,
+		maxMessageSize: maxMessageSize,
+		peerClosed:     make(chan struct{}),
+	}
+}
+
+// Subprotocol returns the subprotocol agreed on in the handshake, or "" if there is none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// OnPong sets a function to be called with the payload of every pong that arrives. It is called
+// from ReadMessage, so it must not block and has to be set before reading starts.
+func (c *Conn) OnPong(fn func(data []byte)) {
+	c.pongHandler = fn
+}
+
+// ReadMessage reads the next complete message, joining its fragments. Pings are answered and
+// pongs handed to OnPong along the way. Once the peer closes the connection ReadMessage answers
+// the close and returns a *CloseError. A message bigger than the limit, text that is not UTF-8
+// or a frame that breaks the protocol closes the connection with the matching code instead.
+// After an error, every call returns the same error.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, msg, err := c.readMessage()
+	if err != nil {
+		c.readErr = err
+	}
+	return typ, msg, err
+}
+
+func (c *Conn) readMessage() (MessageType, []byte, error) {
+	var typ MessageType
+	var msg []byte
+	for {
+		h, err := readFrameHeader(c.reader)
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		if h.masked == c.client {
+			return 0, nil, c.fail(fmt.Errorf("%w: frame masking is wrong for its sender", ErrProtocol))
+		}
+
+		if h.isControl() {
+			payload, err := readPayload(c.reader, h)
+			if err != nil {
+				return 0, nil, c.fail(err)
+			}
+			if err := c.handleControl(h.opcode, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		switch {
+		case h.opcode == opContinuation && typ == 0:
+			return 0, nil, c.fail(fmt.Errorf("%w: continuation frame without a message", ErrProtocol))
+		case h.opcode != opContinuation && typ != 0:
+			return 0, nil, c.fail(fmt.Errorf("%w: new message before the last one ended", ErrProtocol))
+		case h.opcode != opContinuation:
+			typ = MessageType(h.opcode)
+		}
+		// Check the size before reading, so an oversized message is never buffered.
+		if int64(len(msg))+h.length > c.maxMessageSize {
+			return 0, nil, c.fail(ErrMessageTooBig)
+		}
+		payload, err := readPayload(c.reader, h)
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		msg = append(msg, payload...)
+
+		if h.fin {
+			if typ == TextMessage && !utf8.Valid(msg) {
+				return 0, nil, c.fail(ErrInvalidUTF8)
+			}
+			if msg == nil {
+				msg = []byte{}
+			}
+			return typ, msg, nil
+		}
+	}
+}
+
+func (c *Conn) handleControl(opcode byte, payload []byte) error {
+	switch opcode {
+	case opPing:
+		if err := c.writeFrame(true, opPong, payload); err != nil && !errors.Is(err, ErrCloseSent) {
+			return c.fail(err)
+		}
+	case opPong:
+		if c.pongHandler != nil {
+			c.pongHandler(payload)
+		}
+	case opClose:
+		closeErr := &CloseError{Code: CloseNoStatus}
+		switch {
+		case len(payload) == 1:
+			return c.fail(fmt.Errorf("%w: close frame is one byte long", ErrProtocol))
+		case len(payload) >= 2:
+			closeErr.Code = int(binary.BigEndian.Uint16(payload))
+			closeErr.Reason = string(payload[2:])
+			if !isCloseCodeCorrect(closeErr.Code) {
+				return c.fail(fmt.Errorf("%w: close code %d is not allowed", ErrProtocol, closeErr.Code))
+			}
+			if !utf8.ValidString(closeErr.Reason) {
+				return c.fail(ErrInvalidUTF8)
+			}
+		}
+
+		// Answer with the same code, unless this end started the closing handshake. Either
+		// way it is complete now, and the server is the one that closes TCP (section 7.1.1).
+		c.writeClose(closeErr.Code, "")
+		c.peerCloseOnce.Do(func() { close(c.peerClosed) })
+		if !c.client {
+			c.conn.Close()
+		}
+		return closeErr
+	}
+	return nil
+}
+
+// fail ends the connection over err. Errors this end detected in what the peer sent are
+// reported to it with the matching close code first; a connection that broke is just closed,
+// and one that ended without a close frame is reported as CloseAbnormal.
+func (c *Conn) fail(err error) error {
+	code := 0
+	switch {
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	case errors.Is(err, ErrInvalidUTF8):
+		code = CloseInvalidPayload
+	}
+	if code != 0 {
+		c.writeClose(code, err.Error())
+	}
+	c.conn.Close()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &CloseError{Code: CloseAbnormal, Reason: err.Error()}
+	}
+	return err
+}
+
+func isCloseCodeCorrect(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		// Registered with IANA or private.
+		return true
+	}
+	return false
+}
+
+// WriteMessage sends data as a single frame.
+func (c *Conn) WriteMessage(typ MessageType, data []byte) error {
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	return c.writeFrame(true, byte(typ), data)
+}
+
+// NextWriter starts a message that is sent a fragment per Write, for messages that are produced
+// piece by piece. The message ends when the writer is closed, and no other message can be sent
+// until then.
+func (c *Conn) NextWriter(typ MessageType) (io.WriteCloser, error) {
+	c.messageMu.Lock()
+	return &messageWriter{c: c, opcode: byte(typ)}, nil
+}
+
+type messageWriter struct {
+	c      *Conn
+	opcode byte
+	closed bool
+}
+
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, errors.New("websocket message is already finished")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := mw.c.writeFrame(false, mw.opcode, p); err != nil {
+		return 0, err
+	}
+	mw.opcode = opContinuation
+	return len(p), nil
+}
+
+func (mw *messageWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+	defer mw.c.messageMu.Unlock()
+	return mw.c.writeFrame(true, mw.opcode, nil)
+}
+
+// Ping sends a ping with data, which may be at most 125 bytes. The answer arrives through
+// OnPong while the connection is being read.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket ping payload is too long")
+	}
+	return c.writeFrame(true, opPing, data)
+}
+
+// Close starts the closing handshake with code and reason, waits up to a few seconds for the
+// peer to answer, then closes the connection. If another goroutine is in ReadMessage it sees
+// the peer's answer as a *CloseError; otherwise Close reads, and drops, whatever the peer still
+// sends before its close frame. Calling Close after the peer closed just closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+	err := c.writeClose(code, reason)
+	if errors.Is(err, ErrCloseSent) {
+		err = nil
+	}
+
+	if c.readMu.TryLock() {
+		c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+		for c.readErr == nil {
+			if _, _, readErr := c.readMessage(); readErr != nil {
+				c.readErr = readErr
+			}
+		}
+		c.readMu.Unlock()
+	} else {
+		timer := time.NewTimer(closeTimeout)
+		defer timer.Stop()
+		select {
+		case <-c.peerClosed:
+		case <-timer.C:
+		}
+	}
+
+	c.conn.Close()
+	return err
+}
+
+// writeClose sends a close frame, unless one was sent already. CloseNoStatus is sent as an
+// empty close frame, and the reason is cut to fit a control frame.
+func (c *Conn) writeClose(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatus {
+		if len(reason) > maxControlPayload-2 {
+			reason = reason[:maxControlPayload-2]
+			for !utf8.ValidString(reason) {
+				reason = reason[:len(reason)-1]
+			}
+		}
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	return c.writeFrame(true, opClose, payload)
+}
+
+// writeFrame sends one frame. Nothing but the close frame itself can follow a close frame.
+func (c *Conn) writeFrame(fin bool, opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == opClose {
+		// A peer that stopped reading must not hold the close up forever.
+		c.closeSent = true
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	}
+	_, err := c.conn.Write(appendFrame(nil, fin, opcode, payload, c.client))
+	return err
+}
@@ -0,0 +1,250 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pair upgrades a connection and returns the server's end along with a client for the other.
+func pair(t *testing.T, opts ...Option) (*Conn, *Conn) {
+	t.Helper()
+	server, clientConn, r, _ := upgrade(t, handshakeRequest(nil), opts...)
+	return server, newConn(clientConn, r, true, "", DefaultMaxMessageSize)
+}
+
+type message struct {
+	typ  MessageType
+	data string
+	err  error
+}
+
+// readAsync reads one message on its own goroutine, since writes on a pipe block until the
+// other end reads.
+func readAsync(c *Conn) <-chan message {
+	ch := make(chan message, 1)
+	go func() {
+		typ, data, err := c.ReadMessage()
+		ch <- message{typ, string(data), err}
+	}()
+	return ch
+}
+
+// writeRaw sends frames exactly as given, bypassing the checks a Conn makes on what it sends.
+func writeRaw(t *testing.T, conn net.Conn, frames ...[]byte) {
+	t.Helper()
+	go func() {
+		for _, frame := range frames {
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func clientFrame(fin bool, opcode byte, payload string) []byte {
+	return appendFrame(nil, fin, opcode, []byte(payload), true)
+}
+
+func TestConnMessages(t *testing.T) {
+	server, client := pair(t)
+
+	// Test: Text goes from client to server
+	got := readAsync(server)
+	require.NoError(t, client.WriteMessage(TextMessage, []byte("hello")))
+	assert.Equal(t, message{TextMessage, "hello", nil}, <-got)
+
+	// Test: Binary goes from server to client, past the 16-bit length form
+	big := strings.Repeat("x", 70000)
+	got = readAsync(client)
+	require.NoError(t, server.WriteMessage(BinaryMessage, []byte(big)))
+	assert.Equal(t, message{BinaryMessage, big, nil}, <-got)
+
+	// Test: A message written in pieces arrives whole
+	got = readAsync(server)
+	mw, err := client.NextWriter(TextMessage)
+	require.NoError(t, err)
+	for _, piece := range []string{"frag", "ment", "ed"} {
+		_, err := mw.Write([]byte(piece))
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+	assert.Equal(t, message{TextMessage, "fragmented", nil}, <-got)
+
+	// Test: An empty message is still a message
+	got = readAsync(client)
+	require.NoError(t, server.WriteMessage(TextMessage, nil))
+	assert.Equal(t, message{TextMessage, "", nil}, <-got)
+}
+
+func TestConnControlFrames(t *testing.T) {
+	server, client := pair(t)
+
+	// Test: A ping between fragments is answered without breaking up the message
+	pongs := make(chan string, 1)
+	client.OnPong(func(data []byte) { pongs <- string(data) })
+	clientGot := readAsync(client)
+	got := readAsync(server)
+	writeRaw(t, client.conn,
+		clientFrame(false, opText, "one "),
+		clientFrame(true, opPing, "are you there"),
+		clientFrame(true, opContinuation, "two"),
+	)
+	assert.Equal(t, message{TextMessage, "one two", nil}, <-got)
+	assert.Equal(t, "are you there", <-pongs)
+
+	// Test: Ping from the server is answered by the client's reader
+	serverPongs := make(chan string, 1)
+	server.OnPong(func(data []byte) { serverPongs <- string(data) })
+	got = readAsync(server)
+	require.NoError(t, server.Ping([]byte("ping")))
+	assert.Equal(t, "ping", <-serverPongs)
+	assert.Error(t, server.Ping(make([]byte, 126)))
+
+	// Test: Closing from the server completes the handshake on both ends
+	require.NoError(t, server.Close(CloseGoingAway, "shutting down"))
+	clientMsg := <-clientGot
+	var closeErr *CloseError
+	require.ErrorAs(t, clientMsg.err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+	assert.Equal(t, "shutting down", closeErr.Reason)
+	serverMsg := <-got
+	require.ErrorAs(t, serverMsg.err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+
+	// Test: Nothing can be sent after the close
+	assert.ErrorIs(t, server.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+	require.NoError(t, client.Close(CloseNormal, ""))
+}
+
+func TestConnCloseWithoutReader(t *testing.T) {
+	// Test: Close reads the peer's answer itself when nobody else is reading
+	server, client := pair(t)
+	got := readAsync(client)
+	done := make(chan error, 1)
+	go func() { done <- server.Close(CloseNormal, "") }()
+
+	msg := <-got
+	var closeErr *CloseError
+	require.ErrorAs(t, msg.err, &closeErr)
+	assert.Equal(t, CloseNormal, closeErr.Code)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the peer answered")
+	}
+
+	// Test: The error sticks
+	_, _, err := server.ReadMessage()
+	require.ErrorAs(t, err, &closeErr)
+}
+
+func TestConnFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   int
+		err    error
+	}{
+		{
+			name:   "unmasked client frame",
+			frames: [][]byte{appendFrame(nil, true, opText, []byte("hi"), false)},
+			code:   CloseProtocolError,
+			err:    ErrProtocol,
+		},
+		{
+			name:   "message over the limit across fragments",
+			frames: [][]byte{clientFrame(false, opBinary, "12345678"), clientFrame(true, opContinuation, "9abc")},
+			code:   CloseMessageTooBig,
+			err:    ErrMessageTooBig,
+		},
+		{
+			name:   "text that is not UTF-8",
+			frames: [][]byte{clientFrame(true, opText, "\xff\xfe")},
+			code:   CloseInvalidPayload,
+			err:    ErrInvalidUTF8,
+		},
+		{
+			name:   "continuation without a message",
+			frames: [][]byte{clientFrame(true, opContinuation, "x")},
+			code:   CloseProtocolError,
+			err:    ErrProtocol,
+		},
+		{
+			name:   "new message inside a fragmented one",
+			frames: [][]byte{clientFrame(false, opText, "a"), clientFrame(true, opText, "b")},
+			code:   CloseProtocolError,
+			err:    ErrProtocol,
+		},
+		{
+			name:   "fragmented ping",
+			frames: [][]byte{clientFrame(false, opPing, "x")},
+			code:   CloseProtocolError,
+			err:    ErrProtocol,
+		},
+		{
+			name:   "reserved bit",
+			frames: [][]byte{append([]byte{0xC1}, clientFrame(true, opText, "x")[1:]...)},
+			code:   CloseProtocolError,
+			err:    ErrProtocol,
+		},
+		{
+			name:   "unknown opcode",
+			frames: [][]byte{clientFrame(true, 0x3, "x")},
+			code:   CloseProtocolError,
+			err:    ErrProtocol,
+		},
+		{
+			name:   "close code that cannot be sent",
+			frames: [][]byte{clientFrame(true, opClose, string(binary.BigEndian.AppendUint16(nil, CloseAbnormal)))},
+			code:   CloseProtocolError,
+			err:    ErrProtocol,
+		},
+	}
+	for _, tt := range tests {
+		server, client := pair(t, WithMaxMessageSize(10))
+		clientGot := readAsync(client)
+		got := readAsync(server)
+		writeRaw(t, client.conn, tt.frames...)
+
+		// Test: The server closes with the code that matches the failure
+		msg := <-got
+		assert.ErrorIs(t, msg.err, tt.err, tt.name)
+		var closeErr *CloseError
+		clientMsg := <-clientGot
+		if assert.ErrorAs(t, clientMsg.err, &closeErr, tt.name) {
+			assert.Equal(t, tt.code, closeErr.Code, tt.name)
+		}
+	}
+}
+
+func TestConnAbnormalClosure(t *testing.T) {
+	// Test: A connection that drops without a close frame is reported as abnormal
+	server, client := pair(t)
+	got := readAsync(server)
+	client.conn.Close()
+	msg := <-got
+	var closeErr *CloseError
+	require.ErrorAs(t, msg.err, &closeErr)
+	assert.Equal(t, CloseAbnormal, closeErr.Code)
+}
+
+func TestConnEarlyBytes(t *testing.T) {
+	// Test: Frames that arrived with the handshake are not lost
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	r := bufio.NewReader(strings.NewReader(string(clientFrame(true, opText, "early"))))
+	conn := newConn(serverConn, r, false, "", DefaultMaxMessageSize)
+	typ, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, typ)
+	assert.Equal(t, "early", string(data))
+}
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Opcodes from RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// maxControlPayload is the most a ping, pong or close frame may carry.
+const maxControlPayload = 125
+
+var ErrProtocol = errors.New("websocket protocol error")
+
+type frameHeader struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	maskKey [4]byte
+	length  int64
+}
+
+func (h frameHeader) isControl() bool {
+	return h.opcode&0x8 != 0
+}
+
+// readFrameHeader reads the header of the next frame and checks it against what RFC 6455 allows
+// without any extension: no reserved bits, known opcodes only, and control frames that are
+// short and unfragmented.
+func readFrameHeader(r io.Reader) (frameHeader, error) {
+	var h frameHeader
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	if b[0]&0x70 != 0 {
+		return h, fmt.Errorf("%w: reserved bits are set", ErrProtocol)
+	}
+	h.fin = b[0]&0x80 != 0
+	h.opcode = b[0] & 0x0f
+	h.masked = b[1]&0x80 != 0
+	h.length = int64(b[1] & 0x7f)
+
+	switch h.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return h, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, h.opcode)
+	}
+
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return h, noEOF(err)
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, noEOF(err)
+		}
+		length := binary.BigEndian.Uint64(b[:8])
+		if length > 1<<63-1 {
+			return h, fmt.Errorf("%w: payload length is too big", ErrProtocol)
+		}
+		h.length = int64(length)
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, h.maskKey[:]); err != nil {
+			return h, noEOF(err)
+		}
+	}
+
+	if h.isControl() && (!h.fin || h.length > maxControlPayload) {
+		return h, fmt.Errorf("%w: control frame is fragmented or too long", ErrProtocol)
+	}
+	return h, nil
+}
+
+// noEOF turns an EOF in the middle of a frame into the error it really is.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readPayload reads the payload that follows h, unmasked.
+func readPayload(r io.Reader, h frameHeader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, noEOF(err)
+	}
+	if h.masked {
+		maskBytes(h.maskKey, payload)
+	}
+	return payload, nil
+}
+
+// appendFrame appends a complete frame to buf. A client masks every frame it sends with a
+// fresh key; a server never masks.
+func appendFrame(buf []byte, fin bool, opcode byte, payload []byte, mask bool) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		buf = append(buf, b0, maskBit|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b0, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b0, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if !mask {
+		return append(buf, payload...)
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	buf = append(buf, key[:]...)
+	start := len(buf)
+	buf = append(buf, payload...)
+	maskBytes(key, buf[start:])
+	return buf
+}
+
+// maskBytes applies the masking algorithm from RFC 6455 section 5.3, which is its own inverse.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+)
+
+// acceptGUID is the fixed value RFC 6455 section 4.2.2 appends to the client's key.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrBadHandshake = errors.New("request is not a valid websocket handshake")
+
+type Option func(*upgrader)
+
+// WithSubprotocols sets the subprotocols the server speaks, most preferred first. The first of
+// them the client also offers is chosen; if there is none the connection goes ahead without a
+// subprotocol and it is up to the handler whether that will do.
+func WithSubprotocols(protocols ...string) Option {
+	return func(u *upgrader) {
+		u.subprotocols = protocols
+	}
+}
+
+// WithMaxMessageSize sets the largest message the connection accepts, counting all its
+// fragments. A bigger one closes the connection with CloseMessageTooBig. It defaults to
+// DefaultMaxMessageSize.
+func WithMaxMessageSize(n int64) Option {
+	return func(u *upgrader) {
+		u.maxMessageSize = n
+	}
+}
+
+type upgrader struct {
+	subprotocols   []string
+	maxMessageSize int64
+}
+
+// Upgrade completes the opening handshake for req and takes over the connection. If req is not
+// a valid handshake Upgrade answers it through w, with 426 and the supported version if only
+// the version is wrong and with 400 otherwise, and returns an error wrapping ErrBadHandshake.
+// On success the connection belongs to the returned Conn and nothing more may be written to w.
+func Upgrade(w *response.Writer, req *request.Request, opts ...Option) (*Conn, error) {
+	u := &upgrader{maxMessageSize: DefaultMaxMessageSize}
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	key, err := checkHandshake(req)
+	if err != nil {
+		body := fmt.Appendf(nil, "%v\n", err)
+		statusCode := response.StatusBadRequest
+		h := response.GetDefaultHeaders(len(body))
+		if errors.Is(err, errWrongVersion) {
+			statusCode = response.StatusUpgradeRequired
+			h["Sec-WebSocket-Version"] = "13"
+		}
+		w.WriteRequestLine(statusCode)
+		w.WriteHeaders(h)
+		w.WriteBody(body)
+		return nil, err
+	}
+	subprotocol := selectSubprotocol(req, u.subprotocols)
+
+	conn, reader, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if subprotocol != "" {
+		handshake += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(handshake + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, reader, false, subprotocol, u.maxMessageSize), nil
+}
+
+var errWrongVersion = fmt.Errorf("%w: only version 13 is supported", ErrBadHandshake)
+
+// checkHandshake checks req against RFC 6455 section 4.2.1 and returns the client's key.
+func checkHandshake(req *request.Request) (string, error) {
+	if req.RequestLine.Method != "GET" {
+		return "", fmt.Errorf("%w: method is %s, not GET", ErrBadHandshake, req.RequestLine.Method)
+	}
+	if req.RequestLine.HttpVersion != "1.1" {
+		return "", fmt.Errorf("%w: HTTP/%s cannot be upgraded", ErrBadHandshake, req.RequestLine.HttpVersion)
+	}
+	if !req.Headers.HasToken("Connection", "upgrade") || !req.Headers.HasToken("Upgrade", "websocket") {
+		return "", fmt.Errorf("%w: upgrade to websocket is not requested", ErrBadHandshake)
+	}
+	if version, _ := req.Headers.Get("Sec-WebSocket-Version"); version != "13" {
+		return "", errWrongVersion
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	key = strings.TrimSpace(key)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", fmt.Errorf("%w: Sec-WebSocket-Key is incorrect", ErrBadHandshake)
+	}
+	return key, nil
+}
+
+// acceptKey computes Sec-WebSocket-Accept for the client's key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func selectSubprotocol(req *request.Request, supported []string) string {
+	offered, ok := req.Headers.Get("Sec-WebSocket-Protocol")
+	if !ok {
+		return ""
+	}
+	for _, protocol := range supported {
+		for _, candidate := range strings.Split(offered, ",") {
+			if strings.TrimSpace(candidate) == protocol {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
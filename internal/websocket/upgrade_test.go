@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func handshakeRequest(h headers.Headers) *request.Request {
+	base := headers.Headers{
+		"host":                  "localhost:42069",
+		"connection":            "keep-alive, Upgrade",
+		"upgrade":               "websocket",
+		"sec-websocket-version": "13",
+		"sec-websocket-key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	}
+	for k, v := range h {
+		if v == "" {
+			delete(base, k)
+		} else {
+			base[k] = v
+		}
+	}
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: "GET", RequestTarget: "/chat", HttpVersion: "1.1"},
+		Headers:     base,
+	}
+}
+
+// upgrade runs Upgrade for req on one end of an in-memory pipe and returns the server's Conn,
+// the client end of the pipe and the handshake response the client read.
+func upgrade(t *testing.T, req *request.Request, opts ...Option) (*Conn, net.Conn, *bufio.Reader, string) {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		serverConn.Close()
+		clientConn.Close()
+	})
+	w := response.NewWriter(serverConn)
+	w.SetHijacker(func() (net.Conn, *bufio.Reader) { return serverConn, bufio.NewReader(serverConn) })
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := Upgrade(w, req, opts...)
+		done <- result{conn, err}
+	}()
+
+	r := bufio.NewReader(clientConn)
+	head := ""
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+		if line == "\r\n" {
+			break
+		}
+	}
+	res := <-done
+	require.NoError(t, res.err)
+	return res.conn, clientConn, r, head
+}
+
+func TestUpgrade(t *testing.T) {
+	// Test: The accept key is derived from the client's key (RFC 6455 section 1.3)
+	conn, _, _, head := upgrade(t, handshakeRequest(nil))
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n"+
+		"\r\n", head)
+	assert.Equal(t, "", conn.Subprotocol())
+
+	// Test: The server's most preferred subprotocol the client offers is chosen
+	conn, _, _, head = upgrade(t, handshakeRequest(headers.Headers{
+		"sec-websocket-protocol": "chat.v1, chat.v2",
+	}), WithSubprotocols("chat.v2", "chat.v1"))
+	assert.Contains(t, head, "Sec-WebSocket-Protocol: chat.v2\r\n")
+	assert.Equal(t, "chat.v2", conn.Subprotocol())
+
+	// Test: No common subprotocol leaves the header out
+	conn, _, _, head = upgrade(t, handshakeRequest(headers.Headers{
+		"sec-websocket-protocol": "mqtt",
+	}), WithSubprotocols("chat.v1"))
+	assert.NotContains(t, head, "Sec-WebSocket-Protocol")
+	assert.Equal(t, "", conn.Subprotocol())
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		version    string
+		h          headers.Headers
+		statusLine string
+	}{
+		{"not GET", "POST", "1.1", nil, "HTTP/1.1 400 Bad Request\r\n"},
+		{"HTTP/1.0", "GET", "1.0", nil, "HTTP/1.0 400 Bad Request\r\n"},
+		{"no Connection upgrade", "GET", "1.1", headers.Headers{"connection": "keep-alive"}, "HTTP/1.1 400 Bad Request\r\n"},
+		{"no Upgrade", "GET", "1.1", headers.Headers{"upgrade": ""}, "HTTP/1.1 400 Bad Request\r\n"},
+		{"wrong version", "GET", "1.1", headers.Headers{"sec-websocket-version": "8"}, "HTTP/1.1 426 Upgrade Required\r\n"},
+		{"key too short", "GET", "1.1", headers.Headers{"sec-websocket-key": "c2hvcnQ="}, "HTTP/1.1 400 Bad Request\r\n"},
+		{"key not base64", "GET", "1.1", headers.Headers{"sec-websocket-key": "not a key at all!!!!!!!"}, "HTTP/1.1 400 Bad Request\r\n"},
+	}
+	for _, tt := range tests {
+		req := handshakeRequest(tt.h)
+		req.RequestLine.Method = tt.method
+		req.RequestLine.HttpVersion = tt.version
+		buf := &bytes.Buffer{}
+		w := response.NewWriter(buf)
+		w.SetHttpVersion(tt.version)
+
+		// Test: An incorrect handshake is answered over HTTP and nothing is hijacked
+		conn, err := Upgrade(w, req)
+		assert.ErrorIs(t, err, ErrBadHandshake, tt.name)
+		assert.Nil(t, conn, tt.name)
+		assert.Contains(t, buf.String(), tt.statusLine, tt.name)
+		if tt.name == "wrong version" {
+			assert.Contains(t, buf.String(), "Sec-WebSocket-Version: 13\r\n")
+		}
+	}
+}